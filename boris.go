@@ -19,74 +19,242 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	"github.com/alphazero/borisdb/config"
+	"github.com/alphazero/borisdb/logging"
 	"github.com/alphazero/borisdb/store"
 	"github.com/alphazero/borisdb/web"
-	"log"
+	"log/slog"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
 )
 
 // server configuration and options
 var option = struct {
-	port   int    // service port
-	path   string // fs store path
-	dbname string // database name
+	port       int           // service port
+	path       string        // fs store path
+	dbname     string        // database name
+	adminToken string        // static admin token
+	authReq    bool          // require tokens for read and write
+	compact    bool          // compact db offline and exit
+	maxBlob    int64         // max blob size in bytes
+	maxSize    int64         // max store size in bytes
+	maxImport  int64         // max import archive size in bytes
+	readonly   bool          // serve db in read-only mode
+	logFormat  string        // logfmt or json
+	logLevel   string        // debug, info, warn or error
+	slowOp     time.Duration // log store ops slower than this
+	minDisk    uint64        // min free disk space for readiness
+	drain      time.Duration // max wait for in-flight requests on shutdown
+	config     string        // config file path
+	printCfg   bool          // print resolved config and exit
+	dbfile     string        // resolved db file path
+	tlsCert    string        // service certificate file
+	tlsKey     string        // service key file
+	clientCA   string        // CA bundle file verifying client certificates
+	readRate   float64       // per-client reads per second
+	readBurst  int           // per-client read burst
+	writeRate  float64       // per-client writes per second
+	writeBurst int           // per-client write burst
+	segWrites  int           // max pending writes per segment
+	cacheAge   time.Duration // max-age of cacheable responses
+	uploadDir  string        // upload session staging directory
+	uploadTTL  time.Duration // expiry of idle upload sessions
+	respPort   int           // RESP front end port
+	hdrTimeout time.Duration // http read header timeout
+	wTimeout   time.Duration // http write timeout
+	idle       time.Duration // http idle connection timeout
 }{
-	port:   web.DefaultPort,
-	dbname: store.DefaultDb,
+	port:       web.DefaultPort,
+	dbname:     store.DefaultDb,
+	logFormat:  logging.Logfmt,
+	logLevel:   "info",
+	slowOp:     time.Second,
+	drain:      15 * time.Second,
+	cacheAge:   365 * 24 * time.Hour,
+	uploadTTL:  24 * time.Hour,
+	maxImport:  4 << 30,
+	hdrTimeout: web.DefaultReadHeaderTimeout,
+	wTimeout:   web.DefaultWriteTimeout,
+	idle:       web.DefaultIdleTimeout,
 }
 
+// prefix of environment variable settings, e.g. BORISDB_PORT
+const envPrefix = "BORISDB_"
+
+var log *slog.Logger
+
 /// main server process ///////////////////////////////////////////////////////
 
 func main() {
+	os.Exit(run())
+}
+
+// runs the server and returns the process exit code.
+func run() int {
 	flag.Parse()
 
-	// verify options
+	// resolve and verify options
+	if option.config == "" {
+		option.config = os.Getenv(config.EnvName(envPrefix, "config"))
+	}
+	sources, e := config.Load(flag.CommandLine, option.config, envPrefix)
+	if e != nil {
+		logging.Default().Error("invalid configuration", "error", e)
+		return 1
+	}
 	if e := initOptions(); e != nil {
-		log.Fatalf(e.Error())
+		logging.Default().Error("invalid options", "error", e)
+		return 1
+	}
+	if option.printCfg {
+		secrets := []string{"admin-token"}
+		commands := []string{"config", "print-config", "compact"}
+		config.Write(os.Stdout, flag.CommandLine, sources, secrets, commands)
+		return 0
+	}
+	if option.compact {
+		return compactDb()
 	}
-	log.Printf("info - borisdb startup ... ")
+	log.Info("borisdb startup ...")
 
 	// open store
-	db, e := store.OpenDb(option.path)
+	dbopts := &store.Options{
+		MaxBlobSize: option.maxBlob,
+		MaxSize:     option.maxSize,
+		ReadOnly:    option.readonly,
+
+		SlowOpThreshold:  option.slowOp,
+		MaxSegmentWrites: option.segWrites,
+	}
+	db, e := store.OpenDb(option.dbfile, dbopts)
 	if e != nil {
-		log.Printf("err - failed to open database - %s", e)
-		os.Exit(1)
+		log.Error("failed to open database", "error", e)
+		return 1
 	}
-	defer db.Close()
-	log.Printf("info - borisdb using db: %q", option.path)
+	log.Info("borisdb using db", "path", option.dbfile, "read-only", option.readonly)
 
 	// shutdown hooks
 	sigchan := make(chan os.Signal, 1)
-	signal.Notify(sigchan, os.Interrupt)
+	signal.Notify(sigchan, os.Interrupt, syscall.SIGTERM)
 	shutdown, shutdownFn := getShutdownHooks()
 
 	// start webserver
-	go web.RunService(option.port, db, shutdownFn)
-	log.Printf("info - borisdb listening on port %d", option.port)
+	webopts := web.Options{
+		AdminToken:        option.adminToken,
+		AuthRequired:      option.authReq,
+		MaxBlobSize:       option.maxBlob,
+		ReadOnly:          option.readonly,
+		DbPath:            option.dbfile,
+		MinDiskFree:       option.minDisk,
+		TLSCert:           option.tlsCert,
+		TLSKey:            option.tlsKey,
+		ClientCA:          option.clientCA,
+		ReadRate:          option.readRate,
+		ReadBurst:         option.readBurst,
+		WriteRate:         option.writeRate,
+		WriteBurst:        option.writeBurst,
+		CacheMaxAge:       option.cacheAge,
+		UploadDir:         option.uploadDir,
+		UploadTTL:         option.uploadTTL,
+		RESPPort:          option.respPort,
+		MaxImportSize:     option.maxImport,
+		ReadHeaderTimeout: option.hdrTimeout,
+		WriteTimeout:      option.wTimeout,
+		IdleTimeout:       option.idle,
+	}
+	svc, e := web.RunService(option.port, db, webopts, shutdownFn)
+	if e != nil {
+		log.Error("failed to start web service", "error", e)
+		db.Close()
+		return 1
+	}
+	log.Info("borisdb listening", "port", option.port, "tls", option.tlsCert != "")
+	if option.respPort != 0 {
+		log.Info("borisdb RESP listening", "port", option.respPort)
+	}
+
+	// certificates are reloaded on SIGHUP
+	hupchan := make(chan os.Signal, 1)
+	if option.tlsCert != "" {
+		signal.Notify(hupchan, syscall.SIGHUP)
+	}
 
 	// clean shutdown
-	select {
-	case <-sigchan:
-	case e := <-shutdown:
-		if e != nil {
-			log.Printf("%s", e)
+	code := 0
+wait:
+	for {
+		select {
+		case <-hupchan:
+			if e := svc.ReloadTLS(); e != nil {
+				log.Error("failed to reload tls certificate", "error", e)
+				continue
+			}
+			log.Info("tls certificate reloaded", "cert", option.tlsCert)
+		case sig := <-sigchan:
+			log.Info("borisdb shutdown", "signal", sig.String())
+			break wait
+		case e := <-shutdown:
+			if e != nil {
+				log.Error("borisdb shutdown", "error", e)
+				code = 1
+			} else {
+				log.Info("borisdb shutdown", "reason", "shutdown request")
+			}
+			break wait
 		}
 	}
+	// a second signal terminates the process without draining
+	signal.Stop(sigchan)
+	signal.Stop(hupchan)
+
+	ctx, cancel := context.WithTimeout(context.Background(), option.drain)
+	defer cancel()
+	if e := svc.Shutdown(ctx); e != nil {
+		log.Error("failed to drain requests", "error", e, "timeout", option.drain)
+		code = 1
+	}
+	// blocks until in-flight store ops complete
+	if e := db.Close(); e != nil {
+		log.Error("failed to close database", "error", e)
+		code = 1
+	}
 
-	log.Printf("info - borisdb stopped. ciao!\n")
+	log.Info("borisdb stopped. ciao!", "exit-code", code)
+	return code
+}
+
+/// offline tools ///////////////////////////////////////////////////////////
+
+func compactDb() int {
+	log.Info("borisdb compacting ...", "path", option.dbfile)
+	before, after, e := store.CompactFile(option.dbfile)
+	if e != nil {
+		log.Error("failed to compact database", "error", e)
+		return 1
+	}
+	log.Info("borisdb compacted", "before", before, "after", after)
+	return 0
 }
 
 /// server shutdown ///////////////////////////////////////////////////////////
 
+// returns the shutdown channel and the function signalling it. Only
+// the first call to the function is delivered.
 func getShutdownHooks() (chan error, func(error) error) {
 	var shutdown = make(chan error, 1)
+	var once sync.Once
 	shutdownFn := func(e error) error {
-		shutdown <- e
-		close(shutdown)
+		once.Do(func() {
+			shutdown <- e
+			close(shutdown)
+		})
 		return e
 	}
 	return shutdown, shutdownFn
@@ -95,14 +263,57 @@ func getShutdownHooks() (chan error, func(error) error) {
 /// server initialization /////////////////////////////////////////////////////
 
 func init() {
+	flag.StringVar(&option.config, "config", option.config, "config file path (also "+config.EnvName(envPrefix, "config")+")")
+	flag.BoolVar(&option.printCfg, "print-config", option.printCfg, "print the resolved configuration and exit")
 	flag.IntVar(&option.port, "port", option.port, "web service port")
+	flag.IntVar(&option.respPort, "resp-port", option.respPort, "RESP (redis protocol) front end port (disabled if 0)")
 	flag.StringVar(&option.path, "path", option.path, "db file path")
 	flag.StringVar(&option.dbname, "db", option.dbname, "db name")
+	flag.StringVar(&option.adminToken, "admin-token", option.adminToken, "static admin role token (disabled if blank)")
+	flag.BoolVar(&option.authReq, "auth-required", option.authReq, "require read/write role tokens for all endpoints")
+	flag.Int64Var(&option.maxBlob, "max-blob", option.maxBlob, "max blob size in bytes (unlimited if 0)")
+	flag.Int64Var(&option.maxSize, "max-size", option.maxSize, "max store size in bytes (unlimited if 0)")
+	flag.Int64Var(&option.maxImport, "max-import", option.maxImport, "max import archive size in bytes (unlimited if 0)")
+	flag.StringVar(&option.tlsCert, "tls-cert", option.tlsCert, "service certificate file (https if set, reloaded on SIGHUP)")
+	flag.StringVar(&option.tlsKey, "tls-key", option.tlsKey, "service key file")
+	flag.StringVar(&option.clientCA, "tls-client-ca", option.clientCA, "CA bundle file verifying client certificates (mutual-TLS if set)")
+	flag.Float64Var(&option.readRate, "read-rate", option.readRate, "per-client reads per second (unlimited if 0)")
+	flag.IntVar(&option.readBurst, "read-burst", option.readBurst, "per-client read burst (read-rate if 0)")
+	flag.Float64Var(&option.writeRate, "write-rate", option.writeRate, "per-client writes per second (unlimited if 0)")
+	flag.IntVar(&option.writeBurst, "write-burst", option.writeBurst, "per-client write burst (write-rate if 0)")
+	flag.DurationVar(&option.cacheAge, "cache-max-age", option.cacheAge, "max-age of cacheable blob responses (not cached if 0)")
+	flag.StringVar(&option.uploadDir, "upload-dir", option.uploadDir, "upload session staging directory (<db>.uploads if blank)")
+	flag.DurationVar(&option.uploadTTL, "upload-ttl", option.uploadTTL, "expiry of idle upload sessions")
+	flag.IntVar(&option.segWrites, "max-segment-writes", option.segWrites, "max pending writes per segment (unlimited if 0)")
+	flag.BoolVar(&option.readonly, "readonly", option.readonly, "serve existing db in read-only mode")
+	flag.BoolVar(&option.compact, "compact", option.compact, "compact the (offline) db and exit")
+	flag.StringVar(&option.logFormat, "log-format", option.logFormat, "log output format (logfmt or json)")
+	flag.StringVar(&option.logLevel, "log-level", option.logLevel, "min log level (debug, info, warn, error)")
+	flag.Uint64Var(&option.minDisk, "min-disk-free", option.minDisk, "min free disk bytes for readiness (unchecked if 0)")
+	flag.DurationVar(&option.drain, "drain-timeout", option.drain, "max wait for in-flight requests on shutdown")
+	flag.DurationVar(&option.hdrTimeout, "read-header-timeout", option.hdrTimeout, "max wait for http request headers")
+	flag.DurationVar(&option.wTimeout, "write-timeout", option.wTimeout, "max duration of http requests (except backups, exports and imports) and of RESP commands")
+	flag.DurationVar(&option.idle, "idle-timeout", option.idle, "max idle time of http keep-alive and RESP connections")
+	flag.DurationVar(&option.slowOp, "slow-op", option.slowOp, "log store ops slower than this (disabled if 0)")
 }
 
 // initialize and verify server options
 func initOptions() error {
-	// TODO: verify port is valid for userspace range
+	// verify port is valid for userspace range
+	if option.port < 1024 || option.port > 65535 {
+		return fmt.Errorf("err - port %d is not in userspace range [1024, 65535]", option.port)
+	}
+	if option.respPort != 0 && (option.respPort < 1024 || option.respPort > 65535 || option.respPort == option.port) {
+		return fmt.Errorf("err - resp port %d is not in userspace range [1024, 65535] or is the service port", option.respPort)
+	}
+
+	// setup logging
+	logger, e := logging.New(os.Stderr, option.logFormat, option.logLevel)
+	if e != nil {
+		return fmt.Errorf("err - log options - %s", e)
+	}
+	logging.SetDefault(logger)
+	log = logger
 
 	// use current working directory if path is not specified.
 	if option.path == "" {
@@ -117,12 +328,31 @@ func initOptions() error {
 		return fmt.Errorf("err - specified path is not a directory - %s", option.path)
 	}
 
+	// verify limits
+	if option.maxBlob < 0 || option.maxSize < 0 || option.maxImport < 0 || option.segWrites < 0 {
+		return fmt.Errorf("err - limits can not be negative")
+	}
+	if option.readRate < 0 || option.writeRate < 0 || option.readBurst < 0 || option.writeBurst < 0 {
+		return fmt.Errorf("err - rate limits can not be negative")
+	}
+	if option.drain < 0 || option.slowOp < 0 || option.cacheAge < 0 || option.uploadTTL < 0 ||
+		option.hdrTimeout < 0 || option.wTimeout < 0 || option.idle < 0 {
+		return fmt.Errorf("err - durations can not be negative")
+	}
+
 	// verify dbname
 	if option.dbname == "" {
 		return fmt.Errorf("err - dbname can not be blank")
 	}
 
-	option.path = filepath.Join(option.path, option.dbname)
+	option.dbfile = filepath.Join(option.path, option.dbname)
+
+	// uploads are staged next to the db, and not enabled in read-only mode
+	if option.readonly {
+		option.uploadDir = ""
+	} else if option.uploadDir == "" {
+		option.uploadDir = option.dbfile + ".uploads"
+	}
 
 	return nil
 }
@@ -0,0 +1,207 @@
+//    Copyright © 2016 Joubin Houshyar. All rights reserved.
+//
+//    This file is part of Frankinstore.
+//
+//    Frankinstore is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU Affero General Public License as
+//    published by the Free Software Foundation, either version 3 of
+//    the License, or (at your option) any later version.
+//
+//    Frankinstore is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU Affero General Public License for more details.
+//
+//    You should have received a copy of the GNU Affero General Public
+//    License along with Frankinstore.  If not, see <http://www.gnu.org/licenses/>.
+
+// package config resolves command line flags from a configuration file
+// and environment variables.
+//
+// Every setting is a flag of a flag.FlagSet. Settings are resolved with
+// the precedence
+//
+//	command line flags > environment > config file > flag defaults
+//
+// The config file is a line oriented 'name = value' file, with names
+// of the flags. Values may be double quoted. Blank lines, lines
+// starting with '#' and trailing ' # ...' comments are ignored. E.g.
+//
+//	# borisdb.conf
+//	port = 5722
+//	path = "/var/lib/borisdb"
+//	readonly = true
+//
+// Environment variables are named by the prefix and the upper-cased
+// flag name, with '-' replaced by '_', e.g. BORISDB_MAX_BLOB.
+package config
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// sources of a resolved setting
+const (
+	FromDefault = "default"
+	FromFile    = "file"
+	FromEnv     = "env"
+	FromFlag    = "flag"
+)
+
+// Load resolves the settings of the parsed flagset 'fs' from config file
+// 'file' (optional) and environment variables with prefix 'prefix'.
+// Flags set on the command line are not overridden. Unknown names in the
+// config file are errors.
+// Returns the source of each setting, by flag name.
+func Load(fs *flag.FlagSet, file, prefix string) (map[string]string, error) {
+	sources := map[string]string{}
+	fs.VisitAll(func(f *flag.Flag) { sources[f.Name] = FromDefault })
+	fs.Visit(func(f *flag.Flag) { sources[f.Name] = FromFlag })
+
+	set := func(name, value, source string) error {
+		if sources[name] == FromFlag {
+			return nil
+		}
+		if e := fs.Set(name, value); e != nil {
+			return fmt.Errorf("err - config - %s %q - %w", source, name, e)
+		}
+		sources[name] = source
+		return nil
+	}
+
+	if file != "" {
+		settings, e := ReadFile(file)
+		if e != nil {
+			return nil, e
+		}
+		for _, s := range settings {
+			if fs.Lookup(s.Name) == nil {
+				return nil, fmt.Errorf("err - config - %s:%d - unknown setting %q", file, s.Line, s.Name)
+			}
+			if e := set(s.Name, s.Value, FromFile); e != nil {
+				return nil, e
+			}
+		}
+	}
+
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if v, ok := os.LookupEnv(EnvName(prefix, f.Name)); ok && err == nil {
+			err = set(f.Name, v, FromEnv)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return sources, nil
+}
+
+// EnvName returns the environment variable name of flag 'name'.
+func EnvName(prefix, name string) string {
+	return prefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+/// config file ///////////////////////////////////////////////////////////////
+
+// a single setting of a config file
+type Setting struct {
+	Name  string
+	Value string
+	Line  int // line number in file
+}
+
+// ReadFile reads the settings of config file 'name'.
+func ReadFile(name string) ([]Setting, error) {
+	file, e := os.Open(name)
+	if e != nil {
+		return nil, fmt.Errorf("err - config - %w", e)
+	}
+	defer file.Close()
+
+	settings, e := Parse(file)
+	if e != nil {
+		return nil, fmt.Errorf("err - config - %s%w", name, e)
+	}
+	return settings, nil
+}
+
+// Parse reads the settings of a config file from 'r'.
+func Parse(r io.Reader) ([]Setting, error) {
+	var settings []Setting
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf(":%d - expect 'name = value'", n)
+		}
+		name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+		if name == "" {
+			return nil, fmt.Errorf(":%d - blank name", n)
+		}
+		if strings.HasPrefix(value, `"`) {
+			q, e := strconv.QuotedPrefix(value)
+			if e != nil {
+				return nil, fmt.Errorf(":%d - invalid quoted value %s", n, value)
+			}
+			if rest := strings.TrimSpace(value[len(q):]); rest != "" && !strings.HasPrefix(rest, "#") {
+				return nil, fmt.Errorf(":%d - unexpected %q after quoted value", n, rest)
+			}
+			value, _ = strconv.Unquote(q)
+		} else if i := strings.Index(value, " #"); i >= 0 {
+			value = strings.TrimSpace(value[:i])
+		}
+		settings = append(settings, Setting{name, value, n})
+	}
+	if e := scanner.Err(); e != nil {
+		return nil, fmt.Errorf(" - %w", e)
+	}
+	return settings, nil
+}
+
+// Write writes the resolved settings of 'fs' to 'w' in config file
+// format, annotated with their source. Values of the 'secrets' flags
+// are masked and 'omit' flags, e.g. command flags, are not written.
+func Write(w io.Writer, fs *flag.FlagSet, sources map[string]string, secrets, omit []string) error {
+	var names []string
+	fs.VisitAll(func(f *flag.Flag) {
+		if !contains(omit, f.Name) {
+			names = append(names, f.Name)
+		}
+	})
+	sort.Strings(names)
+
+	for _, name := range names {
+		value := fs.Lookup(name).Value.String()
+		if contains(secrets, name) && value != "" {
+			value = "****"
+		}
+		source := sources[name]
+		if source == "" {
+			source = FromDefault
+		}
+		if _, e := fmt.Fprintf(w, "%s = %s # %s\n", name, strconv.Quote(value), source); e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,119 @@
+//    Copyright © 2016 Joubin Houshyar. All rights reserved.
+//
+//    This file is part of Frankinstore.
+//
+//    Frankinstore is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU Affero General Public License as
+//    published by the Free Software Foundation, either version 3 of
+//    the License, or (at your option) any later version.
+//
+//    Frankinstore is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU Affero General Public License for more details.
+//
+//    You should have received a copy of the GNU Affero General Public
+//    License along with Frankinstore.  If not, see <http://www.gnu.org/licenses/>.
+
+package config
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newFlagSet() (*flag.FlagSet, *int, *string, *bool) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	port := fs.Int("port", 5722, "")
+	path := fs.String("path", "/tmp", "")
+	ro := fs.Bool("readonly", false, "")
+	fs.String("admin-token", "", "")
+	return fs, port, path, ro
+}
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	name := filepath.Join(t.TempDir(), "borisdb.conf")
+	if e := os.WriteFile(name, []byte(content), 0600); e != nil {
+		t.Fatal(e)
+	}
+	return name
+}
+
+func TestPrecedence(t *testing.T) {
+	file := writeConfig(t, `
+# comment
+port = 6000
+path = "/from/file" # trailing comment
+readonly = true
+`)
+	t.Setenv("TEST_PATH", "/from/env")
+	t.Setenv("TEST_PORT", "7000")
+
+	fs, port, path, ro := newFlagSet()
+	if e := fs.Parse([]string{"-port", "8000"}); e != nil {
+		t.Fatal(e)
+	}
+	sources, e := Load(fs, file, "TEST_")
+	if e != nil {
+		t.Fatalf("Load error = %v", e)
+	}
+	if *port != 8000 || sources["port"] != FromFlag {
+		t.Errorf("port = %d (%s); want 8000 (flag)", *port, sources["port"])
+	}
+	if *path != "/from/env" || sources["path"] != FromEnv {
+		t.Errorf("path = %q (%s); want /from/env (env)", *path, sources["path"])
+	}
+	if !*ro || sources["readonly"] != FromFile {
+		t.Errorf("readonly = %t (%s); want true (file)", *ro, sources["readonly"])
+	}
+	if sources["admin-token"] != FromDefault {
+		t.Errorf("admin-token source = %s; want default", sources["admin-token"])
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	for _, content := range []string{
+		"bogus = 1\n",
+		"port = notanumber\n",
+		"port 5722\n",
+		"path = \"unterminated\n",
+		"path = \"a\" b\n",
+	} {
+		fs, _, _, _ := newFlagSet()
+		fs.Parse(nil)
+		if _, e := Load(fs, writeConfig(t, content), "TEST_"); e == nil {
+			t.Errorf("Load(%q) error = nil; want error", content)
+		}
+	}
+}
+
+func TestWriteRoundTrip(t *testing.T) {
+	fs, _, _, _ := newFlagSet()
+	fs.Parse([]string{"-path", "/with space/#x", "-admin-token", "secret"})
+	sources, _ := Load(fs, "", "TEST_")
+
+	var buf bytes.Buffer
+	if e := Write(&buf, fs, sources, []string{"admin-token"}, []string{"readonly"}); e != nil {
+		t.Fatal(e)
+	}
+	if strings.Contains(buf.String(), "secret") {
+		t.Errorf("Write output contains secret:\n%s", buf.String())
+	}
+	if strings.Contains(buf.String(), "readonly") {
+		t.Errorf("Write output contains omitted flag:\n%s", buf.String())
+	}
+	settings, e := Parse(&buf)
+	if e != nil {
+		t.Fatalf("Parse(Write) error = %v", e)
+	}
+	for _, s := range settings {
+		if s.Name == "path" && s.Value != "/with space/#x" {
+			t.Errorf("path = %q; want %q", s.Value, "/with space/#x")
+		}
+	}
+}
@@ -18,31 +18,57 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
+	"github.com/alphazero/borisdb/store"
 	"github.com/alphazero/borisdb/web"
 	"os"
 	"strings"
+	"time"
 )
 
 var option = struct {
-	cmd  string
-	data string
-	host string
-	port int
-	size int
+	cmd     string
+	data    string
+	host    string
+	port    int
+	size    int
+	out     string
+	in      string
+	token   string
+	name    string
+	https   bool          // use https
+	ca      string        // CA bundle file verifying the server
+	cert    string        // client certificate file (mutual-TLS)
+	key     string        // client key file (mutual-TLS)
+	timeout time.Duration // per-call timeout
+	retries int           // max retries of idempotent calls
+	verify  bool          // verify blobs of get
 }{
-	host: "127.0.0.1",
-	port: web.DefaultPort,
-	size: 4096,
+	host:    "127.0.0.1",
+	port:    web.DefaultPort,
+	size:    4096,
+	retries: web.DefaultRetries,
 }
 
 func init() {
-	flag.StringVar(&option.cmd, "c", option.cmd, "cmd: {put, get, del, shutdown, info}")
+	flag.StringVar(&option.cmd, "c", option.cmd, "cmd: {put, get, del, shutdown, info, backup, export, import, upload, compact, token-create, token-list, token-revoke}")
 	flag.StringVar(&option.data, "d", option.data, "data to send")
 	flag.StringVar(&option.host, "a", option.host, "host address")
 	flag.IntVar(&option.port, "p", option.port, "port")
 	flag.IntVar(&option.size, "s", option.size, "size of payload")
+	flag.StringVar(&option.out, "o", option.out, "output file")
+	flag.StringVar(&option.in, "i", option.in, "input file")
+	flag.StringVar(&option.token, "t", option.token, "access token")
+	flag.StringVar(&option.name, "n", option.name, "token name (token-create)")
+	flag.BoolVar(&option.https, "https", option.https, "use https (implied by -ca, -cert)")
+	flag.StringVar(&option.ca, "ca", option.ca, "CA bundle file verifying the server (system roots if blank)")
+	flag.StringVar(&option.cert, "cert", option.cert, "client certificate file")
+	flag.StringVar(&option.key, "key", option.key, "client key file")
+	flag.DurationVar(&option.timeout, "timeout", option.timeout, "per-call timeout (none if 0)")
+	flag.BoolVar(&option.verify, "verify", option.verify, "verify blobs of get hash to their key")
+	flag.IntVar(&option.retries, "retries", option.retries, "max retries of get and put on transient errors")
 }
 
 type callFn func() ([]byte, error)
@@ -50,24 +76,49 @@ type callFn func() ([]byte, error)
 func main() {
 	flag.Parse()
 
-	client, e := web.NewClient(option.host, option.port)
+	client, e := web.NewClient(option.host, option.port,
+		web.WithTimeout(option.timeout),
+		web.WithRetries(option.retries, web.DefaultRetryBackoff, web.DefaultMaxBackoff),
+		web.WithVerify(option.verify))
 	if e != nil {
 		fmt.Printf("err - %s\n", e)
 		return
 	}
+	client.SetToken(option.token)
+	if option.https || option.ca != "" || option.cert != "" {
+		cfg, e := web.LoadClientTLS(option.ca, option.cert, option.key)
+		if e != nil {
+			fmt.Printf("err - %s\n", e)
+			return
+		}
+		client.SetTLS(cfg)
+	}
+
 	var fn callFn
 	switch option.cmd {
 	case "put":
 		fn = func() ([]byte, error) {
-			return client.Put([]byte(option.data))
+			key, e := client.Put([]byte(option.data))
+			if e != nil {
+				return nil, e
+			}
+			return []byte(key.String()), nil
 		}
 	case "get":
 		fn = func() ([]byte, error) {
-			return client.Get(option.data)
+			key, e := store.ParseKey(option.data)
+			if e != nil {
+				return nil, e
+			}
+			return client.Get(key)
 		}
 	case "del":
 		fn = func() ([]byte, error) {
-			return client.Del(option.data)
+			key, e := store.ParseKey(option.data)
+			if e != nil {
+				return nil, e
+			}
+			return client.Del(key)
 		}
 	case "info":
 		fn = func() ([]byte, error) {
@@ -77,12 +128,82 @@ func main() {
 		fn = func() ([]byte, error) {
 			return client.Shutdown()
 		}
+	case "backup":
+		fn = func() ([]byte, error) {
+			return backup(client, option.out)
+		}
+	case "export":
+		fn = func() ([]byte, error) {
+			return export(client, option.out)
+		}
+	case "import":
+		fn = func() ([]byte, error) {
+			return importArchive(client, option.in)
+		}
+	case "upload": // -d session id to resume
+		fn = func() ([]byte, error) {
+			return upload(client, option.in, option.data)
+		}
+	case "compact":
+		fn = func() ([]byte, error) {
+			return client.Compact()
+		}
+	case "token-create": // -d role
+		fn = func() ([]byte, error) {
+			info, e := client.CreateToken(option.data, option.name)
+			if e != nil {
+				return nil, e
+			}
+			return []byte(info.Token), nil
+		}
+	case "token-list":
+		fn = func() ([]byte, error) {
+			tokens, e := client.ListTokens()
+			if e != nil {
+				return nil, e
+			}
+			var lines []string
+			for _, t := range tokens {
+				lines = append(lines, fmt.Sprintf("%s %s %q %s", t.ID, t.Role, t.Name, t.Created.Format(time.RFC3339)))
+			}
+			return []byte(strings.Join(lines, "\n")), nil
+		}
+	case "token-revoke": // -d id
+		fn = func() ([]byte, error) {
+			if e := client.RevokeToken(option.data); e != nil {
+				return nil, e
+			}
+			return []byte("revoked " + option.data), nil
+		}
 	default:
 		fmt.Fprintf(os.Stderr, "unknown command %q\n", option.cmd)
 		os.Exit(1)
 	}
 
-	go call(client, fn)
+	call(client, fn)
+}
+
+// writes the backup stream to file 'fname' and verifies it.
+func backup(client *web.Client, fname string) ([]byte, error) {
+	if fname == "" {
+		return nil, fmt.Errorf("output file (-o) not specified")
+	}
+	file, e := os.OpenFile(fname, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if e != nil {
+		return nil, e
+	}
+	n, e := client.Backup(file)
+	if e0 := file.Close(); e == nil {
+		e = e0
+	}
+	if e != nil {
+		os.Remove(fname)
+		return nil, e
+	}
+	if e := store.Verify(fname); e != nil {
+		return nil, e
+	}
+	return []byte(fmt.Sprintf("backup %s - %d bytes - verified", fname, n)), nil
 }
 
 func call(client *web.Client, fn callFn) {
@@ -96,3 +217,64 @@ func call(client *web.Client, fn callFn) {
 	rs := strings.Trim(string(resp), " \n")
 	fmt.Fprintf(w, "%s[%s]\n", s, rs)
 }
+
+// writes the export archive stream to file 'fname'.
+func export(client *web.Client, fname string) ([]byte, error) {
+	if fname == "" {
+		return nil, fmt.Errorf("output file (-o) not specified")
+	}
+	file, e := os.OpenFile(fname, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if e != nil {
+		return nil, e
+	}
+	n, e := client.Export(file)
+	if e0 := file.Close(); e == nil {
+		e = e0
+	}
+	if e != nil {
+		os.Remove(fname)
+		return nil, e
+	}
+	return []byte(fmt.Sprintf("export %s - %d bytes", fname, n)), nil
+}
+
+// sends the export archive in file 'fname'.
+func importArchive(client *web.Client, fname string) ([]byte, error) {
+	if fname == "" {
+		return nil, fmt.Errorf("input file (-i) not specified")
+	}
+	file, e := os.Open(fname)
+	if e != nil {
+		return nil, e
+	}
+	defer file.Close()
+
+	return client.Import(file)
+}
+
+// uploads file 'fname' in parts, resuming upload session 'id' if set.
+func upload(client *web.Client, fname, id string) ([]byte, error) {
+	if fname == "" {
+		return nil, fmt.Errorf("input file (-i) not specified")
+	}
+	file, e := os.Open(fname)
+	if e != nil {
+		return nil, e
+	}
+	defer file.Close()
+	finfo, e := file.Stat()
+	if e != nil {
+		return nil, e
+	}
+
+	up := client.NewUploader()
+	up.ID = id
+	key, e := up.Upload(file, finfo.Size())
+	if e != nil {
+		if up.ID != "" && !errors.Is(e, store.NotFoundErr) {
+			fmt.Fprintf(os.Stderr, "resume with -c upload -i %s -d %s\n", fname, up.ID)
+		}
+		return nil, e
+	}
+	return []byte(key.String()), nil
+}
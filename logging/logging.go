@@ -0,0 +1,108 @@
+//    Copyright © 2016 Joubin Houshyar. All rights reserved.
+//
+//    This file is part of Frankinstore.
+//
+//    Frankinstore is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU Affero General Public License as
+//    published by the Free Software Foundation, either version 3 of
+//    the License, or (at your option) any later version.
+//
+//    Frankinstore is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU Affero General Public License for more details.
+//
+//    You should have received a copy of the GNU Affero General Public
+//    License along with Frankinstore.  If not, see <http://www.gnu.org/licenses/>.
+
+// package logging provides leveled, structured logging with request
+// scoped attributes. Loggers are log/slog loggers writing either logfmt
+// or JSON records.
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// supported output formats
+const (
+	Logfmt = "logfmt"
+	JSON   = "json"
+)
+
+// key of the request id attribute
+const RequestIDKey = "request_id"
+
+var defaultLogger atomic.Pointer[slog.Logger]
+
+func init() {
+	l, _ := New(os.Stderr, Logfmt, "info")
+	defaultLogger.Store(l)
+}
+
+// New returns a logger writing records of 'level' (debug, info, warn,
+// error) and above to 'w' in the specified format.
+func New(w io.Writer, format, level string) (*slog.Logger, error) {
+	var lvl slog.Level
+	if e := lvl.UnmarshalText([]byte(level)); e != nil {
+		return nil, fmt.Errorf("invalid log level %q", level)
+	}
+	opts := &slog.HandlerOptions{Level: lvl}
+	switch strings.ToLower(format) {
+	case Logfmt:
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case JSON:
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	}
+	return nil, fmt.Errorf("invalid log format %q - expect %s or %s", format, Logfmt, JSON)
+}
+
+// Default returns the process wide logger.
+func Default() *slog.Logger {
+	return defaultLogger.Load()
+}
+
+// SetDefault sets the process wide logger.
+func SetDefault(l *slog.Logger) {
+	defaultLogger.Store(l)
+}
+
+/// request ids ///////////////////////////////////////////////////////////////
+
+type requestIDKey struct{}
+
+// NewRequestID returns a new random request id.
+func NewRequestID() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// WithRequestID returns a copy of ctx carrying request id 'id'.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestID returns the request id of ctx, if any.
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// FromContext returns the default logger, annotated with the request
+// id of ctx, if any.
+func FromContext(ctx context.Context) *slog.Logger {
+	l := Default()
+	if id := RequestID(ctx); id != "" {
+		l = l.With(RequestIDKey, id)
+	}
+	return l
+}
@@ -0,0 +1,333 @@
+//    Copyright © 2016 Joubin Houshyar. All rights reserved.
+//
+//    This file is part of Frankinstore.
+//
+//    Frankinstore is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU Affero General Public License as
+//    published by the Free Software Foundation, either version 3 of
+//    the License, or (at your option) any later version.
+//
+//    Frankinstore is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU Affero General Public License for more details.
+//
+//    You should have received a copy of the GNU Affero General Public
+//    License along with Frankinstore.  If not, see <http://www.gnu.org/licenses/>.
+
+// package metrics provides counters, histograms and gauges, exposed in
+// the Prometheus text exposition format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// default histogram buckets (in seconds) for latencies of store ops.
+var DefaultBuckets = []float64{
+	.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10,
+}
+
+// Default is the registry exposed by the borisdb services.
+var Default = NewRegistry()
+
+/// registry //////////////////////////////////////////////////////////////////
+
+// type defines a metric family as exposed by the registry.
+type family interface {
+	name() string
+	write(w *bufio.Writer)
+}
+
+// Registry is a named set of metric families.
+type Registry struct {
+	mu       sync.Mutex
+	families map[string]family
+}
+
+func NewRegistry() *Registry {
+	return &Registry{families: make(map[string]family)}
+}
+
+// registers 'f', replacing any existing family of the same name.
+func (r *Registry) register(f family) {
+	r.mu.Lock()
+	r.families[f.name()] = f
+	r.mu.Unlock()
+}
+
+// Counter registers a new counter family with the given label names.
+func (r *Registry) Counter(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{vec: newVec(name, help, "counter", labels)}
+	r.register(c)
+	return c
+}
+
+// Histogram registers a new histogram family with the given (sorted)
+// upper bounds and label names.
+func (r *Registry) Histogram(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	h := &HistogramVec{vec: newVec(name, help, "histogram", labels), buckets: buckets}
+	r.register(h)
+	return h
+}
+
+// GaugeFunc registers a gauge whose value is computed by fn when the
+// registry is written. An existing family of the same name is replaced.
+func (r *Registry) GaugeFunc(name, help string, fn func() float64) {
+	r.register(&funcMetric{vec: newVec(name, help, "gauge", nil), fn: fn})
+}
+
+// CounterFunc registers a counter whose value is computed by fn when the
+// registry is written. An existing family of the same name is replaced.
+func (r *Registry) CounterFunc(name, help string, fn func() float64) {
+	r.register(&funcMetric{vec: newVec(name, help, "counter", nil), fn: fn})
+}
+
+// WriteTo writes all metric families, sorted by name, to 'w' in the
+// Prometheus text exposition format.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	families := make([]family, 0, len(r.families))
+	for _, f := range r.families {
+		families = append(families, f)
+	}
+	r.mu.Unlock()
+	sort.Slice(families, func(i, j int) bool { return families[i].name() < families[j].name() })
+
+	cw := &countingWriter{w: w}
+	bw := bufio.NewWriter(cw)
+	for _, f := range families {
+		f.write(bw)
+	}
+	e := bw.Flush()
+	return cw.n, e
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	n, e := w.w.Write(b)
+	w.n += int64(n)
+	return n, e
+}
+
+/// metric vectors ////////////////////////////////////////////////////////////
+
+// vec is a family of metrics partitioned by label values.
+type vec struct {
+	fname  string
+	help   string
+	typ    string
+	labels []string
+
+	mu      sync.Mutex
+	metrics map[string]interface{} // by encoded label values
+}
+
+func newVec(name, help, typ string, labels []string) *vec {
+	return &vec{fname: name, help: help, typ: typ, labels: labels, metrics: make(map[string]interface{})}
+}
+
+func (v *vec) name() string { return v.fname }
+
+// returns the metric for label values 'lvs', creating it with newFn
+// if necessary.
+func (v *vec) with(lvs []string, newFn func() interface{}) interface{} {
+	if len(lvs) != len(v.labels) {
+		panic(fmt.Sprintf("metrics: %s: have %d label values - expect %d", v.fname, len(lvs), len(v.labels)))
+	}
+	k := labelString(v.labels, lvs)
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	m, ok := v.metrics[k]
+	if !ok {
+		m = newFn()
+		v.metrics[k] = m
+	}
+	return m
+}
+
+// returns the metrics of the vec sorted by label string.
+func (v *vec) sorted() (keys []string, metrics []interface{}) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	for k := range v.metrics {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		metrics = append(metrics, v.metrics[k])
+	}
+	return
+}
+
+func (v *vec) writeHeader(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", v.fname, escapeHelp(v.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", v.fname, v.typ)
+}
+
+/* counters */
+
+// CounterVec is a family of counters partitioned by label values.
+type CounterVec struct {
+	*vec
+}
+
+// Counter is a monotonically increasing value.
+type Counter struct {
+	bits uint64
+}
+
+// With returns the counter for the given label values.
+func (c *CounterVec) With(lvs ...string) *Counter {
+	return c.with(lvs, func() interface{} { return &Counter{} }).(*Counter)
+}
+
+func (c *Counter) Inc() { c.Add(1) }
+
+// Add increments the counter by 'd', which must not be negative.
+func (c *Counter) Add(d float64) {
+	addFloat(&c.bits, d)
+}
+
+func (c *Counter) Value() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&c.bits))
+}
+
+func (c *CounterVec) write(w *bufio.Writer) {
+	c.writeHeader(w)
+	keys, metrics := c.sorted()
+	for i, k := range keys {
+		fmt.Fprintf(w, "%s%s %s\n", c.fname, k, formatFloat(metrics[i].(*Counter).Value()))
+	}
+}
+
+/* histograms */
+
+// HistogramVec is a family of histograms partitioned by label values.
+type HistogramVec struct {
+	*vec
+	buckets []float64
+}
+
+// Histogram counts observations in cumulative buckets.
+type Histogram struct {
+	mu      sync.Mutex
+	buckets []float64
+	counts  []uint64 // per bucket, non-cumulative; last is +Inf
+	sum     float64
+	count   uint64
+}
+
+// With returns the histogram for the given label values.
+func (h *HistogramVec) With(lvs ...string) *Histogram {
+	return h.with(lvs, func() interface{} {
+		return &Histogram{buckets: h.buckets, counts: make([]uint64, len(h.buckets)+1)}
+	}).(*Histogram)
+}
+
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.buckets, v)
+	h.mu.Lock()
+	h.counts[i]++
+	h.sum += v
+	h.count++
+	h.mu.Unlock()
+}
+
+func (h *HistogramVec) write(w *bufio.Writer) {
+	h.writeHeader(w)
+	keys, metrics := h.sorted()
+	for i, k := range keys {
+		m := metrics[i].(*Histogram)
+		m.mu.Lock()
+		var cum uint64
+		for j, le := range h.buckets {
+			cum += m.counts[j]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.fname, withLabel(k, "le", formatFloat(le)), cum)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.fname, withLabel(k, "le", "+Inf"), m.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.fname, k, formatFloat(m.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.fname, k, m.count)
+		m.mu.Unlock()
+	}
+}
+
+/* func metrics */
+
+type funcMetric struct {
+	*vec
+	fn func() float64
+}
+
+func (f *funcMetric) write(w *bufio.Writer) {
+	f.writeHeader(w)
+	fmt.Fprintf(w, "%s %s\n", f.fname, formatFloat(f.fn()))
+}
+
+/// util //////////////////////////////////////////////////////////////////////
+
+func addFloat(bits *uint64, d float64) {
+	for {
+		old := atomic.LoadUint64(bits)
+		nbits := math.Float64bits(math.Float64frombits(old) + d)
+		if atomic.CompareAndSwapUint64(bits, old, nbits) {
+			return
+		}
+	}
+}
+
+// returns the encoded label set, e.g. {op="get",code="200"}
+func labelString(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, n := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, "%s=\"%s\"", n, escapeLabel(values[i]))
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// adds label 'name' to the encoded label set 'ls'.
+func withLabel(ls, name, value string) string {
+	l := fmt.Sprintf("%s=\"%s\"", name, escapeLabel(value))
+	if ls == "" {
+		return "{" + l + "}"
+	}
+	return ls[:len(ls)-1] + "," + l + "}"
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+func escapeLabel(s string) string { return labelEscaper.Replace(s) }
+func escapeHelp(s string) string  { return helpEscaper.Replace(s) }
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, +1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	case math.IsNaN(f):
+		return "NaN"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
@@ -0,0 +1,80 @@
+//    Copyright © 2016 Joubin Houshyar. All rights reserved.
+//
+//    This file is part of Frankinstore.
+//
+//    Frankinstore is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU Affero General Public License as
+//    published by the Free Software Foundation, either version 3 of
+//    the License, or (at your option) any later version.
+//
+//    Frankinstore is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU Affero General Public License for more details.
+//
+//    You should have received a copy of the GNU Affero General Public
+//    License along with Frankinstore.  If not, see <http://www.gnu.org/licenses/>.
+
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestWriteTo(t *testing.T) {
+	r := NewRegistry()
+	c := r.Counter("test_ops_total", "Count of ops.", "op")
+	c.With("put").Inc()
+	c.With("get").Add(2)
+	h := r.Histogram("test_latency_seconds", "Op latency.", []float64{0.1, 1}, "op")
+	h.With("get").Observe(0.05)
+	h.With("get").Observe(0.5)
+	h.With("get").Observe(5)
+	r.GaugeFunc("test_objects", "Object count.", func() float64 { return 42 })
+
+	var buf bytes.Buffer
+	n, e := r.WriteTo(&buf)
+	if e != nil {
+		t.Fatalf("WriteTo error = %v", e)
+	}
+	if n != int64(buf.Len()) {
+		t.Errorf("WriteTo n = %d; want %d", n, buf.Len())
+	}
+
+	want := `# HELP test_latency_seconds Op latency.
+# TYPE test_latency_seconds histogram
+test_latency_seconds_bucket{op="get",le="0.1"} 1
+test_latency_seconds_bucket{op="get",le="1"} 2
+test_latency_seconds_bucket{op="get",le="+Inf"} 3
+test_latency_seconds_sum{op="get"} 5.55
+test_latency_seconds_count{op="get"} 3
+# HELP test_objects Object count.
+# TYPE test_objects gauge
+test_objects 42
+# HELP test_ops_total Count of ops.
+# TYPE test_ops_total counter
+test_ops_total{op="get"} 2
+test_ops_total{op="put"} 1
+`
+	if got := buf.String(); got != want {
+		t.Errorf("WriteTo =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestLabelEscaping(t *testing.T) {
+	r := NewRegistry()
+	r.Counter("test_total", "Help with \\ and\nnewline.", "path").With("a\"b\\c\nd").Inc()
+
+	var buf bytes.Buffer
+	r.WriteTo(&buf)
+	for _, want := range []string{
+		`# HELP test_total Help with \\ and\nnewline.`,
+		`test_total{path="a\"b\\c\nd"} 1`,
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("output missing %q:\n%s", want, buf.String())
+		}
+	}
+}
@@ -18,13 +18,48 @@ limitations under the License.
 // mechanism.
 package singleflight
 
-import "sync"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"sync"
+)
+
+// errGoexit is reported to waiters if fn called runtime.Goexit.
+var errGoexit = errors.New("singleflight: fn called runtime.Goexit")
+
+// PanicError is the error reported to all callers if fn panicked.
+type PanicError struct {
+	Value interface{} // the value passed to panic
+	Stack []byte      // stack trace of the panicking goroutine
+}
+
+func (p *PanicError) Error() string {
+	return fmt.Sprintf("singleflight: panic in fn: %v\n\n%s", p.Value, p.Stack)
+}
+
+// Result holds the results of Do, so they can be passed on a channel.
+type Result struct {
+	Val    interface{}
+	Err    error
+	Shared bool // true if the result was delivered to more than one caller
+}
 
 // call is an in-flight or completed Do call
 type call struct {
 	wg  sync.WaitGroup
 	val interface{}
 	err error
+
+	// forgotten indicates whether Forget was called with this call's key
+	// while the call was still in flight.
+	forgotten bool
+
+	// count of callers that joined the call, and their result channels
+	// if they joined via DoChan.
+	dups  int
+	chans []chan<- Result
 }
 
 // Group represents a class of work and forms a namespace in which
@@ -37,28 +72,108 @@ type Group struct {
 // Do executes and returns the results of the given function, making
 // sure that only one execution is in-flight for a given key at a
 // time. If a duplicate comes in, the duplicate caller waits for the
-// original to complete and receives the same results.
-func (g *Group) Do(key string, fn func() (interface{}, error)) (interface{}, error) {
+// original to complete and receives the same results. 'shared'
+// reports whether the results were delivered to more than one caller.
+//
+// If fn panics, the panic is recovered and all callers receive a
+// *PanicError.
+func (g *Group) Do(key string, fn func() (interface{}, error)) (v interface{}, err error, shared bool) {
 	g.mu.Lock()
 	if g.m == nil {
 		g.m = make(map[string]*call)
 	}
 	if c, ok := g.m[key]; ok {
+		c.dups++
 		g.mu.Unlock()
 		c.wg.Wait()
-		return c.val, c.err
+		return c.val, c.err, true
 	}
 	c := new(call)
 	c.wg.Add(1)
 	g.m[key] = c
 	g.mu.Unlock()
 
-	c.val, c.err = fn()
-	c.wg.Done()
+	g.doCall(c, key, fn)
+	return c.val, c.err, c.dups > 0
+}
 
+// DoChan is like Do but returns a channel that will receive the
+// results when they are ready. The channel is buffered and callers
+// are free to abandon it.
+func (g *Group) DoChan(key string, fn func() (interface{}, error)) <-chan Result {
+	ch := make(chan Result, 1)
 	g.mu.Lock()
+	if g.m == nil {
+		g.m = make(map[string]*call)
+	}
+	if c, ok := g.m[key]; ok {
+		c.dups++
+		c.chans = append(c.chans, ch)
+		g.mu.Unlock()
+		return ch
+	}
+	c := &call{chans: []chan<- Result{ch}}
+	c.wg.Add(1)
+	g.m[key] = c
+	g.mu.Unlock()
+
+	go g.doCall(c, key, fn)
+
+	return ch
+}
+
+// DoContext is like Do but the caller stops waiting once ctx is done,
+// in which case ctx.Err() is returned. The call itself is not cancelled
+// and its results are still delivered to the other callers. 'shared'
+// reports whether the results were delivered to more than one caller.
+func (g *Group) DoContext(ctx context.Context, key string, fn func() (interface{}, error)) (v interface{}, err error, shared bool) {
+	if e := ctx.Err(); e != nil {
+		return nil, e, false
+	}
+	select {
+	case r := <-g.DoChan(key, fn):
+		return r.Val, r.Err, r.Shared
+	case <-ctx.Done():
+		return nil, ctx.Err(), false
+	}
+}
+
+// Forget tells the group to forget about a key. Future calls to Do for
+// this key will call the function rather than waiting for an earlier,
+// still in-flight, call to complete.
+func (g *Group) Forget(key string) {
+	g.mu.Lock()
+	if c, ok := g.m[key]; ok {
+		c.forgotten = true
+	}
 	delete(g.m, key)
 	g.mu.Unlock()
+}
+
+// doCall handles the single call for a key. Panics and runtime.Goexit
+// in fn are reported as errors to all callers.
+func (g *Group) doCall(c *call, key string, fn func() (interface{}, error)) {
+	normalReturn := false
+	defer func() {
+		if !normalReturn {
+			if r := recover(); r != nil {
+				c.val, c.err = nil, &PanicError{Value: r, Stack: debug.Stack()}
+			} else {
+				c.val, c.err = nil, errGoexit
+			}
+		}
 
-	return c.val, c.err
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		c.wg.Done()
+		if !c.forgotten {
+			delete(g.m, key)
+		}
+		for _, ch := range c.chans {
+			ch <- Result{c.val, c.err, c.dups > 0}
+		}
+	}()
+
+	c.val, c.err = fn()
+	normalReturn = true
 }
@@ -17,6 +17,7 @@ limitations under the License.
 package singleflight
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"sync"
@@ -27,7 +28,7 @@ import (
 
 func TestDo(t *testing.T) {
 	var g Group
-	v, err := g.Do("key", func() (interface{}, error) {
+	v, err, shared := g.Do("key", func() (interface{}, error) {
 		return "bar", nil
 	})
 	if got, want := fmt.Sprintf("%v (%T)", v, v), "bar (string)"; got != want {
@@ -36,12 +37,15 @@ func TestDo(t *testing.T) {
 	if err != nil {
 		t.Errorf("Do error = %v", err)
 	}
+	if shared {
+		t.Error("Do shared = true; want false")
+	}
 }
 
 func TestDoErr(t *testing.T) {
 	var g Group
 	someErr := errors.New("Some error")
-	v, err := g.Do("key", func() (interface{}, error) {
+	v, err, _ := g.Do("key", func() (interface{}, error) {
 		return nil, someErr
 	})
 	if err != someErr {
@@ -66,13 +70,16 @@ func TestDoDupSuppress(t *testing.T) {
 	for i := 0; i < n; i++ {
 		wg.Add(1)
 		go func() {
-			v, err := g.Do("key", fn)
+			v, err, shared := g.Do("key", fn)
 			if err != nil {
 				t.Errorf("Do error: %v", err)
 			}
 			if v.(string) != "bar" {
 				t.Errorf("got %q; want %q", v, "bar")
 			}
+			if !shared {
+				t.Error("Do shared = false; want true")
+			}
 			wg.Done()
 		}()
 	}
@@ -83,3 +90,147 @@ func TestDoDupSuppress(t *testing.T) {
 		t.Errorf("number of calls = %d; want 1", got)
 	}
 }
+
+func TestDoChan(t *testing.T) {
+	var g Group
+	ch := g.DoChan("key", func() (interface{}, error) {
+		return "bar", nil
+	})
+	r := <-ch
+	if got, want := fmt.Sprintf("%v (%T)", r.Val, r.Val), "bar (string)"; got != want {
+		t.Errorf("DoChan = %v; want %v", got, want)
+	}
+	if r.Err != nil {
+		t.Errorf("DoChan error = %v", r.Err)
+	}
+	if r.Shared {
+		t.Errorf("DoChan shared = true; want false")
+	}
+}
+
+func TestDoChanShared(t *testing.T) {
+	var g Group
+	c := make(chan string)
+	fn := func() (interface{}, error) {
+		return <-c, nil
+	}
+
+	const n = 10
+	chans := make([]<-chan Result, n)
+	for i := 0; i < n; i++ {
+		chans[i] = g.DoChan("key", fn)
+	}
+	c <- "bar"
+	for _, ch := range chans {
+		r := <-ch
+		if r.Val.(string) != "bar" {
+			t.Errorf("got %q; want %q", r.Val, "bar")
+		}
+		if !r.Shared {
+			t.Errorf("shared = false; want true")
+		}
+	}
+}
+
+func TestDoPanic(t *testing.T) {
+	var g Group
+	c := make(chan struct{})
+	fn := func() (interface{}, error) {
+		<-c
+		panic("boom")
+	}
+
+	const n = 5
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err, _ := g.Do("key", fn)
+			var perr *PanicError
+			if !errors.As(err, &perr) {
+				t.Errorf("Do error = %v; want *PanicError", err)
+				return
+			}
+			if perr.Value != "boom" {
+				t.Errorf("panic value = %v; want boom", perr.Value)
+			}
+		}()
+	}
+	time.Sleep(100 * time.Millisecond) // let goroutines above block
+	close(c)
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("waiters hang after panic in fn")
+	}
+
+	// group must be usable after the panic
+	v, err, _ := g.Do("key", func() (interface{}, error) {
+		return "bar", nil
+	})
+	if err != nil || v.(string) != "bar" {
+		t.Errorf("Do after panic = %v, %v; want bar, nil", v, err)
+	}
+}
+
+func TestDoContextCancel(t *testing.T) {
+	var g Group
+	c := make(chan string)
+	var calls int32
+	fn := func() (interface{}, error) {
+		atomic.AddInt32(&calls, 1)
+		return <-c, nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		_, err, _ := g.DoContext(ctx, "key", fn)
+		done <- err
+	}()
+	other := g.DoChan("key", fn)
+
+	time.Sleep(100 * time.Millisecond) // let goroutines above block
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Errorf("DoContext error = %v; want context.Canceled", err)
+	}
+
+	// shared work is not cancelled for the remaining waiter
+	c <- "bar"
+	r := <-other
+	if r.Err != nil || r.Val.(string) != "bar" {
+		t.Errorf("DoChan = %v, %v; want bar, nil", r.Val, r.Err)
+	}
+	if got := atomic.LoadInt32(&calls); got != 1 {
+		t.Errorf("number of calls = %d; want 1", got)
+	}
+}
+
+func TestForget(t *testing.T) {
+	var g Group
+	c := make(chan string)
+	first := g.DoChan("key", func() (interface{}, error) {
+		return <-c, nil
+	})
+
+	g.Forget("key")
+	v, err, _ := g.Do("key", func() (interface{}, error) {
+		return "baz", nil
+	})
+	if err != nil || v.(string) != "baz" {
+		t.Errorf("Do after Forget = %v, %v; want baz, nil", v, err)
+	}
+
+	c <- "bar"
+	if r := <-first; r.Val.(string) != "bar" {
+		t.Errorf("forgotten call = %v; want bar", r.Val)
+	}
+}
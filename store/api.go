@@ -20,9 +20,12 @@
 package store
 
 import (
+	"context"
 	"crypto/sha1"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
 )
 
 // api constants
@@ -31,14 +34,24 @@ const (
 )
 
 // Errors & Warnings
+//
+// Errors returned by the store either are, or wrap, one of the following.
+// Use errors.Is to test for a specific error.
 var (
-	ExistingErr      = fmt.Errorf("existing entry")
-	NotFoundErr      = fmt.Errorf("entry not found")
-	DataCorruptedErr = fmt.Errorf("data corrupted")
-	DiskFullErr      = fmt.Errorf("disk full error")
-	NilValueErr      = fmt.Errorf("nil value error")
-	ZeroValueErr     = fmt.Errorf("zero value error")
-	InvalidKeyErr    = fmt.Errorf("key is not compliant to spec.")
+	ExistingErr       = errors.New("existing entry")
+	NotFoundErr       = errors.New("entry not found")
+	DataCorruptedErr  = errors.New("data corrupted")
+	DiskFullErr       = errors.New("disk full error")
+	TooLargeErr       = errors.New("value too large error")
+	NilValueErr       = errors.New("nil value error")
+	ZeroValueErr      = errors.New("zero value error")
+	InvalidKeyErr     = errors.New("key is not compliant to spec.")
+	ReadOnlyErr       = errors.New("store is read-only")
+	ClosedErr         = errors.New("store is closed")
+	InvalidArchiveErr = errors.New("invalid archive")
+	InternalErr       = errors.New("internal store error")
+	UnavailableErr    = errors.New("store temporarily unavailable")
+	BusyErr           = errors.New("store busy")
 )
 
 // value blob keys are sha1 digests
@@ -51,7 +64,31 @@ func (k Key) String() string {
 	return hex.EncodeToString(k[:])
 }
 
+// ParseKey parses the hex encoded key 's'. Returns InvalidKeyErr unless
+// 's' is exactly 2*KeySize hex digits.
+func ParseKey(s string) (Key, error) {
+	var key Key
+	if len(s) != 2*KeySize {
+		return key, fmt.Errorf("%w - expect %d hex digits - have %d", InvalidKeyErr, 2*KeySize, len(s))
+	}
+	if _, e := hex.Decode(key[:], []byte(s)); e != nil {
+		return key, fmt.Errorf("%w - %s", InvalidKeyErr, e)
+	}
+	return key, nil
+}
+
+// KeyOf returns the key of value blob 'v'.
+func KeyOf(v []byte) Key {
+	return Key(sha1.Sum(v))
+}
+
 // type defines the interface for a content addressable k/v store.
+//
+// Values returned by Get and Del are owned by the caller. Use View for
+// zero-copy access to values.
+//
+// The Context variants of the methods stop once ctx is done and return
+// ctx.Err(). Note that operations already committed are not rolled back.
 type KVStore interface {
 	// Adds value blob 'val' to store. Returns computed key.
 	Put(val []byte) (Key, error)
@@ -59,6 +96,15 @@ type KVStore interface {
 	Get(key Key) ([]byte, error)
 	// Dels the specified value for 'key', if any.
 	Del(key Key) ([]byte, error)
+	// Calls fn with the value for 'key', if any. The value is only valid
+	// for the duration of the call and must not be modified. Errors
+	// returned by fn are returned as is.
+	View(key Key, fn func(val []byte) error) error
+
+	PutContext(ctx context.Context, val []byte) (Key, error)
+	GetContext(ctx context.Context, key Key) ([]byte, error)
+	DelContext(ctx context.Context, key Key) ([]byte, error)
+	ViewContext(ctx context.Context, key Key, fn func(val []byte) error) error
 }
 
 // type defines the general store and data semantics of the storage engine.
@@ -67,4 +113,44 @@ type Store interface {
 	// Closes the store
 	Close() error
 	Info() ([]byte, error)
+	// Writes a consistent snapshot of the store to 'w'.
+	// Returns the number of bytes written.
+	Backup(w io.Writer) (int64, error)
+	// Calls fn for every blob in the store. Iteration stops at the
+	// first error returned by fn. 'val' is only valid for the call.
+	ForEach(fn func(key Key, val []byte) error) error
+	// Reclaims free space of the backing store.
+	// Returns the store size before and after compaction, or BusyErr
+	// if a backup or export is in progress.
+	Compact() (before, after int64, err error)
+	// Verifies the store can serve requests. Returns UnavailableErr
+	// while maintenance (backup, export, compaction) is in progress.
+	Check() error
+
+	InfoContext(ctx context.Context) ([]byte, error)
+	BackupContext(ctx context.Context, w io.Writer) (int64, error)
+	ForEachContext(ctx context.Context, fn func(key Key, val []byte) error) error
+	CompactContext(ctx context.Context) (before, after int64, err error)
+	CheckContext(ctx context.Context) error
+}
+
+// Credentials is an optional interface of stores that also persist
+// service credentials, e.g. access tokens. Credentials are opaque
+// values keyed by id, and are neither blobs nor part of exports.
+type Credentials interface {
+	// Sets credential 'id' to 'v'. Overwrites existing credentials.
+	PutCredential(id string, v []byte) error
+	// Returns NotFoundErr if credential 'id' does not exist.
+	GetCredential(id string) ([]byte, error)
+	// Returns NotFoundErr if credential 'id' does not exist.
+	DelCredential(id string) error
+	// Calls fn for every credential. 'v' is only valid for the call.
+	ForEachCredential(fn func(id string, v []byte) error) error
+}
+
+// SizedWriter is an optional interface of Backup writers. Stores that
+// know the size of the snapshot call SetSize before writing it.
+type SizedWriter interface {
+	io.Writer
+	SetSize(n int64)
 }
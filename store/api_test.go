@@ -0,0 +1,46 @@
+//    Copyright © 2016 Joubin Houshyar. All rights reserved.
+//
+//    This file is part of Frankinstore.
+//
+//    Frankinstore is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU Affero General Public License as
+//    published by the Free Software Foundation, either version 3 of
+//    the License, or (at your option) any later version.
+//
+//    Frankinstore is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU Affero General Public License for more details.
+//
+//    You should have received a copy of the GNU Affero General Public
+//    License along with Frankinstore.  If not, see <http://www.gnu.org/licenses/>.
+
+package store
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestParseKey(t *testing.T) {
+	v := []byte("hello borisdb")
+	key := KeyOf(v)
+	if k, e := ParseKey(key.String()); e != nil || k != key {
+		t.Errorf("ParseKey(%s) = %s, %v; want %s, nil", key, k, e, key)
+	}
+	if k, e := ParseKey(strings.ToUpper(key.String())); e != nil || k != key {
+		t.Errorf("ParseKey(upper case) = %s, %v; want %s, nil", k, e, key)
+	}
+	for _, s := range []string{
+		"",
+		"00ff",
+		key.String()[:KeySize*2-1],
+		key.String() + "00",
+		strings.Repeat("zz", KeySize),
+	} {
+		if _, e := ParseKey(s); !errors.Is(e, InvalidKeyErr) {
+			t.Errorf("ParseKey(%q) error = %v; want InvalidKeyErr", s, e)
+		}
+	}
+}
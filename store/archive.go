@@ -0,0 +1,246 @@
+//    Copyright © 2016 Joubin Houshyar. All rights reserved.
+//
+//    This file is part of Frankinstore.
+//
+//    Frankinstore is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU Affero General Public License as
+//    published by the Free Software Foundation, either version 3 of
+//    the License, or (at your option) any later version.
+//
+//    Frankinstore is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU Affero General Public License for more details.
+//
+//    You should have received a copy of the GNU Affero General Public
+//    License along with Frankinstore.  If not, see <http://www.gnu.org/licenses/>.
+
+package store
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+)
+
+// Export archives are POSIX tar streams with the following layout:
+//
+//	META                  archive format and creation time
+//	blobs/<hex-key>       one entry per blob, content is the value
+//	...
+//	MANIFEST              "<hex-key> <size>" line per blob, followed by
+//	                      "count <n>" and "sha1 <hex-digest>" lines.
+//
+// The trailing sha1 digest is computed over all preceding manifest lines
+// and guards against truncated or tampered archives.
+const (
+	ArchiveFormat = "borisdb-archive/1"
+
+	archiveMeta     = "META"
+	archiveManifest = "MANIFEST"
+	archiveBlobDir  = "blobs/"
+)
+
+// max blob size of archive entries, unless limited by the store
+const archiveMaxBlob = 1 << 30
+
+// Writes every blob in store 's' to 'w' as an export archive.
+// Returns the number of exported blobs.
+func Export(s Store, w io.Writer) (int, error) {
+	return ExportContext(context.Background(), s, w)
+}
+
+// Export that stops once ctx is done.
+func ExportContext(ctx context.Context, s Store, w io.Writer) (n int, err error) {
+	tw := tar.NewWriter(w)
+	now := time.Now()
+
+	meta := fmt.Sprintf("format %s\ncreated %s\n", ArchiveFormat, now.UTC().Format(time.RFC3339))
+	if e := writeArchiveEntry(tw, archiveMeta, []byte(meta), now); e != nil {
+		return 0, fmt.Errorf("err - Export - %w", e)
+	}
+
+	var manifest bytes.Buffer
+	e := s.ForEachContext(ctx, func(key Key, val []byte) error {
+		if e := ctx.Err(); e != nil {
+			return e
+		}
+		if e := writeArchiveEntry(tw, archiveBlobDir+key.String(), val, now); e != nil {
+			return e
+		}
+		fmt.Fprintf(&manifest, "%s %d\n", key, len(val))
+		n++
+		return nil
+	})
+	if e != nil {
+		return n, fmt.Errorf("err - Export - %w", e)
+	}
+
+	fmt.Fprintf(&manifest, "count %d\n", n)
+	fmt.Fprintf(&manifest, "sha1 %x\n", sha1.Sum(manifest.Bytes()))
+	if e := writeArchiveEntry(tw, archiveManifest, manifest.Bytes(), now); e != nil {
+		return n, fmt.Errorf("err - Export - %w", e)
+	}
+	if e := tw.Close(); e != nil {
+		return n, fmt.Errorf("err - Export - %w", e)
+	}
+	return n, nil
+}
+
+// Reads an export archive from 'r' and adds every blob to store 's'
+// using the normal Put path. Each blob is verified against its key and
+// the archive as a whole is verified against its manifest. Blobs that are
+// already in the store are skipped. Returns the number of imported blobs.
+//
+// Note that blobs are added as they are read: an archive that fails
+// verification may still have been partially imported.
+func Import(s KVStore, r io.Reader) (int, error) {
+	return ImportContext(context.Background(), s, r)
+}
+
+// Import that stops once ctx is done.
+func ImportContext(ctx context.Context, s KVStore, r io.Reader) (n int, err error) {
+	var maxsize int64
+	if ls, ok := s.(interface{ maxBlobSize() int64 }); ok {
+		maxsize = ls.maxBlobSize()
+	}
+	e := ReadArchive(ctx, r, maxsize, func(key Key, val []byte) error {
+		switch _, e := s.PutContext(ctx, val); {
+		case errors.Is(e, ExistingErr):
+			return nil
+		case e != nil:
+			return fmt.Errorf("%s%s - %w", archiveBlobDir, key, e)
+		}
+		n++
+		return nil
+	})
+	if e != nil {
+		return n, fmt.Errorf("err - Import - %w", e)
+	}
+	return n, nil
+}
+
+// Reads an export archive from 'r' and calls fn for every blob. Each
+// blob is verified against its key, and the archive as a whole against
+// its manifest, once all blobs are read. 'val' is only valid for the
+// call. Reading stops at the first error returned by fn, which is
+// returned as is. Blobs that fail verification are reported as
+// InvalidArchiveErr, and blobs larger than 'maxsize' (if zero, 1GB) as
+// InvalidArchiveErr and TooLargeErr, before they are read.
+func ReadArchive(ctx context.Context, r io.Reader, maxsize int64, fn func(key Key, val []byte) error) error {
+	if maxsize <= 0 {
+		maxsize = archiveMaxBlob
+	}
+	tr := tar.NewReader(r)
+
+	var manifest bytes.Buffer
+	var cnt int
+	for {
+		if e := ctx.Err(); e != nil {
+			return e
+		}
+		hdr, e := tr.Next()
+		if e == io.EOF {
+			return fmt.Errorf("%w - archive has no manifest", InvalidArchiveErr)
+		}
+		if e != nil {
+			return fmt.Errorf("%w - %w", InvalidArchiveErr, e)
+		}
+
+		switch {
+		case hdr.Name == archiveMeta:
+			if e := checkArchiveMeta(tr); e != nil {
+				return fmt.Errorf("%w - %s", InvalidArchiveErr, e)
+			}
+		case hdr.Name == archiveManifest:
+			fmt.Fprintf(&manifest, "count %d\n", cnt)
+			fmt.Fprintf(&manifest, "sha1 %x\n", sha1.Sum(manifest.Bytes()))
+			data, e := ioutil.ReadAll(io.LimitReader(tr, int64(manifest.Len())+1))
+			if e != nil {
+				return fmt.Errorf("%w - %w", InvalidArchiveErr, e)
+			}
+			if !bytes.Equal(data, manifest.Bytes()) {
+				return fmt.Errorf("%w - manifest mismatch", InvalidArchiveErr)
+			}
+			return nil
+		case strings.HasPrefix(hdr.Name, archiveBlobDir):
+			if hdr.Size > maxsize {
+				return fmt.Errorf("%s - %w - %w - size %d exceeds %d", hdr.Name, InvalidArchiveErr, TooLargeErr, hdr.Size, maxsize)
+			}
+			key, val, e := readArchiveBlob(strings.TrimPrefix(hdr.Name, archiveBlobDir), io.LimitReader(tr, hdr.Size+1))
+			if e != nil {
+				return fmt.Errorf("%s - %w", hdr.Name, e)
+			}
+			if e := fn(key, val); e != nil {
+				return e
+			}
+			cnt++
+		default:
+			return fmt.Errorf("%w - unexpected entry %q", InvalidArchiveErr, hdr.Name)
+		}
+
+		if hdr.Name != archiveMeta {
+			fmt.Fprintf(&manifest, "%s %d\n", strings.TrimPrefix(hdr.Name, archiveBlobDir), hdr.Size)
+		}
+	}
+}
+
+// reads and verifies a single archive blob. blobs that fail
+// verification are reported as InvalidArchiveErr.
+func readArchiveBlob(keystr string, r io.Reader) (Key, []byte, error) {
+	var key Key
+	b, e := hex.DecodeString(keystr)
+	if e != nil || len(b) != KeySize {
+		return key, nil, fmt.Errorf("%w - %w", InvalidArchiveErr, InvalidKeyErr)
+	}
+	copy(key[:], b)
+
+	val, e := ioutil.ReadAll(r)
+	if e != nil {
+		return key, nil, fmt.Errorf("%w - %w", InvalidArchiveErr, e)
+	}
+	if Key(sha1.Sum(val)) != key {
+		return key, nil, fmt.Errorf("%w - %w", InvalidArchiveErr, DataCorruptedErr)
+	}
+	return key, val, nil
+}
+
+func checkArchiveMeta(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == "format" {
+			if fields[1] != ArchiveFormat {
+				return fmt.Errorf("unsupported archive format %q", fields[1])
+			}
+			return nil
+		}
+	}
+	if e := scanner.Err(); e != nil {
+		return e
+	}
+	return fmt.Errorf("archive format not specified")
+}
+
+func writeArchiveEntry(tw *tar.Writer, name string, data []byte, modtime time.Time) error {
+	hdr := &tar.Header{
+		Name:    name,
+		Mode:    0600,
+		Size:    int64(len(data)),
+		ModTime: modtime,
+	}
+	if e := tw.WriteHeader(hdr); e != nil {
+		return e
+	}
+	_, e := tw.Write(data)
+	return e
+}
@@ -0,0 +1,170 @@
+//    Copyright © 2016 Joubin Houshyar. All rights reserved.
+//
+//    This file is part of Frankinstore.
+//
+//    Frankinstore is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU Affero General Public License as
+//    published by the Free Software Foundation, either version 3 of
+//    the License, or (at your option) any later version.
+//
+//    Frankinstore is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU Affero General Public License for more details.
+//
+//    You should have received a copy of the GNU Affero General Public
+//    License along with Frankinstore.  If not, see <http://www.gnu.org/licenses/>.
+
+package store
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// exports 'cnt' blobs of a new test store.
+func exportTestDb(t *testing.T, cnt int) []byte {
+	t.Helper()
+	db := openTestDb(t)
+	for i := 0; i < cnt; i++ {
+		if _, e := db.Put([]byte(fmt.Sprintf("blob-%d", i))); e != nil {
+			t.Fatal(e)
+		}
+	}
+	var buf bytes.Buffer
+	n, e := Export(db, &buf)
+	if e != nil || n != cnt {
+		t.Fatalf("Export = %d, %v - expect %d blobs", n, e, cnt)
+	}
+	return buf.Bytes()
+}
+
+// rewrites the entries of archive 'data' with fn.
+func rewriteArchive(t *testing.T, data []byte, fn func(name string, body []byte) []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tr := tar.NewReader(bytes.NewReader(data))
+	tw := tar.NewWriter(&buf)
+	for {
+		hdr, e := tr.Next()
+		if e == io.EOF {
+			break
+		} else if e != nil {
+			t.Fatal(e)
+		}
+		body, e := io.ReadAll(tr)
+		if e != nil {
+			t.Fatal(e)
+		}
+		if e := writeArchiveEntry(tw, hdr.Name, fn(hdr.Name, body), time.Now()); e != nil {
+			t.Fatal(e)
+		}
+	}
+	if e := tw.Close(); e != nil {
+		t.Fatal(e)
+	}
+	return buf.Bytes()
+}
+
+func TestArchiveRoundTrip(t *testing.T) {
+	archive := exportTestDb(t, 100)
+	db := openTestDb(t)
+	n, e := Import(db, bytes.NewReader(archive))
+	if e != nil || n != 100 {
+		t.Fatalf("Import = %d, %v - expect 100 blobs", n, e)
+	}
+	for i := 0; i < 100; i++ {
+		val := []byte(fmt.Sprintf("blob-%d", i))
+		if v, e := db.Get(KeyOf(val)); e != nil || !bytes.Equal(v, val) {
+			t.Fatalf("Get %q = %q, %v", val, v, e)
+		}
+	}
+	// existing blobs are not counted
+	if n, e := Import(db, bytes.NewReader(archive)); e != nil || n != 0 {
+		t.Errorf("re-Import = %d, %v - expect 0 blobs", n, e)
+	}
+}
+
+func TestArchiveTampered(t *testing.T) {
+	archive := exportTestDb(t, 10)
+	tampered := 0
+	for _, tc := range []struct {
+		name    string
+		data    []byte
+		expect  error
+		imports bool // some blobs are imported before the error
+	}{
+		{"manifest", rewriteArchive(t, archive, func(name string, body []byte) []byte {
+			if name == archiveManifest {
+				return bytes.Replace(body, []byte("count 10"), []byte("count 9"), 1)
+			}
+			return body
+		}), InvalidArchiveErr, true},
+		{"blob", rewriteArchive(t, archive, func(name string, body []byte) []byte {
+			if strings.HasPrefix(name, archiveBlobDir) && tampered == 0 {
+				tampered++
+				body = append([]byte(nil), body...)
+				body[0] ^= 0xff
+			}
+			return body
+		}), DataCorruptedErr, false},
+		{"manifest size", rewriteArchive(t, archive, func(name string, body []byte) []byte {
+			if name == archiveManifest {
+				return bytes.Replace(body, []byte(" 6\n"), []byte(" 7\n"), 1)
+			}
+			return body
+		}), InvalidArchiveErr, true},
+		{"truncated", archive[:len(archive)/2], InvalidArchiveErr, true},
+	} {
+		db := openTestDb(t)
+		n, e := Import(db, bytes.NewReader(tc.data))
+		if !errors.Is(e, tc.expect) || !errors.Is(e, InvalidArchiveErr) {
+			t.Errorf("%s: Import error = %v - expect %v", tc.name, e, tc.expect)
+		}
+		if !tc.imports && n != 0 {
+			t.Errorf("%s: Import = %d - expect no blobs", tc.name, n)
+		}
+	}
+}
+
+// oversized entries are rejected before they are read.
+func TestArchiveTooLarge(t *testing.T) {
+	// archive of a single entry header, claiming 'size' bytes
+	header := func(size int64) []byte {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		key := KeyOf([]byte("large"))
+		if e := tw.WriteHeader(&tar.Header{Name: archiveBlobDir + key.String(), Mode: 0600, Size: size}); e != nil {
+			t.Fatal(e)
+		}
+		return buf.Bytes()
+	}
+	limited, e := OpenDb(filepath.Join(t.TempDir(), DefaultDb), &Options{MaxBlobSize: 100})
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer limited.Close()
+
+	for _, tc := range []struct {
+		name string
+		db   Store
+		size int64
+	}{
+		{"unlimited", openTestDb(t), archiveMaxBlob + 1},
+		{"limited", limited, 101},
+	} {
+		if _, e := Import(tc.db, bytes.NewReader(header(tc.size))); !errors.Is(e, TooLargeErr) || !errors.Is(e, InvalidArchiveErr) {
+			t.Errorf("%s: Import error = %v - expect TooLargeErr", tc.name, e)
+		}
+	}
+	if _, e := Import(limited, bytes.NewReader(exportTestDb(t, 3))); e != nil {
+		t.Errorf("Import error = %v", e)
+	}
+}
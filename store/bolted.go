@@ -18,67 +18,237 @@
 package store
 
 import (
+	"context"
 	"crypto/sha1"
+	"errors"
 	"fmt"
 	"github.com/alphazero/borisdb/singleflight"
 	"github.com/boltdb/bolt"
+	"io"
+	"os"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// opens bolt dbs for compaction. tests replace it to inject failures.
+var boltOpen = bolt.Open
+
 // count of segments in key-space
 const segmentCnt = 8
 
 // metabucket
 var dbinfo = []byte("dbinfo")
 
+// dbinfo keys
+var (
+	objcntKey = []byte("object-cnt")
+	sizeKey   = []byte("size")
+)
+
+// store options. zerovalue limits are not enforced.
+type Options struct {
+	MaxBlobSize int64 // max size of a single value blob
+	MaxSize     int64 // max total size of all value blobs
+	ReadOnly    bool  // open with a shared lock and reject mutations
+	// ops taking longer are logged. Disabled if zerovalue.
+	SlowOpThreshold time.Duration
+	// max pending (queued or running) mutations per segment. Excess
+	// mutations fail with BusyErr instead of queueing.
+	MaxSegmentWrites int
+}
+
+func (o *Options) boltOptions() *bolt.Options {
+	return &bolt.Options{ReadOnly: o.ReadOnly}
+}
+
 // type encapsulates boltdb instance and other state info as required.
 // this type supports store.KVStore.
 // this type supports store.Store.
 type boltdb struct {
+	name      string
+	opts      Options
+	mu        sync.RWMutex            // protects db handle - see Compact
+	wgate     sync.RWMutex            // held by writers - see Compact
+	cmu       sync.Mutex              // held by compactions
+	maint     atomic.Int32            // in-progress backups, exports and compactions - see Check
+	streams   atomic.Int32            // in-progress backups and exports - see Compact
+	swapping  atomic.Bool             // compacted db is being swapped in - see Compact
+	journal   atomic.Pointer[journal] // mutations during compaction, if any
+	lost      atomic.Bool             // db could not be reopened - see Compact
 	db        *bolt.DB
 	metaGroup *singleflight.Group
-	putGroup  []*singleflight.Group
-	getGroup  []*singleflight.Group
+	segments  []*segment
 }
 
-func OpenDb(name string) (Store, error) {
-	bdb, e := bolt.Open(name, 0600, nil)
+// type encapsulates the concurrency control of a key-space segment.
+//
+// Reads are coalesced with concurrent reads of the same key and never
+// with mutations. Mutations are ordered by the segment lock, and forget
+// any in-flight read of the mutated key, so reads that start after a
+// mutation completes always observe it. Deletes also forget any
+// in-flight put of the key, for the same reason.
+type segment struct {
+	id      string             // metrics label
+	reads   singleflight.Group // coalesces Get
+	writes  singleflight.Group // coalesces Put of identical values
+	mu      sync.Mutex         // orders mutations
+	pending atomic.Int32       // admitted mutations - see admit
+}
+
+// Opens (or creates) the bolt database file 'name'. 'opts' may be nil.
+func OpenDb(name string, opts *Options) (Store, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	bdb, e := bolt.Open(name, 0600, opts.boltOptions())
 	if e != nil {
-		return nil, fmt.Errorf("err - OpenDb - %s", e)
+		return nil, fmt.Errorf("err - OpenDb - %w", boltErr(e))
 	}
 
 	// create the store and return
 	db := &boltdb{
+		name:      name,
+		opts:      *opts,
 		db:        bdb,
 		metaGroup: &singleflight.Group{},
-		putGroup:  make([]*singleflight.Group, segmentCnt),
-		getGroup:  make([]*singleflight.Group, segmentCnt),
+		segments:  make([]*segment, segmentCnt),
 	}
 
-	e = db.init()
-	return db, e
+	if e := db.init(); e != nil {
+		bdb.Close()
+		return nil, fmt.Errorf("err - OpenDb - %w", e)
+	}
+	db.registerMetrics()
+	return db, nil
 }
 
 func (p *boltdb) init() error {
 	for i := 0; i < segmentCnt; i++ {
-		p.putGroup[i] = &singleflight.Group{}
-		p.getGroup[i] = &singleflight.Group{}
+		p.segments[i] = &segment{id: strconv.Itoa(i)}
+	}
+	// existing store is used as is in read-only mode
+	if p.opts.ReadOnly {
+		return p.view(txCheckBucketsFn)
+	}
+	for i := 0; i < segmentCnt; i++ {
 		// create the single toplevel bucket
 		bid := []byte(fmt.Sprintf("bucket-%d", i))
-		if e := p.db.Update(createBucketFn(bid)); e != nil {
+		if e := p.update(createBucketFn(bid), nil); e != nil {
 			return e
 		}
 	}
-	if e := p.db.Update(createBucketFn(dbinfo)); e != nil {
+	if e := p.update(createBucketFn(dbinfo), nil); e != nil {
+		return e
+	}
+	if e := p.update(createBucketFn(credentials), nil); e != nil {
 		return e
 	}
 	return nil
 }
 
+// Verify opens the (backup) database file 'name' read-only and checks
+// that it is complete and consistent, and has the expected bucket
+// structure of a borisdb store. Returns DataCorruptedErr otherwise.
+func Verify(name string) (err error) {
+	size, e := fileSize(name)
+	if e != nil {
+		return fmt.Errorf("err - Verify - %w", e)
+	}
+
+	// bolt panics on corrupted pages, and faults on pages past the end
+	// of a truncated file (even in Open). both are recovered here.
+	defer debug.SetPanicOnFault(debug.SetPanicOnFault(true))
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("err - Verify - %w - %v", DataCorruptedErr, r)
+		}
+	}()
+
+	opts := &bolt.Options{ReadOnly: true, Timeout: time.Second}
+	bdb, e := bolt.Open(name, 0400, opts)
+	if e != nil {
+		return fmt.Errorf("err - Verify - %w", boltErr(e))
+	}
+	defer bdb.Close()
+
+	e = bdb.View(func(tx *bolt.Tx) error {
+		// the meta page records the high-water mark of the file
+		if size < tx.Size() {
+			return fmt.Errorf("%w - truncated file - have %d bytes - expect %d", DataCorruptedErr, size, tx.Size())
+		}
+		if e := txCheckPages(tx); e != nil {
+			return e
+		}
+		if e := txCheckBucketsFn(tx); e != nil {
+			return e
+		}
+		// all pages are read here, as tx.Check runs in a goroutine that
+		// can not recover
+		if e := walkBuckets(tx, func([][]byte, []byte, []byte) error { return nil }); e != nil {
+			return fmt.Errorf("%w - %s", DataCorruptedErr, e)
+		}
+		var errs []string
+		for e := range tx.Check() {
+			errs = append(errs, e.Error())
+		}
+		if len(errs) > 0 {
+			return fmt.Errorf("%w - %s", DataCorruptedErr, strings.Join(errs, "; "))
+		}
+		return nil
+	})
+	if e != nil {
+		return fmt.Errorf("err - Verify - %w", e)
+	}
+	return nil
+}
+
+// verifies the bucket structure of a borisdb store.
+func txCheckBucketsFn(tx *bolt.Tx) error {
+	for i := 0; i < segmentCnt; i++ {
+		if tx.Bucket(bucketIdFor(i)) == nil {
+			return fmt.Errorf("%w - missing bucket %q", DataCorruptedErr, bucketIdFor(i))
+		}
+	}
+	if tx.Bucket(dbinfo) == nil {
+		return fmt.Errorf("%w - missing bucket %q", DataCorruptedErr, dbinfo)
+	}
+	return nil
+}
+
+// verifies the type of all allocated pages below the high-water mark.
+// bolt cursors loop on zeroed pages, so this precedes any bucket walk.
+func txCheckPages(tx *bolt.Tx) error {
+	for id := 2; ; id++ {
+		info, e := tx.Page(id)
+		if e != nil {
+			return boltErr(e)
+		} else if info == nil {
+			return nil
+		}
+		switch info.Type {
+		case "free":
+		case "leaf", "freelist":
+			id += info.OverflowCount
+		case "branch":
+			if info.Count == 0 {
+				return fmt.Errorf("%w - page %d - empty branch", DataCorruptedErr, id)
+			}
+			id += info.OverflowCount
+		default:
+			return fmt.Errorf("%w - page %d - invalid type %s", DataCorruptedErr, id, info.Type)
+		}
+	}
+}
+
 func createBucketFn(bid []byte) func(*bolt.Tx) error {
 	return func(tx *bolt.Tx) error {
 		_, e := tx.CreateBucketIfNotExists(bid)
 		if e != nil {
-			return fmt.Errorf("failed to create bucket: %s", e)
+			return fmt.Errorf("failed to create bucket: %w", boltErr(e))
 		}
 		return nil
 	}
@@ -88,26 +258,245 @@ func createBucketFn(bid []byte) func(*bolt.Tx) error {
 
 // support Store.Close()
 func (p *boltdb) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
 	return p.db.Close()
 }
 
 // support Store.Info
-func (p *boltdb) Info() (value []byte, err error) {
-	dbinfo, e := p.metaGroup.Do("update", p.dbinfoUpdateOpFn(0))
+func (p *boltdb) Info() ([]byte, error) {
+	return p.InfoContext(context.Background())
+}
+
+// support Store.InfoContext
+func (p *boltdb) InfoContext(ctx context.Context) (value []byte, err error) {
+	defer p.observe(ctx, "info", time.Now(), &err)
+	dbinfo, e, shared := p.metaGroup.DoContext(ctx, "info", p.dbinfoOpFn())
+	if shared {
+		coalesced.With("meta", "info").Inc()
+	}
 	if e != nil {
-		err = e // REVU: not too much time but map boltdb errors to ours
+		err = boltErr(e)
 		return
 	}
 
 	return dbinfo.([]byte), e
 }
 
+// support Store.Backup
+func (p *boltdb) Backup(w io.Writer) (int64, error) {
+	return p.BackupContext(context.Background(), w)
+}
+
+// support Store.BackupContext
+// the snapshot is taken in a read-only transaction and is consistent
+// irrespective of concurrent writes.
+func (p *boltdb) BackupContext(ctx context.Context, w io.Writer) (n int64, err error) {
+	defer p.observe(ctx, "backup", time.Now(), &err)
+	if e := ctx.Err(); e != nil {
+		return 0, e
+	}
+	if e := p.startStream(); e != nil {
+		return 0, fmt.Errorf("err - Backup - %w", e)
+	}
+	defer p.endStream()
+	err = p.view(func(tx *bolt.Tx) error {
+		// tx.WriteTo writes exactly tx.Size bytes
+		if sw, ok := w.(SizedWriter); ok {
+			sw.SetSize(tx.Size())
+		}
+		var e error
+		n, e = tx.WriteTo(ctxWriter{ctx, w})
+		return e
+	})
+	return
+}
+
+// support Store.ForEach
+func (p *boltdb) ForEach(fn func(Key, []byte) error) error {
+	return p.ForEachContext(context.Background(), fn)
+}
+
+// support Store.ForEachContext
+// all segments are visited in a single read-only transaction.
+func (p *boltdb) ForEachContext(ctx context.Context, fn func(Key, []byte) error) (err error) {
+	defer p.observe(ctx, "foreach", time.Now(), &err)
+	if e := p.startStream(); e != nil {
+		return fmt.Errorf("err - ForEach - %w", e)
+	}
+	defer p.endStream()
+	return p.view(func(tx *bolt.Tx) error {
+		for i := 0; i < segmentCnt; i++ {
+			e := tx.Bucket(bucketIdFor(i)).ForEach(func(k, v []byte) error {
+				if e := ctx.Err(); e != nil {
+					return e
+				}
+				var key Key
+				copy(key[:], k)
+				return fn(key, v)
+			})
+			if e != nil {
+				return e
+			}
+		}
+		return nil
+	})
+}
+
+// support Store.Compact
+func (p *boltdb) Compact() (before, after int64, err error) {
+	return p.CompactContext(context.Background())
+}
+
+// support Store.CompactContext
+// the db is copied from a read-only snapshot while writers proceed.
+// writers are then briefly blocked while their mutations are applied
+// to the copy, and readers while the copy is swapped in. compaction
+// fails with BusyErr if a backup or export holds the db, and can only
+// be cancelled before the swap.
+func (p *boltdb) CompactContext(ctx context.Context) (before, after int64, err error) {
+	defer p.observe(ctx, "compact", time.Now(), &err)
+	if p.opts.ReadOnly {
+		return 0, 0, ReadOnlyErr
+	}
+	if !p.cmu.TryLock() {
+		return 0, 0, fmt.Errorf("err - Compact - %w - compaction in progress", BusyErr)
+	}
+	defer p.cmu.Unlock()
+	if p.streams.Load() > 0 {
+		return 0, 0, fmt.Errorf("err - Compact - %w - backup or export in progress", BusyErr)
+	}
+	p.maint.Add(1)
+	defer p.maint.Add(-1)
+
+	// mutations committed once the journal is set are replayed below
+	j := &journal{keys: make(map[journalKey]struct{})}
+	p.journal.Store(j)
+	defer p.journal.Store(nil)
+
+	tmpname := p.name + ".compact"
+	p.mu.RLock()
+	before, err = fileSize(p.name)
+	if err == nil {
+		err = compactTo(ctx, p.db, tmpname)
+	}
+	p.mu.RUnlock()
+	if err == nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		os.Remove(tmpname)
+		return before, 0, fmt.Errorf("err - Compact - %w", boltErr(err))
+	}
+
+	p.wgate.Lock()
+	defer p.wgate.Unlock()
+	// streams hold the db handle, and would block readers waiting on
+	// the swap. streams starting from here on fail.
+	p.swapping.Store(true)
+	defer p.swapping.Store(false)
+	if p.streams.Load() > 0 {
+		os.Remove(tmpname)
+		return before, 0, fmt.Errorf("err - Compact - %w - backup or export in progress", BusyErr)
+	}
+
+	// the compacted file must open before the store is swapped to it
+	if e := p.replay(tmpname, j); e != nil {
+		os.Remove(tmpname)
+		return before, 0, fmt.Errorf("err - Compact - %w", boltErr(e))
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	// the old handle is unusable once closed, even if Close failed
+	e := p.db.Close()
+	if e == nil {
+		if e = os.Rename(tmpname, p.name); e != nil {
+			e = fmt.Errorf("%w - %s", InternalErr, e)
+		}
+	}
+	if e != nil {
+		os.Remove(tmpname)
+		err = fmt.Errorf("err - Compact - %w", boltErr(e))
+	}
+	// reopen irrespective of rename outcome
+	bdb, e := boltOpen(p.name, 0600, p.opts.boltOptions())
+	if e != nil {
+		p.lost.Store(true)
+		return before, 0, fmt.Errorf("err - Compact - reopen - %w - %s", UnavailableErr, boltErr(e))
+	}
+	p.db = bdb
+	if err != nil {
+		return before, 0, err
+	}
+
+	after, err = fileSize(p.name)
+	return
+}
+
+// registers a backup or export, which holds the db handle for its
+// duration. Fails with BusyErr while a compaction swaps the db.
+func (p *boltdb) startStream() error {
+	p.maint.Add(1)
+	p.streams.Add(1)
+	if p.swapping.Load() {
+		p.endStream()
+		return fmt.Errorf("%w - compaction in progress", BusyErr)
+	}
+	return nil
+}
+
+func (p *boltdb) endStream() {
+	p.streams.Add(-1)
+	p.maint.Add(-1)
+}
+
+// support Store.Check
+func (p *boltdb) Check() error {
+	return p.CheckContext(context.Background())
+}
+
+// support Store.CheckContext
+// the check runs a read transaction over all buckets.
+func (p *boltdb) CheckContext(ctx context.Context) error {
+	if e := ctx.Err(); e != nil {
+		return e
+	}
+	if p.lost.Load() {
+		return fmt.Errorf("err - Check - %w - db lost in compaction", UnavailableErr)
+	}
+	if p.maint.Load() > 0 {
+		return fmt.Errorf("err - Check - %w - maintenance in progress", UnavailableErr)
+	}
+	// the check blocks while the db is swapped (see Compact), and
+	// is bounded by ctx.
+	done := make(chan error, 1)
+	go func() { done <- p.view(txCheckBucketsFn) }()
+	select {
+	case e := <-done:
+		if e != nil {
+			return fmt.Errorf("err - Check - %w", e)
+		}
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("err - Check - %w - %w", UnavailableErr, ctx.Err())
+	}
+}
+
 /// interface: KVStore ////////////////////////////////////////////////////////
 
 // support KVStore.Put
+func (p *boltdb) Put(v []byte) (Key, error) {
+	return p.PutContext(context.Background(), v)
+}
+
+// support KVStore.PutContext
 // computes sha1 hash of value and stores the blob.
 // nil or zerovalue values are not accepted.
-func (p *boltdb) Put(v []byte) (key Key, err error) {
+// values exceeding the store size limits are not accepted.
+func (p *boltdb) PutContext(ctx context.Context, v []byte) (key Key, err error) {
+	start := time.Now()
+	defer func() { p.observe(ctx, "put", start, &err, "key", key.String()) }()
 	/* assert constraints */
 	if v == nil {
 		err = NilValueErr
@@ -117,42 +506,162 @@ func (p *boltdb) Put(v []byte) (key Key, err error) {
 		err = ZeroValueErr
 		return
 	}
+	if p.opts.ReadOnly {
+		err = ReadOnlyErr
+		return
+	}
+	if p.opts.MaxBlobSize > 0 && int64(len(v)) > p.opts.MaxBlobSize {
+		err = TooLargeErr
+		return
+	}
 
 	key = Key(sha1.Sum(v))
-	gid := segmentFor(key)
-	opkey := key.String()
-	_, e := p.putGroup[gid].Do(opkey, p.putOpFn(key, v))
-	if e != nil {
-		err = e // REVU: not too much time but map boltdb errors to ours
-		return
+	seg := p.segments[segmentFor(key)]
+	_, e, shared := seg.writes.DoContext(ctx, opkey("put", key), p.putOpFn(seg, key, v))
+	if shared {
+		coalesced.With(seg.id, "put").Inc()
 	}
-	_, e = p.metaGroup.Do("update", p.dbinfoUpdateOpFn(len(v)))
 	if e != nil {
-		err = e // REVU: not too much time but map boltdb errors to ours
+		err = boltErr(e)
 		return
 	}
+	bytesIn.Add(float64(len(v)))
 
 	return
 }
 
 // support KVStore.Get
-func (p *boltdb) Get(key Key) (value []byte, err error) {
-	gid := segmentFor(key)
-	opkey := key.String()
-	v, e := p.getGroup[gid].Do(opkey, p.getOpFn(key))
-	return v.([]byte), e
+func (p *boltdb) Get(key Key) ([]byte, error) {
+	return p.GetContext(context.Background(), key)
 }
 
-// support KVStore Del
-func (p *boltdb) Del(key Key) (value []byte, err error) {
-	gid := segmentFor(key)
-	opkey := key.String()
-	v, e := p.getGroup[gid].Do(opkey, p.delOpFn(key))
-	return v.([]byte), e
+// support KVStore.GetContext
+// values shared by coalesced calls are copied for each caller.
+func (p *boltdb) GetContext(ctx context.Context, key Key) (value []byte, err error) {
+	defer p.observe(ctx, "get", time.Now(), &err, "key", key.String())
+	seg := p.segments[segmentFor(key)]
+	v, e, shared := seg.reads.DoContext(ctx, opkey("get", key), p.getOpFn(key))
+	value, _ = v.([]byte)
+	if shared {
+		coalesced.With(seg.id, "get").Inc()
+		if value != nil {
+			value = copyOf(value)
+		}
+	}
+	bytesOut.Add(float64(len(value)))
+	return value, boltErr(e)
+}
+
+// support KVStore.View
+func (p *boltdb) View(key Key, fn func([]byte) error) error {
+	return p.ViewContext(context.Background(), key, fn)
+}
+
+// support KVStore.ViewContext
+// fn is called in a read-only transaction with the value as mapped by
+// bolt, i.e. without copying. Note that long running calls delay the
+// remapping of the db file by writers.
+func (p *boltdb) ViewContext(ctx context.Context, key Key, fn func([]byte) error) (err error) {
+	defer p.observe(ctx, "get", time.Now(), &err, "key", key.String()) // zero-copy get
+	if e := ctx.Err(); e != nil {
+		return e
+	}
+	return p.view(func(tx *bolt.Tx) error {
+		v := tx.Bucket(bucketIdFor(segmentFor(key))).Get(key[:])
+		if v == nil {
+			return fmt.Errorf("%w - %s", NotFoundErr, key)
+		}
+		bytesOut.Add(float64(len(v)))
+		return fn(v)
+	})
+}
+
+// support KVStore.Del
+func (p *boltdb) Del(key Key) ([]byte, error) {
+	return p.DelContext(context.Background(), key)
+}
+
+// support KVStore.DelContext
+func (p *boltdb) DelContext(ctx context.Context, key Key) (value []byte, err error) {
+	defer p.observe(ctx, "del", time.Now(), &err, "key", key.String())
+	if p.opts.ReadOnly {
+		return nil, ReadOnlyErr
+	}
+	if e := ctx.Err(); e != nil {
+		return nil, e
+	}
+	seg := p.segments[segmentFor(key)]
+	value, e := p.delOp(seg, key)
+	return value, boltErr(e)
+}
+
+// max blob size, or zero if not limited - see ImportContext
+func (p *boltdb) maxBlobSize() int64 {
+	return p.opts.MaxBlobSize
 }
 
 /// internal ops //////////////////////////////////////////////////////////////
 
+// runs fn in a read-only transaction.
+// errors returned by fn are returned as is.
+func (p *boltdb) view(fn func(*bolt.Tx) error) error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return closedErr(p.db.View(fn))
+}
+
+// admits a mutation of segment 'seg', or returns BusyErr if the
+// segment has opts.MaxSegmentWrites pending mutations. Admitted
+// callers must decrement seg.pending when done.
+func (p *boltdb) admit(seg *segment) error {
+	n := seg.pending.Add(1)
+	if max := p.opts.MaxSegmentWrites; max > 0 && int(n) > max {
+		seg.pending.Add(-1)
+		return fmt.Errorf("%w - segment %s has %d pending writes", BusyErr, seg.id, max)
+	}
+	return nil
+}
+
+// runs fn in a read-write transaction. 'keys' of 'bucket' are the keys
+// mutated by fn, which are journaled while a compaction is in progress.
+func (p *boltdb) update(fn func(*bolt.Tx) error, bucket []byte, keys ...[]byte) error {
+	p.wgate.RLock()
+	defer p.wgate.RUnlock()
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	e := p.db.Update(fn)
+	if j := p.journal.Load(); j != nil {
+		j.add(bucket, keys)
+	}
+	return closedErr(e)
+}
+
+// io.Writer that fails once its context is done.
+type ctxWriter struct {
+	ctx context.Context
+	w   io.Writer
+}
+
+func (w ctxWriter) Write(b []byte) (int, error) {
+	if e := w.ctx.Err(); e != nil {
+		return 0, e
+	}
+	return w.w.Write(b)
+}
+
+func closedErr(e error) error {
+	if errors.Is(e, bolt.ErrDatabaseNotOpen) {
+		return fmt.Errorf("%w - %s", ClosedErr, e)
+	}
+	return e
+}
+
+// singleflight keys are typed by op so that different ops on the same
+// key are never coalesced.
+func opkey(op string, k Key) string {
+	return op + ":" + k.String()
+}
+
 func segmentFor(k Key) int {
 	return int(k[0] & 0x7)
 }
@@ -161,12 +670,46 @@ func bucketIdFor(segment int) []byte {
 	return []byte(fmt.Sprintf("bucket-%d", segment))
 }
 
+// maps bolt errors to store errors. store errors are returned as is.
+func boltErr(e error) error {
+	switch {
+	case e == nil:
+		return nil
+	case errors.Is(e, context.Canceled), errors.Is(e, context.DeadlineExceeded):
+		return e
+	case errors.Is(e, bolt.ErrDatabaseNotOpen):
+		return fmt.Errorf("%w - %s", ClosedErr, e)
+	case errors.Is(e, bolt.ErrDatabaseReadOnly), errors.Is(e, bolt.ErrTxNotWritable):
+		return fmt.Errorf("%w - %s", ReadOnlyErr, e)
+	case errors.Is(e, bolt.ErrInvalid), errors.Is(e, bolt.ErrChecksum), errors.Is(e, bolt.ErrVersionMismatch):
+		return fmt.Errorf("%w - %s", DataCorruptedErr, e)
+	case errors.Is(e, bolt.ErrValueTooLarge), errors.Is(e, bolt.ErrKeyTooLarge):
+		return fmt.Errorf("%w - %s", TooLargeErr, e)
+	case isStoreErr(e):
+		return e
+	}
+	return fmt.Errorf("%w - %s", InternalErr, e)
+}
+
+func isStoreErr(e error) bool {
+	for _, serr := range []error{
+		ExistingErr, NotFoundErr, DataCorruptedErr, DiskFullErr, TooLargeErr,
+		NilValueErr, ZeroValueErr, InvalidKeyErr, ReadOnlyErr, ClosedErr,
+		InvalidArchiveErr, InternalErr, UnavailableErr, BusyErr,
+	} {
+		if errors.Is(e, serr) {
+			return true
+		}
+	}
+	return false
+}
+
 /* Get */
 
 func (p *boltdb) getOpFn(k Key) func() (interface{}, error) {
 	return func() (interface{}, error) {
 		var v []byte
-		e := p.db.View(txViewFn(k, &v))
+		e := p.view(txViewFn(k, &v))
 		return v, e
 	}
 }
@@ -175,106 +718,125 @@ func txViewFn(k Key, v *[]byte) func(tx *bolt.Tx) error {
 	return func(tx *bolt.Tx) error {
 		bid := bucketIdFor(segmentFor(k))
 		b := tx.Bucket(bid)
-		*v = b.Get(k[:])
-		if *v == nil {
-			return NotFoundErr
+		v0 := b.Get(k[:])
+		if v0 == nil {
+			return fmt.Errorf("%w - %s", NotFoundErr, k)
 		}
+		// bolt values are only valid for the life of the transaction
+		*v = copyOf(v0)
 		return nil
 	}
 }
 
 /* Put */
 
-func (p *boltdb) putOpFn(k Key, v []byte) func() (interface{}, error) {
+func (p *boltdb) putOpFn(seg *segment, k Key, v []byte) func() (interface{}, error) {
 	return func() (interface{}, error) {
-		e := p.db.Update(txUpdateFn(k, v))
+		if e := p.admit(seg); e != nil {
+			return nil, e
+		}
+		defer seg.pending.Add(-1)
+		seg.mu.Lock()
+		defer seg.mu.Unlock()
+		e := p.update(txUpdateFn(k, v, p.opts.MaxSize), bucketIdFor(segmentFor(k)), k[:])
+		seg.reads.Forget(opkey("get", k))
 		return nil, e
 	}
 }
 
-func txUpdateFn(k Key, v []byte) func(tx *bolt.Tx) error {
+// dbinfo is updated in the same transaction. 'maxsize' is enforced
+// if non-zero.
+func txUpdateFn(k Key, v []byte, maxsize int64) func(tx *bolt.Tx) error {
 	return func(tx *bolt.Tx) error {
 		bid := bucketIdFor(segmentFor(k))
 		b := tx.Bucket(bid)
 		v0 := b.Get(k[:])
 		if v0 != nil {
-			return fmt.Errorf("%s - %s", ExistingErr, k.String())
+			return fmt.Errorf("%w - %s", ExistingErr, k)
+		}
+		totsize := toInt64(tx.Bucket(dbinfo).Get(sizeKey))
+		if maxsize > 0 && totsize+int64(len(v)) > maxsize {
+			return DiskFullErr
+		}
+		if e := b.Put(k[:], v); e != nil {
+			return e
 		}
-		return b.Put(k[:], v)
+		return txIncrInfo(tx, int64(len(v)), 1)
 	}
 }
 
 /* Del */
 
-func (p *boltdb) delOpFn(k Key) func() (interface{}, error) {
-	return func() (interface{}, error) {
-		var v []byte
-		e := p.db.Update(txRemoveFn(k, &v))
-		return v, e
+// deletes are not coalesced.
+func (p *boltdb) delOp(seg *segment, k Key) ([]byte, error) {
+	if e := p.admit(seg); e != nil {
+		return nil, e
 	}
+	defer seg.pending.Add(-1)
+	seg.mu.Lock()
+	defer seg.mu.Unlock()
+	var v []byte
+	e := p.update(txRemoveFn(k, &v), bucketIdFor(segmentFor(k)), k[:])
+	// puts of k starting from here on must not join an earlier put
+	seg.reads.Forget(opkey("get", k))
+	seg.writes.Forget(opkey("put", k))
+	return v, e
 }
 
+// dbinfo is updated in the same transaction.
 func txRemoveFn(k Key, v *[]byte) func(tx *bolt.Tx) error {
 	return func(tx *bolt.Tx) error {
-		/* TODO delete
 		bid := bucketIdFor(segmentFor(k))
 		b := tx.Bucket(bid)
-		*v = b.Get(k[:])
-		if *v == nil {
-			return NotFoundErr
+		v0 := b.Get(k[:])
+		if v0 == nil {
+			return fmt.Errorf("%w - %s", NotFoundErr, k)
 		}
-		return nil
-		*/
-		return fmt.Errorf("txRemove opfn not implemented")
+		*v = copyOf(v0)
+		if e := b.Delete(k[:]); e != nil {
+			return e
+		}
+		return txIncrInfo(tx, -int64(len(*v)), -1)
 	}
 }
 
-/* update dbinfo */
+/* dbinfo */
 
-func (p *boltdb) dbinfoUpdateOpFn(size int) func() (interface{}, error) {
+func (p *boltdb) dbinfoOpFn() func() (interface{}, error) {
 	var infostr string
 	return func() (interface{}, error) {
-		e := p.db.Update(txUpdateInfoFn(size, &infostr))
+		e := p.view(txInfoFn(&infostr))
 		return []byte(infostr), e
 	}
 }
 
-func txUpdateInfoFn(size int, infostr *string) func(tx *bolt.Tx) error {
-	var objcntKey = []byte("object-cnt")
-	var sizeKey = []byte("size")
+func txInfoFn(infostr *string) func(tx *bolt.Tx) error {
 	return func(tx *bolt.Tx) error {
 		b := tx.Bucket(dbinfo)
-
-		var v0 []byte
-		var e error
-
-		// update size
-		v0 = b.Get(sizeKey)
-		var totsize = toInt64(v0)
-		if size > 0 {
-			totsize += int64(size)
-			e = b.Put(sizeKey, toByte8(totsize))
-			if e != nil {
-				return e
-			}
-		}
-
-		// update object count
-		v0 = b.Get(objcntKey)
-		var cnt = toInt32(v0)
-		if size > 0 {
-			cnt++
-			e = b.Put(objcntKey, toByte4(cnt))
-			if e != nil {
-				return e
-			}
-		}
-
+		totsize := toInt64(b.Get(sizeKey))
+		cnt := toInt32(b.Get(objcntKey))
 		*infostr = fmt.Sprintf("dbinfo: object-cnt:%d - totsize:%d\n", cnt, totsize)
 		return nil
 	}
 }
 
+// adjusts the dbinfo size and object count by 'dsize' and 'dcnt'.
+func txIncrInfo(tx *bolt.Tx, dsize int64, dcnt int32) error {
+	b := tx.Bucket(dbinfo)
+	totsize := toInt64(b.Get(sizeKey)) + dsize
+	if e := b.Put(sizeKey, toByte8(totsize)); e != nil {
+		return e
+	}
+	cnt := toInt32(b.Get(objcntKey)) + dcnt
+	return b.Put(objcntKey, toByte4(cnt))
+}
+
+func copyOf(b []byte) []byte {
+	c := make([]byte, len(b))
+	copy(c, b)
+	return c
+}
+
 /// temp //////////////////////////////////////////////////////////////////////
 
 func toInt64(b []byte) int64 {
@@ -0,0 +1,608 @@
+//    Copyright © 2016 Joubin Houshyar. All rights reserved.
+//
+//    This file is part of Frankinstore.
+//
+//    Frankinstore is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU Affero General Public License as
+//    published by the Free Software Foundation, either version 3 of
+//    the License, or (at your option) any later version.
+//
+//    Frankinstore is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU Affero General Public License for more details.
+//
+//    You should have received a copy of the GNU Affero General Public
+//    License along with Frankinstore.  If not, see <http://www.gnu.org/licenses/>.
+
+package store
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func openTestDb(t *testing.T) Store {
+	t.Helper()
+	db, e := OpenDb(filepath.Join(t.TempDir(), DefaultDb), nil)
+	if e != nil {
+		t.Fatalf("OpenDb: %v", e)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestPutGetDel(t *testing.T) {
+	db := openTestDb(t)
+	val := []byte("hello borisdb")
+
+	key, e := db.Put(val)
+	if e != nil {
+		t.Fatalf("Put error = %v", e)
+	}
+	if _, e := db.Put(val); !errors.Is(e, ExistingErr) {
+		t.Errorf("Put existing error = %v; want ExistingErr", e)
+	}
+	v, e := db.Get(key)
+	if e != nil || !bytes.Equal(v, val) {
+		t.Errorf("Get = %q, %v; want %q, nil", v, e, val)
+	}
+	v, e = db.Del(key)
+	if e != nil || !bytes.Equal(v, val) {
+		t.Errorf("Del = %q, %v; want %q, nil", v, e, val)
+	}
+	if _, e := db.Get(key); !errors.Is(e, NotFoundErr) {
+		t.Errorf("Get after Del error = %v; want NotFoundErr", e)
+	}
+	if _, e := db.Del(key); !errors.Is(e, NotFoundErr) {
+		t.Errorf("Del after Del error = %v; want NotFoundErr", e)
+	}
+}
+
+// concurrent Get and Del of the same key must never share results and
+// the Del must never be skipped.
+func TestGetDelNoCrossTalk(t *testing.T) {
+	db := openTestDb(t)
+
+	const rounds = 200
+	const readers = 8
+	for i := 0; i < rounds; i++ {
+		val := []byte(fmt.Sprintf("value-%d", i))
+		key, e := db.Put(val)
+		if e != nil {
+			t.Fatalf("Put error = %v", e)
+		}
+
+		var wg sync.WaitGroup
+		for j := 0; j < readers; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				v, e := db.Get(key)
+				switch {
+				case errors.Is(e, NotFoundErr):
+				case e != nil:
+					t.Errorf("Get error = %v", e)
+				case !bytes.Equal(v, val):
+					t.Errorf("Get = %q; want %q", v, val)
+				}
+			}()
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v, e := db.Del(key)
+			if e != nil || !bytes.Equal(v, val) {
+				t.Errorf("Del = %q, %v; want %q, nil", v, e, val)
+			}
+		}()
+		wg.Wait()
+
+		if _, e := db.Get(key); !errors.Is(e, NotFoundErr) {
+			t.Fatalf("round %d: Get after Del error = %v; want NotFoundErr", i, e)
+		}
+	}
+}
+
+// reads that start after a mutation completes must observe it, even
+// while other reads of the same key are in flight.
+func TestMutationOrdering(t *testing.T) {
+	db := openTestDb(t)
+	val := []byte("ordered value")
+	key := Key(sha1.Sum(val))
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for j := 0; j < 8; j++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				if _, e := db.Get(key); e != nil && !errors.Is(e, NotFoundErr) {
+					t.Errorf("Get error = %v", e)
+					return
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < 200; i++ {
+		if _, e := db.Put(val); e != nil {
+			t.Fatalf("Put error = %v", e)
+		}
+		if v, e := db.Get(key); e != nil || !bytes.Equal(v, val) {
+			t.Fatalf("round %d: Get after Put = %q, %v; want %q, nil", i, v, e, val)
+		}
+		if _, e := db.Del(key); e != nil {
+			t.Fatalf("Del error = %v", e)
+		}
+		if _, e := db.Get(key); !errors.Is(e, NotFoundErr) {
+			t.Fatalf("round %d: Get after Del error = %v; want NotFoundErr", i, e)
+		}
+	}
+	close(done)
+	wg.Wait()
+}
+
+// puts that start after a delete completes must not join a put of the
+// same blob that completed before the delete.
+func TestPutRacingDel(t *testing.T) {
+	db := openTestDb(t)
+	val := []byte("racing value")
+	key, e := db.Put(val)
+	if e != nil {
+		t.Fatal(e)
+	}
+	p := db.(*boltdb)
+	seg := p.segments[segmentFor(key)]
+
+	// a put of the blob that has stored it, but not yet returned
+	release := make(chan struct{})
+	defer close(release)
+	seg.writes.DoChan(opkey("put", key), func() (interface{}, error) {
+		<-release
+		return nil, nil
+	})
+
+	if _, e := db.Del(key); e != nil {
+		t.Fatalf("Del error = %v", e)
+	}
+	put := make(chan error, 1)
+	go func() {
+		_, e := db.Put(val)
+		put <- e
+	}()
+	select {
+	case e := <-put:
+		if e != nil {
+			t.Errorf("Put error = %v", e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Put joined a put that completed before Del")
+	}
+	if v, e := db.Get(key); e != nil || !bytes.Equal(v, val) {
+		t.Errorf("Get after Put = %q, %v - expect %q", v, e, val)
+	}
+}
+
+// concurrent Puts and Dels must keep dbinfo consistent with the store.
+func TestConcurrentMutationsInfo(t *testing.T) {
+	db := openTestDb(t)
+
+	const n = 64
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			val := []byte(fmt.Sprintf("value-%d", i%(n/2)))
+			key, e := db.Put(val)
+			if e != nil && !errors.Is(e, ExistingErr) {
+				t.Errorf("Put error = %v", e)
+				return
+			}
+			if i%4 == 0 {
+				if _, e := db.Del(key); e != nil && !errors.Is(e, NotFoundErr) {
+					t.Errorf("Del error = %v", e)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	var cnt, size int
+	e := db.ForEach(func(key Key, val []byte) error {
+		cnt++
+		size += len(val)
+		return nil
+	})
+	if e != nil {
+		t.Fatalf("ForEach error = %v", e)
+	}
+	info, e := db.Info()
+	if e != nil {
+		t.Fatalf("Info error = %v", e)
+	}
+	want := fmt.Sprintf("dbinfo: object-cnt:%d - totsize:%d\n", cnt, size)
+	if string(info) != want {
+		t.Errorf("Info = %q; want %q", info, want)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	db := openTestDb(t)
+	if e := db.Check(); e != nil {
+		t.Fatalf("Check error = %v", e)
+	}
+
+	// a backup blocked on its writer is in progress
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		_, e := db.Backup(pw)
+		done <- e
+	}()
+	buf := make([]byte, 1)
+	if _, e := pr.Read(buf); e != nil {
+		t.Fatalf("backup read error = %v", e)
+	}
+	if e := db.Check(); !errors.Is(e, UnavailableErr) {
+		t.Errorf("Check during backup error = %v; want UnavailableErr", e)
+	}
+	go io.Copy(io.Discard, pr)
+	if e := <-done; e != nil {
+		t.Fatalf("Backup error = %v", e)
+	}
+	if e := db.Check(); e != nil {
+		t.Errorf("Check after backup error = %v", e)
+	}
+
+	db.Close()
+	if e := db.Check(); !errors.Is(e, ClosedErr) {
+		t.Errorf("Check after Close error = %v; want ClosedErr", e)
+	}
+}
+
+func TestSegmentWriteAdmission(t *testing.T) {
+	s, e := OpenDb(filepath.Join(t.TempDir(), DefaultDb), &Options{MaxSegmentWrites: 1})
+	if e != nil {
+		t.Fatalf("OpenDb: %v", e)
+	}
+	defer s.Close()
+	db := s.(*boltdb)
+
+	// two values of segment 0
+	var vals [][]byte
+	for i := 0; len(vals) < 2; i++ {
+		v := []byte(fmt.Sprintf("value-%d", i))
+		if segmentFor(Key(sha1.Sum(v))) == 0 {
+			vals = append(vals, v)
+		}
+	}
+
+	// block the segment with a pending put
+	seg := db.segments[0]
+	seg.mu.Lock()
+	done := make(chan error, 1)
+	go func() {
+		_, e := db.Put(vals[0])
+		done <- e
+	}()
+	for seg.pending.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if _, e := db.Put(vals[1]); !errors.Is(e, BusyErr) {
+		t.Errorf("Put on busy segment error = %v; want BusyErr", e)
+	}
+	if _, e := db.Del(Key(sha1.Sum(vals[1]))); !errors.Is(e, BusyErr) {
+		t.Errorf("Del on busy segment error = %v; want BusyErr", e)
+	}
+	seg.mu.Unlock()
+
+	if e := <-done; e != nil {
+		t.Fatalf("pending Put error = %v", e)
+	}
+	if _, e := db.Put(vals[1]); e != nil {
+		t.Errorf("Put after drain error = %v", e)
+	}
+}
+
+func TestBackupVerify(t *testing.T) {
+	db := openTestDb(t)
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 2000; i++ {
+		v := make([]byte, 1024)
+		rnd.Read(v)
+		if _, e := db.Put(v); e != nil {
+			t.Fatal(e)
+		}
+	}
+	dir := t.TempDir()
+	name := filepath.Join(dir, "backup.db")
+	var buf bytes.Buffer
+	n, e := db.Backup(&buf)
+	if e != nil || n != int64(buf.Len()) {
+		t.Fatalf("Backup = %d (wrote %d), %v", n, buf.Len(), e)
+	}
+	if e := os.WriteFile(name, buf.Bytes(), 0600); e != nil {
+		t.Fatal(e)
+	}
+	if e := Verify(name); e != nil {
+		t.Fatalf("Verify error = %v", e)
+	}
+
+	// truncated and damaged backups are reported, not panicked on
+	backup := buf.Bytes()
+	damaged := append([]byte(nil), backup...)
+	for i := len(damaged) * 4 / 10; i < len(damaged)*6/10; i++ {
+		damaged[i] = 0
+	}
+	cases := map[string][]byte{
+		"truncated 90%": backup[:len(backup)*9/10],
+		"truncated 20%": backup[:len(backup)*2/10],
+		"zeroed pages":  damaged,
+	}
+	for cname, data := range cases {
+		name := filepath.Join(dir, strings.ReplaceAll(cname, " ", "-"))
+		if e := os.WriteFile(name, data, 0600); e != nil {
+			t.Fatal(e)
+		}
+		if e := Verify(name); !errors.Is(e, DataCorruptedErr) {
+			t.Errorf("%s: Verify error = %v - expect DataCorruptedErr", cname, e)
+		}
+	}
+}
+
+// a failed open releases the db file.
+func TestOpenDbFailed(t *testing.T) {
+	name := filepath.Join(t.TempDir(), DefaultDb)
+	bdb, e := bolt.Open(name, 0600, nil)
+	if e != nil {
+		t.Fatal(e)
+	}
+	bdb.Close()
+
+	db, e := OpenDb(name, &Options{ReadOnly: true})
+	if !errors.Is(e, DataCorruptedErr) || db != nil {
+		t.Fatalf("OpenDb read-only = %v, %v - expect nil, DataCorruptedErr", db, e)
+	}
+	// the exclusive lock blocks if the shared lock is held
+	done := make(chan error, 1)
+	go func() {
+		db, e := OpenDb(name, nil)
+		if e == nil {
+			e = db.Close()
+		}
+		done <- e
+	}()
+	select {
+	case e := <-done:
+		if e != nil {
+			t.Fatalf("OpenDb: %v", e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("OpenDb blocked - db file not released")
+	}
+}
+
+func TestCompactOpenFailed(t *testing.T) {
+	db := openTestDb(t)
+	key, e := db.Put([]byte("compacted"))
+	if e != nil {
+		t.Fatal(e)
+	}
+	name := db.(*boltdb).name
+	openErr := errors.New("open failed")
+	failOpen := func(fail string) {
+		boltOpen = func(path string, mode os.FileMode, opts *bolt.Options) (*bolt.DB, error) {
+			if path == fail {
+				return nil, openErr
+			}
+			return bolt.Open(path, mode, opts)
+		}
+	}
+	t.Cleanup(func() { boltOpen = bolt.Open })
+
+	// the store is unchanged if the compacted file fails to open
+	failOpen(name + ".compact")
+	if _, _, e := db.Compact(); !errors.Is(e, InternalErr) {
+		t.Fatalf("Compact error = %v - expect InternalErr", e)
+	}
+	if v, e := db.Get(key); e != nil || string(v) != "compacted" {
+		t.Fatalf("Get = %q, %v", v, e)
+	}
+	if e := db.Check(); e != nil {
+		t.Fatalf("Check error = %v", e)
+	}
+
+	// the store is unavailable if the db fails to reopen
+	failOpen(name)
+	if _, _, e := db.Compact(); !errors.Is(e, UnavailableErr) {
+		t.Fatalf("Compact error = %v - expect UnavailableErr", e)
+	}
+	if e := db.Check(); !errors.Is(e, UnavailableErr) {
+		t.Errorf("Check error = %v - expect UnavailableErr", e)
+	}
+	if _, e := db.Get(key); !errors.Is(e, ClosedErr) {
+		t.Errorf("Get error = %v - expect ClosedErr", e)
+	}
+}
+
+// callers of a coalesced get stop waiting once their ctx is done. The
+// shared call completes for the remaining callers.
+func TestCoalescedGetCanceled(t *testing.T) {
+	db := openTestDb(t)
+	val := []byte("coalesced")
+	key, e := db.Put(val)
+	if e != nil {
+		t.Fatal(e)
+	}
+	p := db.(*boltdb)
+	shared := coalesced.With(p.segments[segmentFor(key)].id, "get")
+	before := shared.Value()
+
+	// reads block until the db handle is released
+	p.mu.Lock()
+	ctx, cancel := context.WithCancel(context.Background())
+	canceled := make(chan error, 1)
+	go func() {
+		_, e := db.GetContext(ctx, key)
+		canceled <- e
+	}()
+	const callers = 4
+	results := make(chan error, callers)
+	for i := 0; i < callers; i++ {
+		go func() {
+			v, e := db.GetContext(context.Background(), key)
+			if e == nil && !bytes.Equal(v, val) {
+				e = fmt.Errorf("value %q", v)
+			}
+			results <- e
+		}()
+	}
+	time.Sleep(50 * time.Millisecond) // let callers join the call
+
+	cancel()
+	select {
+	case e := <-canceled:
+		if !errors.Is(e, context.Canceled) {
+			t.Errorf("canceled GetContext error = %v", e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("canceled GetContext still waiting")
+	}
+	p.mu.Unlock()
+	for i := 0; i < callers; i++ {
+		if e := <-results; e != nil {
+			t.Errorf("GetContext error = %v", e)
+		}
+	}
+	if n := shared.Value() - before; n < callers {
+		t.Errorf("coalesced gets = %v - expect %d", n, callers)
+	}
+}
+
+// checks are bounded by ctx while the db is swapped.
+func TestCheckCanceled(t *testing.T) {
+	db := openTestDb(t)
+	p := db.(*boltdb)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if e := db.CheckContext(ctx); !errors.Is(e, UnavailableErr) || !errors.Is(e, context.DeadlineExceeded) {
+		t.Errorf("CheckContext error = %v - expect UnavailableErr", e)
+	}
+}
+
+// mutations committed while the db is copied are applied to the copy.
+func TestCompactReplay(t *testing.T) {
+	db := openTestDb(t)
+	p := db.(*boltdb)
+	deleted, _ := db.Put([]byte("deleted"))
+	kept, _ := db.Put([]byte("kept"))
+	e := p.PutCredential("token", []byte("credential"))
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	j := &journal{keys: make(map[journalKey]struct{})}
+	p.journal.Store(j)
+	tmpname := p.name + ".compact"
+	if e := compactTo(context.Background(), p.db, tmpname); e != nil {
+		t.Fatal(e)
+	}
+	added, _ := db.Put([]byte("added"))
+	db.Del(deleted)
+	p.DelCredential("token")
+	p.journal.Store(nil)
+	if e := p.replay(tmpname, j); e != nil {
+		t.Fatalf("replay error = %v", e)
+	}
+
+	cdb, e := OpenDb(tmpname, &Options{ReadOnly: true})
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer cdb.Close()
+	for key, want := range map[Key]string{kept: "kept", added: "added", deleted: ""} {
+		if v, _ := cdb.Get(key); string(v) != want {
+			t.Errorf("Get %s = %q - expect %q", key, v, want)
+		}
+	}
+	if _, e := cdb.(*boltdb).GetCredential("token"); !errors.Is(e, NotFoundErr) {
+		t.Errorf("GetCredential error = %v - expect NotFoundErr", e)
+	}
+	want, _ := db.Info()
+	if info, _ := cdb.Info(); !bytes.Equal(info, want) {
+		t.Errorf("Info = %q - expect %q", info, want)
+	}
+}
+
+// compactions fail fast while a backup holds the db, so that readers
+// are not blocked behind the swap.
+func TestCompactBehindBackup(t *testing.T) {
+	db := openTestDb(t)
+	key, _ := db.Put([]byte("blob"))
+
+	// the backup stalls on its first write
+	r, w := io.Pipe()
+	backup := make(chan error, 1)
+	go func() {
+		_, e := db.Backup(w)
+		backup <- e
+	}()
+	for db.(*boltdb).streams.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	compacted := make(chan error, 1)
+	go func() {
+		_, _, e := db.Compact()
+		compacted <- e
+	}()
+	viewed := make(chan error, 1)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		viewed <- db.View(key, func([]byte) error { return nil })
+	}()
+	for _, c := range []struct {
+		op     string
+		result chan error
+		want   error
+	}{{"Compact", compacted, BusyErr}, {"View", viewed, nil}} {
+		select {
+		case e := <-c.result:
+			if (c.want == nil && e != nil) || !errors.Is(e, c.want) {
+				t.Errorf("%s error = %v - expect %v", c.op, e, c.want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%s blocked behind backup", c.op)
+		}
+	}
+
+	r.CloseWithError(io.ErrClosedPipe)
+	if e := <-backup; e == nil {
+		t.Error("backup to closed pipe succeeded")
+	}
+	if _, _, e := db.Compact(); e != nil {
+		t.Errorf("Compact error = %v", e)
+	}
+}
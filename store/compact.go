@@ -0,0 +1,239 @@
+//    Copyright © 2016 Joubin Houshyar. All rights reserved.
+//
+//    This file is part of Frankinstore.
+//
+//    Frankinstore is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU Affero General Public License as
+//    published by the Free Software Foundation, either version 3 of
+//    the License, or (at your option) any later version.
+//
+//    Frankinstore is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU Affero General Public License for more details.
+//
+//    You should have received a copy of the GNU Affero General Public
+//    License along with Frankinstore.  If not, see <http://www.gnu.org/licenses/>.
+
+package store
+
+import (
+	"context"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"os"
+	"sync"
+	"time"
+)
+
+// compacted pages are filled to capacity as blobs are never updated in place.
+const compactFillPercent = 1.0
+
+// max size of a single transaction when copying buckets.
+const compactTxSize = 64 << 20
+
+// Compacts the (offline) database file 'name' in place. The live buckets are
+// copied to a fresh file which is then renamed to 'name'.
+// Returns the file size before and after compaction.
+func CompactFile(name string) (before, after int64, err error) {
+	before, err = fileSize(name)
+	if err != nil {
+		return 0, 0, fmt.Errorf("err - CompactFile - %w", err)
+	}
+
+	// fail fast if the file is in use by a server
+	bdb, e := bolt.Open(name, 0600, &bolt.Options{Timeout: time.Second})
+	if e != nil {
+		return before, 0, fmt.Errorf("err - CompactFile - %w", boltErr(e))
+	}
+	tmpname := name + ".compact"
+	e = compactTo(context.Background(), bdb, tmpname)
+	if e0 := bdb.Close(); e == nil {
+		e = e0
+	}
+	if e == nil {
+		e = os.Rename(tmpname, name)
+	}
+	if e != nil {
+		os.Remove(tmpname)
+		return before, 0, fmt.Errorf("err - CompactFile - %w", boltErr(e))
+	}
+
+	after, err = fileSize(name)
+	return
+}
+
+// copies all buckets of 'src' to a new database file 'dst'.
+// copying stops once ctx is done.
+func compactTo(ctx context.Context, src *bolt.DB, dst string) error {
+	os.Remove(dst)
+	bdb, e := bolt.Open(dst, 0600, nil)
+	if e != nil {
+		return e
+	}
+	defer bdb.Close()
+
+	tx, e := bdb.Begin(true)
+	if e != nil {
+		return e
+	}
+	var txsize int
+	e = src.View(func(stx *bolt.Tx) error {
+		return walkBuckets(stx, func(path [][]byte, k, v []byte) error {
+			if e := ctx.Err(); e != nil {
+				return e
+			}
+			// commit periodically to bound memory use
+			if txsize+len(k)+len(v) > compactTxSize {
+				if e := tx.Commit(); e != nil {
+					return e
+				}
+				var e error
+				if tx, e = bdb.Begin(true); e != nil {
+					return e
+				}
+				txsize = 0
+			}
+			txsize += len(k) + len(v)
+
+			b, e := tx.CreateBucketIfNotExists(path[0])
+			if e != nil {
+				return e
+			}
+			b.FillPercent = compactFillPercent
+			for _, bid := range path[1:] {
+				if b, e = b.CreateBucketIfNotExists(bid); e != nil {
+					return e
+				}
+				b.FillPercent = compactFillPercent
+			}
+			if k == nil {
+				return nil // empty bucket
+			}
+			if v == nil {
+				_, e = b.CreateBucketIfNotExists(k)
+				return e
+			}
+			return b.Put(k, v)
+		})
+	})
+	if e != nil {
+		tx.Rollback()
+		return e
+	}
+	if e := tx.Commit(); e != nil {
+		return e
+	}
+
+	return closeTrimmed(bdb, dst)
+}
+
+// closes db file 'name'. bolt preallocates the file to its mmap size,
+// so the file is trimmed to the high-water mark of its pages.
+func closeTrimmed(bdb *bolt.DB, name string) error {
+	var size int64
+	if e := bdb.View(func(tx *bolt.Tx) error {
+		size = tx.Size()
+		return nil
+	}); e != nil {
+		return e
+	}
+	if e := bdb.Close(); e != nil {
+		return e
+	}
+	return os.Truncate(name, size)
+}
+
+/// online compaction /////////////////////////////////////////////////////////
+
+// type records the keys mutated while a compaction copies the db.
+type journal struct {
+	mu   sync.Mutex
+	keys map[journalKey]struct{}
+}
+
+type journalKey struct {
+	bucket string
+	key    string
+}
+
+func (j *journal) add(bucket []byte, keys [][]byte) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for _, k := range keys {
+		j.keys[journalKey{string(bucket), string(k)}] = struct{}{}
+	}
+}
+
+// applies the journaled mutations of the db to its compacted copy
+// 'name', and copies dbinfo. Called with writers blocked.
+func (p *boltdb) replay(name string, j *journal) error {
+	cdb, e := boltOpen(name, 0600, &bolt.Options{Timeout: time.Second})
+	if e != nil {
+		return e
+	}
+	defer cdb.Close()
+	e = cdb.Update(func(dtx *bolt.Tx) error {
+		return p.view(func(stx *bolt.Tx) error {
+			for jk := range j.keys {
+				b, e := dtx.CreateBucketIfNotExists([]byte(jk.bucket))
+				if e != nil {
+					return e
+				}
+				b.FillPercent = compactFillPercent
+				var v []byte
+				if sb := stx.Bucket([]byte(jk.bucket)); sb != nil {
+					v = sb.Get([]byte(jk.key))
+				}
+				if v == nil {
+					e = b.Delete([]byte(jk.key))
+				} else {
+					e = b.Put([]byte(jk.key), copyOf(v))
+				}
+				if e != nil {
+					return e
+				}
+			}
+			b := dtx.Bucket(dbinfo)
+			return stx.Bucket(dbinfo).ForEach(func(k, v []byte) error {
+				return b.Put(copyOf(k), copyOf(v))
+			})
+		})
+	})
+	if e != nil {
+		return e
+	}
+	return closeTrimmed(cdb, name)
+}
+
+// calls fn for every key of every (nested) bucket in tx. 'path' is the
+// bucket path of the key. fn is called with nil 'k' for each bucket and
+// with nil 'v' for nested bucket keys.
+func walkBuckets(tx *bolt.Tx, fn func(path [][]byte, k, v []byte) error) error {
+	var walk func(path [][]byte, b *bolt.Bucket) error
+	walk = func(path [][]byte, b *bolt.Bucket) error {
+		if e := fn(path, nil, nil); e != nil {
+			return e
+		}
+		return b.ForEach(func(k, v []byte) error {
+			if e := fn(path, k, v); e != nil {
+				return e
+			}
+			if v == nil {
+				return walk(append(path[:len(path):len(path)], k), b.Bucket(k))
+			}
+			return nil
+		})
+	}
+	return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+		return walk([][]byte{name}, b)
+	})
+}
+
+func fileSize(name string) (int64, error) {
+	finfo, e := os.Stat(name)
+	if e != nil {
+		return 0, e
+	}
+	return finfo.Size(), nil
+}
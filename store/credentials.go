@@ -0,0 +1,97 @@
+//    Copyright © 2016 Joubin Houshyar. All rights reserved.
+//
+//    This file is part of Frankinstore.
+//
+//    Frankinstore is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU Affero General Public License as
+//    published by the Free Software Foundation, either version 3 of
+//    the License, or (at your option) any later version.
+//
+//    Frankinstore is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU Affero General Public License for more details.
+//
+//    You should have received a copy of the GNU Affero General Public
+//    License along with Frankinstore.  If not, see <http://www.gnu.org/licenses/>.
+
+package store
+
+import (
+	"fmt"
+	"github.com/boltdb/bolt"
+)
+
+// credentials bucket. The bucket is optional in read-only mode, as it
+// does not exist in databases created by earlier versions.
+var credentials = []byte("credentials")
+
+/// interface: Credentials ////////////////////////////////////////////////////
+
+// support Credentials.PutCredential
+func (p *boltdb) PutCredential(id string, v []byte) error {
+	if p.opts.ReadOnly {
+		return ReadOnlyErr
+	}
+	if id == "" {
+		return fmt.Errorf("err - PutCredential - %w - blank id", InvalidKeyErr)
+	}
+	e := p.update(func(tx *bolt.Tx) error {
+		return tx.Bucket(credentials).Put([]byte(id), v)
+	}, credentials, []byte(id))
+	if e != nil {
+		return fmt.Errorf("err - PutCredential - %w", boltErr(e))
+	}
+	return nil
+}
+
+// support Credentials.GetCredential
+func (p *boltdb) GetCredential(id string) ([]byte, error) {
+	var v []byte
+	e := p.view(func(tx *bolt.Tx) error {
+		var bv []byte
+		if b := tx.Bucket(credentials); b != nil {
+			bv = b.Get([]byte(id))
+		}
+		if bv == nil {
+			return fmt.Errorf("%w - credential %q", NotFoundErr, id)
+		}
+		v = copyOf(bv)
+		return nil
+	})
+	if e != nil {
+		return nil, fmt.Errorf("err - GetCredential - %w", boltErr(e))
+	}
+	return v, nil
+}
+
+// support Credentials.DelCredential
+func (p *boltdb) DelCredential(id string) error {
+	if p.opts.ReadOnly {
+		return ReadOnlyErr
+	}
+	e := p.update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(credentials)
+		if b.Get([]byte(id)) == nil {
+			return fmt.Errorf("%w - credential %q", NotFoundErr, id)
+		}
+		return b.Delete([]byte(id))
+	}, credentials, []byte(id))
+	if e != nil {
+		return fmt.Errorf("err - DelCredential - %w", boltErr(e))
+	}
+	return nil
+}
+
+// support Credentials.ForEachCredential
+func (p *boltdb) ForEachCredential(fn func(id string, v []byte) error) error {
+	return p.view(func(tx *bolt.Tx) error {
+		b := tx.Bucket(credentials)
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			return fn(string(k), v)
+		})
+	})
+}
@@ -0,0 +1,36 @@
+//    Copyright © 2016 Joubin Houshyar. All rights reserved.
+//
+//    This file is part of Frankinstore.
+//
+//    Frankinstore is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU Affero General Public License as
+//    published by the Free Software Foundation, either version 3 of
+//    the License, or (at your option) any later version.
+//
+//    Frankinstore is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU Affero General Public License for more details.
+//
+//    You should have received a copy of the GNU Affero General Public
+//    License along with Frankinstore.  If not, see <http://www.gnu.org/licenses/>.
+
+//go:build linux || darwin
+// +build linux darwin
+
+package store
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// DiskFree returns the number of bytes available to unprivileged users on
+// the filesystem holding file (or directory) 'name'.
+func DiskFree(name string) (uint64, error) {
+	var st syscall.Statfs_t
+	if e := syscall.Statfs(name, &st); e != nil {
+		return 0, fmt.Errorf("err - DiskFree - %w", e)
+	}
+	return uint64(st.Bavail) * uint64(st.Bsize), nil
+}
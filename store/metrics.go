@@ -0,0 +1,174 @@
+//    Copyright © 2016 Joubin Houshyar. All rights reserved.
+//
+//    This file is part of Frankinstore.
+//
+//    Frankinstore is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU Affero General Public License as
+//    published by the Free Software Foundation, either version 3 of
+//    the License, or (at your option) any later version.
+//
+//    Frankinstore is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU Affero General Public License for more details.
+//
+//    You should have received a copy of the GNU Affero General Public
+//    License along with Frankinstore.  If not, see <http://www.gnu.org/licenses/>.
+
+package store
+
+import (
+	"context"
+	"errors"
+	"github.com/alphazero/borisdb/logging"
+	"github.com/alphazero/borisdb/metrics"
+	"github.com/boltdb/bolt"
+	"log/slog"
+	"time"
+)
+
+// store metrics are registered with metrics.Default.
+var (
+	opsTotal = metrics.Default.Counter("borisdb_store_ops_total",
+		"Count of store operations.", "op")
+	opErrors = metrics.Default.Counter("borisdb_store_errors_total",
+		"Count of failed store operations by error type.", "op", "error")
+	opDuration = metrics.Default.Histogram("borisdb_store_op_duration_seconds",
+		"Latency of store operations.", metrics.DefaultBuckets, "op")
+	coalesced = metrics.Default.Counter("borisdb_store_coalesced_total",
+		"Count of store operations that shared the result of a concurrent call.", "segment", "op")
+	bytesIn = metrics.Default.Counter("borisdb_store_bytes_in_total",
+		"Count of value bytes added to the store.").With()
+	bytesOut = metrics.Default.Counter("borisdb_store_bytes_out_total",
+		"Count of value bytes read from the store.").With()
+)
+
+// records the outcome of store op 'op' started at 'start'. Failed and
+// slow ops are logged with 'attrs' and the request id of ctx. Use as
+//
+//	defer p.observe(ctx, "get", time.Now(), &err, "key", key)
+func (p *boltdb) observe(ctx context.Context, op string, start time.Time, err *error, attrs ...any) {
+	elapsed := time.Since(start)
+	opsTotal.With(op).Inc()
+	opDuration.With(op).Observe(elapsed.Seconds())
+
+	attrs = append(attrs, "op", op, "duration", elapsed)
+	switch e := *err; {
+	case e != nil:
+		etype := errorType(e)
+		opErrors.With(op, etype).Inc()
+		level := slog.LevelError
+		if expectedErrors[etype] {
+			level = slog.LevelDebug
+		}
+		logging.FromContext(ctx).Log(ctx, level, "store op failed", append(attrs, "error", e)...)
+	case p.opts.SlowOpThreshold > 0 && elapsed > p.opts.SlowOpThreshold:
+		logging.FromContext(ctx).Warn("slow store op", attrs...)
+	}
+}
+
+// error types that are part of the normal course of operation, e.g.
+// bad client input. These are logged at debug level.
+var expectedErrors = map[string]bool{
+	"not_found":     true,
+	"existing":      true,
+	"invalid_value": true,
+	"invalid_key":   true,
+	"read_only":     true,
+	"too_large":     true,
+	"canceled":      true,
+	"busy":          true,
+}
+
+// returns the metrics label for the (store) error 'e'.
+func errorType(e error) string {
+	switch {
+	case errors.Is(e, NotFoundErr):
+		return "not_found"
+	case errors.Is(e, ExistingErr):
+		return "existing"
+	case errors.Is(e, DataCorruptedErr):
+		return "data_corrupted"
+	case errors.Is(e, DiskFullErr):
+		return "disk_full"
+	case errors.Is(e, TooLargeErr):
+		return "too_large"
+	case errors.Is(e, NilValueErr), errors.Is(e, ZeroValueErr):
+		return "invalid_value"
+	case errors.Is(e, InvalidKeyErr):
+		return "invalid_key"
+	case errors.Is(e, ReadOnlyErr):
+		return "read_only"
+	case errors.Is(e, ClosedErr):
+		return "closed"
+	case errors.Is(e, InvalidArchiveErr):
+		return "invalid_archive"
+	case errors.Is(e, UnavailableErr):
+		return "unavailable"
+	case errors.Is(e, BusyErr):
+		return "busy"
+	case errors.Is(e, context.Canceled):
+		return "canceled"
+	case errors.Is(e, context.DeadlineExceeded):
+		return "deadline_exceeded"
+	}
+	return "internal"
+}
+
+// registers the dbinfo and bolt gauges of the store. These replace the
+// gauges of any previously opened store.
+func (p *boltdb) registerMetrics() {
+	var info = func(key []byte, size int) func() float64 {
+		return func() float64 {
+			var v float64
+			p.view(func(tx *bolt.Tx) error {
+				b := tx.Bucket(dbinfo).Get(key)
+				if size == 8 {
+					v = float64(toInt64(b))
+				} else {
+					v = float64(toInt32(b))
+				}
+				return nil
+			})
+			return v
+		}
+	}
+	metrics.Default.GaugeFunc("borisdb_store_objects",
+		"Count of value blobs in the store.", info(objcntKey, 4))
+	metrics.Default.GaugeFunc("borisdb_store_size_bytes",
+		"Total size of value blobs in the store.", info(sizeKey, 8))
+	metrics.Default.GaugeFunc("borisdb_store_pending_writes",
+		"Count of admitted mutations, over all segments.", func() float64 {
+			var n int32
+			for _, seg := range p.segments {
+				n += seg.pending.Load()
+			}
+			return float64(n)
+		})
+	metrics.Default.GaugeFunc("borisdb_store_max_segment_writes",
+		"Configured max pending mutations per segment (0 if unlimited).", func() float64 {
+			return float64(p.opts.MaxSegmentWrites)
+		})
+
+	var stats = func(fn func(s bolt.Stats) int) func() float64 {
+		return func() float64 {
+			p.mu.RLock()
+			defer p.mu.RUnlock()
+			return float64(fn(p.db.Stats()))
+		}
+	}
+	metrics.Default.CounterFunc("borisdb_bolt_tx_total",
+		"Count of started bolt read transactions.", stats(func(s bolt.Stats) int { return s.TxN }))
+	metrics.Default.GaugeFunc("borisdb_bolt_open_tx",
+		"Count of open bolt read transactions.", stats(func(s bolt.Stats) int { return s.OpenTxN }))
+	metrics.Default.GaugeFunc("borisdb_bolt_freelist_free_pages",
+		"Count of free pages on the bolt freelist.", stats(func(s bolt.Stats) int { return s.FreePageN }))
+	metrics.Default.GaugeFunc("borisdb_bolt_freelist_pending_pages",
+		"Count of pending pages on the bolt freelist.", stats(func(s bolt.Stats) int { return s.PendingPageN }))
+	metrics.Default.GaugeFunc("borisdb_bolt_freelist_bytes",
+		"Size of the bolt freelist in bytes.", stats(func(s bolt.Stats) int { return s.FreelistInuse }))
+	metrics.Default.CounterFunc("borisdb_bolt_write_tx_pages_total",
+		"Count of pages allocated by bolt write transactions.", stats(func(s bolt.Stats) int { return s.TxStats.PageCount }))
+	metrics.Default.CounterFunc("borisdb_bolt_write_tx_writes_total",
+		"Count of page writes by bolt write transactions.", stats(func(s bolt.Stats) int { return s.TxStats.Write }))
+}
@@ -0,0 +1,251 @@
+//    Copyright © 2016 Joubin Houshyar. All rights reserved.
+//
+//    This file is part of Frankinstore.
+//
+//    Frankinstore is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU Affero General Public License as
+//    published by the Free Software Foundation, either version 3 of
+//    the License, or (at your option) any later version.
+//
+//    Frankinstore is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU Affero General Public License for more details.
+//
+//    You should have received a copy of the GNU Affero General Public
+//    License along with Frankinstore.  If not, see <http://www.gnu.org/licenses/>.
+
+// package storetest provides a conformance test suite of the store.Store
+// semantics, run against every backend, e.g. the local bolt store and the
+// remote store of package web.
+package storetest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/alphazero/borisdb/store"
+	"testing"
+)
+
+// OpenFn returns a new, empty and writable store. The store is closed
+// by the suite, and otherwise by t.Cleanup of the open function.
+type OpenFn func(t *testing.T) store.Store
+
+// Run runs the conformance suite, as subtests of 't', against stores
+// returned by 'open'.
+func Run(t *testing.T, open OpenFn) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, s store.Store)
+	}{
+		{"PutGet", testPutGet},
+		{"InvalidValues", testInvalidValues},
+		{"NotFound", testNotFound},
+		{"Del", testDel},
+		{"View", testView},
+		{"ForEach", testForEach},
+		{"Maintenance", testMaintenance},
+		{"Canceled", testCanceled},
+		{"Closed", testClosed},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.fn(t, open(t))
+		})
+	}
+}
+
+/// tests /////////////////////////////////////////////////////////////////////
+
+func testPutGet(t *testing.T, s store.Store) {
+	blob := []byte("the quick brown fox")
+	key, e := s.Put(blob)
+	if e != nil {
+		t.Fatalf("Put error = %v", e)
+	}
+	if key != store.KeyOf(blob) {
+		t.Errorf("Put key = %s - expect %s", key, store.KeyOf(blob))
+	}
+
+	// puts are idempotent, and report existing blobs
+	key2, e := s.Put(blob)
+	if !errors.Is(e, store.ExistingErr) {
+		t.Errorf("Put existing error = %v - expect ExistingErr", e)
+	}
+	if key2 != key {
+		t.Errorf("Put existing key = %s - expect %s", key2, key)
+	}
+
+	v, e := s.Get(key)
+	if e != nil || !bytes.Equal(v, blob) {
+		t.Errorf("Get = %q, %v - expect %q", v, e, blob)
+	}
+	if info, e := s.Info(); e != nil || len(info) == 0 {
+		t.Errorf("Info = %q, %v", info, e)
+	}
+}
+
+func testInvalidValues(t *testing.T, s store.Store) {
+	if _, e := s.Put(nil); !errors.Is(e, store.NilValueErr) {
+		t.Errorf("Put(nil) error = %v - expect NilValueErr", e)
+	}
+	if _, e := s.Put([]byte{}); !errors.Is(e, store.ZeroValueErr) {
+		t.Errorf("Put(empty) error = %v - expect ZeroValueErr", e)
+	}
+}
+
+func testNotFound(t *testing.T, s store.Store) {
+	key := store.KeyOf([]byte("not stored"))
+	if _, e := s.Get(key); !errors.Is(e, store.NotFoundErr) {
+		t.Errorf("Get error = %v - expect NotFoundErr", e)
+	}
+	if _, e := s.Del(key); !errors.Is(e, store.NotFoundErr) {
+		t.Errorf("Del error = %v - expect NotFoundErr", e)
+	}
+	called := false
+	e := s.View(key, func([]byte) error { called = true; return nil })
+	if !errors.Is(e, store.NotFoundErr) || called {
+		t.Errorf("View error = %v, called %t - expect NotFoundErr, not called", e, called)
+	}
+}
+
+func testDel(t *testing.T, s store.Store) {
+	blob := []byte("to be deleted")
+	key, _ := s.Put(blob)
+	v, e := s.Del(key)
+	if e != nil || !bytes.Equal(v, blob) {
+		t.Errorf("Del = %q, %v - expect %q", v, e, blob)
+	}
+	if _, e := s.Get(key); !errors.Is(e, store.NotFoundErr) {
+		t.Errorf("Get after Del error = %v - expect NotFoundErr", e)
+	}
+	// deleted blobs can be stored again
+	if _, e := s.Put(blob); e != nil {
+		t.Errorf("Put after Del error = %v", e)
+	}
+}
+
+func testView(t *testing.T, s store.Store) {
+	blob := []byte("viewed")
+	key, _ := s.Put(blob)
+	e := s.View(key, func(v []byte) error {
+		if !bytes.Equal(v, blob) {
+			t.Errorf("View value = %q - expect %q", v, blob)
+		}
+		return nil
+	})
+	if e != nil {
+		t.Errorf("View error = %v", e)
+	}
+
+	// errors of fn are returned as is
+	fnErr := errors.New("fn error")
+	if e := s.View(key, func([]byte) error { return fnErr }); e != fnErr {
+		t.Errorf("View error = %v - expect fn error", e)
+	}
+}
+
+func testForEach(t *testing.T, s store.Store) {
+	blobs := make(map[store.Key][]byte)
+	for i := 0; i < 50; i++ {
+		blob := []byte(fmt.Sprintf("blob %d", i))
+		key, e := s.Put(blob)
+		if e != nil {
+			t.Fatal(e)
+		}
+		blobs[key] = blob
+	}
+
+	seen := make(map[store.Key]bool)
+	e := s.ForEach(func(key store.Key, v []byte) error {
+		if !bytes.Equal(v, blobs[key]) {
+			t.Errorf("ForEach %s value = %q - expect %q", key, v, blobs[key])
+		}
+		seen[key] = true
+		return nil
+	})
+	if e != nil || len(seen) != len(blobs) {
+		t.Errorf("ForEach visited %d blobs, %v - expect %d", len(seen), e, len(blobs))
+	}
+
+	// iteration stops at the first error of fn, which is returned as is
+	fnErr := errors.New("fn error")
+	n := 0
+	e = s.ForEach(func(store.Key, []byte) error {
+		n++
+		if n == 10 {
+			return fnErr
+		}
+		return nil
+	})
+	if e != fnErr || n != 10 {
+		t.Errorf("ForEach = %d calls, %v - expect 10 calls, fn error", n, e)
+	}
+}
+
+func testMaintenance(t *testing.T, s store.Store) {
+	for i := 0; i < 20; i++ {
+		s.Put([]byte(fmt.Sprintf("blob %d", i)))
+	}
+	if e := s.Check(); e != nil {
+		t.Errorf("Check error = %v", e)
+	}
+	var buf bytes.Buffer
+	if n, e := s.Backup(&buf); e != nil || n == 0 || int64(buf.Len()) != n {
+		t.Errorf("Backup = %d (wrote %d), %v", n, buf.Len(), e)
+	}
+	before, after, e := s.Compact()
+	if e != nil || before <= 0 || after <= 0 {
+		t.Errorf("Compact = %d, %d, %v", before, after, e)
+	}
+	// the store is usable after compaction
+	if _, e := s.Get(store.KeyOf([]byte("blob 0"))); e != nil {
+		t.Errorf("Get after Compact error = %v", e)
+	}
+}
+
+func testCanceled(t *testing.T, s store.Store) {
+	key, _ := s.Put([]byte("canceled"))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	checks := map[string]error{}
+	_, checks["PutContext"] = s.PutContext(ctx, []byte("new blob"))
+	_, checks["GetContext"] = s.GetContext(ctx, key)
+	_, checks["DelContext"] = s.DelContext(ctx, key)
+	checks["ViewContext"] = s.ViewContext(ctx, key, func([]byte) error { return nil })
+	checks["ForEachContext"] = s.ForEachContext(ctx, func(store.Key, []byte) error { return nil })
+	checks["CheckContext"] = s.CheckContext(ctx)
+	_, checks["BackupContext"] = s.BackupContext(ctx, &bytes.Buffer{})
+	for op, e := range checks {
+		if !errors.Is(e, context.Canceled) {
+			t.Errorf("%s error = %v - expect context.Canceled", op, e)
+		}
+	}
+	// the canceled del did not delete
+	if _, e := s.Get(key); e != nil {
+		t.Errorf("Get error = %v", e)
+	}
+}
+
+func testClosed(t *testing.T, s store.Store) {
+	key, _ := s.Put([]byte("closed"))
+	if e := s.Close(); e != nil {
+		t.Fatalf("Close error = %v", e)
+	}
+
+	checks := map[string]error{}
+	_, checks["Put"] = s.Put([]byte("new blob"))
+	_, checks["Get"] = s.Get(key)
+	_, checks["Del"] = s.Del(key)
+	checks["View"] = s.View(key, func([]byte) error { return nil })
+	checks["ForEach"] = s.ForEach(func(store.Key, []byte) error { return nil })
+	checks["Check"] = s.Check()
+	for op, e := range checks {
+		if !errors.Is(e, store.ClosedErr) {
+			t.Errorf("%s error = %v - expect ClosedErr", op, e)
+		}
+	}
+}
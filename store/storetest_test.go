@@ -0,0 +1,36 @@
+//    Copyright © 2016 Joubin Houshyar. All rights reserved.
+//
+//    This file is part of Frankinstore.
+//
+//    Frankinstore is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU Affero General Public License as
+//    published by the Free Software Foundation, either version 3 of
+//    the License, or (at your option) any later version.
+//
+//    Frankinstore is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU Affero General Public License for more details.
+//
+//    You should have received a copy of the GNU Affero General Public
+//    License along with Frankinstore.  If not, see <http://www.gnu.org/licenses/>.
+
+package store_test
+
+import (
+	"github.com/alphazero/borisdb/store"
+	"github.com/alphazero/borisdb/store/storetest"
+	"path/filepath"
+	"testing"
+)
+
+func TestConformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) store.Store {
+		db, e := store.OpenDb(filepath.Join(t.TempDir(), "test.db"), nil)
+		if e != nil {
+			t.Fatal(e)
+		}
+		t.Cleanup(func() { db.Close() })
+		return db
+	})
+}
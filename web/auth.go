@@ -0,0 +1,285 @@
+//    Copyright © 2016 Joubin Houshyar. All rights reserved.
+//
+//    This file is part of Frankinstore.
+//
+//    Frankinstore is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU Affero General Public License as
+//    published by the Free Software Foundation, either version 3 of
+//    the License, or (at your option) any later version.
+//
+//    Frankinstore is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU Affero General Public License for more details.
+//
+//    You should have received a copy of the GNU Affero General Public
+//    License along with Frankinstore.  If not, see <http://www.gnu.org/licenses/>.
+
+package web
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/alphazero/borisdb/store"
+	"net/http"
+	"strings"
+	"time"
+)
+
+/// roles /////////////////////////////////////////////////////////////////////
+
+// access roles. Each role includes the permissions of the lesser roles.
+type Role int
+
+const (
+	RoleNone  Role = iota
+	RoleRead       // get, info, metrics
+	RoleWrite      // set, del
+	RoleAdmin      // shutdown, backup, export, import, compact, tokens
+)
+
+var roleNames = []string{"none", "read", "write", "admin"}
+
+func (r Role) String() string {
+	if r < RoleNone || r > RoleAdmin {
+		return fmt.Sprintf("role(%d)", int(r))
+	}
+	return roleNames[r]
+}
+
+// ParseRole returns the role named 'name'.
+func ParseRole(name string) (Role, error) {
+	for i, n := range roleNames {
+		if n == name && Role(i) != RoleNone {
+			return Role(i), nil
+		}
+	}
+	return RoleNone, fmt.Errorf("invalid role %q - expect read, write or admin", name)
+}
+
+/// tokens ////////////////////////////////////////////////////////////////////
+
+// Tokens have the form '<id>.<secret>'. Only the SHA-256 digest of the
+// secret is stored, as a store credential keyed by id.
+
+// TokenInfo describes an issued token. The secret is only returned
+// when the token is created.
+type TokenInfo struct {
+	ID      string    `json:"id"`
+	Name    string    `json:"name,omitempty"`
+	Role    string    `json:"role"`
+	Created time.Time `json:"created"`
+	Token   string    `json:"token,omitempty"`
+}
+
+// stored token credential
+type tokenRecord struct {
+	Name    string    `json:"name,omitempty"`
+	Role    string    `json:"role"`
+	Hash    string    `json:"hash"` // hex sha256 of secret
+	Created time.Time `json:"created"`
+}
+
+// returns a new random token and its stored record.
+func newToken(role Role, name string) (TokenInfo, tokenRecord, error) {
+	var id [8]byte
+	var secret [32]byte
+	if _, e := rand.Read(id[:]); e != nil {
+		return TokenInfo{}, tokenRecord{}, e
+	}
+	if _, e := rand.Read(secret[:]); e != nil {
+		return TokenInfo{}, tokenRecord{}, e
+	}
+	info := TokenInfo{
+		ID:      hex.EncodeToString(id[:]),
+		Name:    name,
+		Role:    role.String(),
+		Created: time.Now().UTC(),
+	}
+	info.Token = info.ID + "." + hex.EncodeToString(secret[:])
+	rec := tokenRecord{
+		Name:    name,
+		Role:    info.Role,
+		Hash:    hashSecret(hex.EncodeToString(secret[:])),
+		Created: info.Created,
+	}
+	return info, rec, nil
+}
+
+func hashSecret(secret string) string {
+	digest := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(digest[:])
+}
+
+/// authentication ////////////////////////////////////////////////////////////
+
+var errInvalidCredentials = errors.New("invalid credentials")
+
+// type authenticates requests by bearer token.
+type authenticator struct {
+	creds      store.Credentials // nil if tokens are not supported
+	adminToken string            // static admin token - see Options
+	required   bool              // read and write require a token
+}
+
+func newAuthenticator(db store.Store, opts Options) *authenticator {
+	creds, _ := db.(store.Credentials)
+	return &authenticator{
+		creds:      creds,
+		adminToken: opts.AdminToken,
+		required:   opts.AuthRequired,
+	}
+}
+
+// returns the id and role of the bearer token of 'req'. Requests
+// without an Authorization header are anonymous (RoleNone).
+func (a *authenticator) authenticate(req *http.Request) (string, Role, error) {
+	auth := req.Header.Get("Authorization")
+	if auth == "" {
+		return "", RoleNone, nil
+	}
+	token, ok := strings.CutPrefix(auth, "Bearer ")
+	if !ok || token == "" {
+		return "", RoleNone, errInvalidCredentials
+	}
+	return a.authenticateToken(token)
+}
+
+// returns the id and role of 'token'.
+func (a *authenticator) authenticateToken(token string) (string, Role, error) {
+	if a.adminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(a.adminToken)) == 1 {
+		return "admin", RoleAdmin, nil
+	}
+
+	id, secret, ok := strings.Cut(token, ".")
+	if !ok || a.creds == nil {
+		return "", RoleNone, errInvalidCredentials
+	}
+	v, e := a.creds.GetCredential(id)
+	if errors.Is(e, store.NotFoundErr) {
+		return "", RoleNone, errInvalidCredentials
+	} else if e != nil {
+		return "", RoleNone, e
+	}
+	var rec tokenRecord
+	if e := json.Unmarshal(v, &rec); e != nil {
+		return "", RoleNone, fmt.Errorf("%w - token %s - %s", store.DataCorruptedErr, id, e)
+	}
+	if subtle.ConstantTimeCompare([]byte(hashSecret(secret)), []byte(rec.Hash)) != 1 {
+		return "", RoleNone, errInvalidCredentials
+	}
+	role, e := ParseRole(rec.Role)
+	if e != nil {
+		return "", RoleNone, fmt.Errorf("%w - token %s - %s", store.DataCorruptedErr, id, e)
+	}
+	return id, role, nil
+}
+
+// convenience wrapper for handlers requiring 'role'. Read and write
+// handlers are open to anonymous requests unless auth is required.
+func (a *authenticator) require(role Role, fn http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		id, have, e := a.authenticate(req)
+		switch {
+		case errors.Is(e, errInvalidCredentials):
+			w.Header().Set("WWW-Authenticate", `Bearer realm="borisdb", error="invalid_token"`)
+			onError(w, http.StatusUnauthorized, "%s", e)
+			return
+		case e != nil:
+			onStoreError(w, e)
+			return
+		}
+		if id != "" {
+			logClient(w, id)
+			req = req.WithContext(withClient(req.Context(), id))
+		}
+
+		if have >= role || (role < RoleAdmin && !a.required) {
+			fn(w, req)
+			return
+		}
+		if id == "" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="borisdb"`)
+			onError(w, http.StatusUnauthorized, "%s role token required", role)
+			return
+		}
+		onError(w, http.StatusForbidden, "%s role token required - have %s", role, have)
+	}
+}
+
+/// handlers //////////////////////////////////////////////////////////////////
+
+// returns a new http request handler function for token management.
+//
+// The returned handler creates tokens on POST /admin/tokens, with form
+// values 'role' and (optional) 'name', and answers with the TokenInfo
+// including the secret token. Tokens are listed on GET /admin/tokens
+// and revoked on DELETE /admin/tokens/<id>.
+func getTokensHandler(a *authenticator) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, req *http.Request) {
+		/* assert constraints */
+		if a.creds == nil {
+			onError(w, http.StatusNotImplemented, "tokens are not supported by the store")
+			return
+		}
+		id := strings.TrimPrefix(strings.TrimPrefix(req.URL.Path, "/admin/tokens"), "/")
+
+		// process request
+		switch {
+		case req.Method == "GET" && id == "":
+			tokens := []TokenInfo{}
+			e := a.creds.ForEachCredential(func(id string, v []byte) error {
+				var rec tokenRecord
+				if e := json.Unmarshal(v, &rec); e != nil {
+					return fmt.Errorf("%w - token %s - %s", store.DataCorruptedErr, id, e)
+				}
+				tokens = append(tokens, TokenInfo{ID: id, Name: rec.Name, Role: rec.Role, Created: rec.Created})
+				return nil
+			})
+			if e != nil {
+				onStoreError(w, e)
+				return
+			}
+			writeJSON(w, http.StatusOK, tokens)
+
+		case req.Method == "POST" && id == "":
+			role, e := ParseRole(req.FormValue("role"))
+			if e != nil {
+				onError(w, http.StatusBadRequest, "%s", e)
+				return
+			}
+			info, rec, e := newToken(role, req.FormValue("name"))
+			if e != nil {
+				onError(w, http.StatusInternalServerError, "%s", e)
+				return
+			}
+			v, _ := json.Marshal(rec)
+			if e := a.creds.PutCredential(info.ID, v); e != nil {
+				onStoreError(w, e)
+				return
+			}
+			writeJSON(w, http.StatusCreated, info)
+
+		case req.Method == "DELETE" && id != "":
+			if e := a.creds.DelCredential(id); e != nil {
+				onStoreError(w, e)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+
+		default:
+			onError(w, http.StatusMethodNotAllowed, "unsupported method %s for %s", req.Method, req.URL.Path)
+		}
+	}
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
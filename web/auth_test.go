@@ -0,0 +1,157 @@
+//    Copyright © 2016 Joubin Houshyar. All rights reserved.
+//
+//    This file is part of Frankinstore.
+//
+//    Frankinstore is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU Affero General Public License as
+//    published by the Free Software Foundation, either version 3 of
+//    the License, or (at your option) any later version.
+//
+//    Frankinstore is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU Affero General Public License for more details.
+//
+//    You should have received a copy of the GNU Affero General Public
+//    License along with Frankinstore.  If not, see <http://www.gnu.org/licenses/>.
+
+package web
+
+import (
+	"encoding/json"
+	"github.com/alphazero/borisdb/store"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func openTestDb(t *testing.T) store.Store {
+	t.Helper()
+	db, e := store.OpenDb(filepath.Join(t.TempDir(), store.DefaultDb), nil)
+	if e != nil {
+		t.Fatalf("OpenDb: %v", e)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// serves 'req' with 'fn' and returns the response.
+func serve(fn http.HandlerFunc, method, uri, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, uri, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	fn(w, req)
+	return w
+}
+
+func okHandler(w http.ResponseWriter, req *http.Request) {
+	w.Write([]byte("ok"))
+}
+
+// creates a token of 'role' through the tokens handler.
+func createToken(t *testing.T, a *authenticator, adminToken, role string) TokenInfo {
+	t.Helper()
+	tokens := a.require(RoleAdmin, getTokensHandler(a))
+	w := serve(tokens, "POST", "/admin/tokens?role="+role+"&name=test-"+role, adminToken)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create %s token status = %d; want 201 - %s", role, w.Code, w.Body)
+	}
+	var info TokenInfo
+	if e := json.Unmarshal(w.Body.Bytes(), &info); e != nil {
+		t.Fatal(e)
+	}
+	return info
+}
+
+func TestRoles(t *testing.T) {
+	db := openTestDb(t)
+	a := newAuthenticator(db, Options{AdminToken: "bootstrap", AuthRequired: true})
+
+	reader := createToken(t, a, "bootstrap", "read").Token
+	writer := createToken(t, a, "bootstrap", "write").Token
+	admin := createToken(t, a, "bootstrap", "admin").Token
+
+	for _, tc := range []struct {
+		role  Role
+		token string
+		want  int
+	}{
+		{RoleRead, "", http.StatusUnauthorized},
+		{RoleRead, "bogus", http.StatusUnauthorized},
+		{RoleRead, reader + "x", http.StatusUnauthorized},
+		{RoleRead, reader, http.StatusOK},
+		{RoleWrite, reader, http.StatusForbidden},
+		{RoleWrite, writer, http.StatusOK},
+		{RoleAdmin, writer, http.StatusForbidden},
+		{RoleAdmin, admin, http.StatusOK},
+		{RoleAdmin, "bootstrap", http.StatusOK},
+		{RoleWrite, admin, http.StatusOK},
+	} {
+		if w := serve(a.require(tc.role, okHandler), "GET", "/", tc.token); w.Code != tc.want {
+			t.Errorf("%s with token %q status = %d; want %d", tc.role, tc.token, w.Code, tc.want)
+		}
+	}
+}
+
+func TestAnonymousAccess(t *testing.T) {
+	db := openTestDb(t)
+	a := newAuthenticator(db, Options{})
+
+	if w := serve(a.require(RoleWrite, okHandler), "GET", "/", ""); w.Code != http.StatusOK {
+		t.Errorf("anonymous write status = %d; want 200", w.Code)
+	}
+	if w := serve(a.require(RoleAdmin, okHandler), "GET", "/", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("anonymous admin status = %d; want 401", w.Code)
+	}
+	// invalid credentials are rejected even if not required
+	if w := serve(a.require(RoleRead, okHandler), "GET", "/", "bogus"); w.Code != http.StatusUnauthorized {
+		t.Errorf("invalid token read status = %d; want 401", w.Code)
+	}
+}
+
+func TestTokenManagement(t *testing.T) {
+	db := openTestDb(t)
+	a := newAuthenticator(db, Options{AdminToken: "bootstrap"})
+	tokens := a.require(RoleAdmin, getTokensHandler(a))
+
+	info := createToken(t, a, "bootstrap", "write")
+	if !strings.HasPrefix(info.Token, info.ID+".") {
+		t.Errorf("token %q does not have id prefix %q", info.Token, info.ID)
+	}
+
+	// stored credentials do not include the secret
+	v, e := db.(store.Credentials).GetCredential(info.ID)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if secret := strings.TrimPrefix(info.Token, info.ID+"."); strings.Contains(string(v), secret) {
+		t.Errorf("stored credential contains secret")
+	}
+
+	w := serve(tokens, "GET", "/admin/tokens", "bootstrap")
+	var list []TokenInfo
+	json.Unmarshal(w.Body.Bytes(), &list)
+	if len(list) != 1 || list[0].ID != info.ID || list[0].Token != "" {
+		t.Errorf("list = %+v; want single token %s without secret", list, info.ID)
+	}
+
+	if w := serve(a.require(RoleWrite, okHandler), "GET", "/", info.Token); w.Code != http.StatusOK {
+		t.Errorf("write before revoke status = %d; want 200", w.Code)
+	}
+	if w := serve(tokens, "DELETE", "/admin/tokens/"+info.ID, "bootstrap"); w.Code != http.StatusNoContent {
+		t.Errorf("revoke status = %d; want 204", w.Code)
+	}
+	if w := serve(a.require(RoleWrite, okHandler), "GET", "/", info.Token); w.Code != http.StatusUnauthorized {
+		t.Errorf("write after revoke status = %d; want 401", w.Code)
+	}
+	if w := serve(tokens, "DELETE", "/admin/tokens/"+info.ID, "bootstrap"); w.Code != http.StatusNotFound {
+		t.Errorf("revoke revoked status = %d; want 404", w.Code)
+	}
+	if w := serve(tokens, "POST", "/admin/tokens?role=root", "bootstrap"); w.Code != http.StatusBadRequest {
+		t.Errorf("create invalid role status = %d; want 400", w.Code)
+	}
+}
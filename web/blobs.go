@@ -0,0 +1,221 @@
+//    Copyright © 2016 Joubin Houshyar. All rights reserved.
+//
+//    This file is part of Frankinstore.
+//
+//    Frankinstore is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU Affero General Public License as
+//    published by the Free Software Foundation, either version 3 of
+//    the License, or (at your option) any later version.
+//
+//    Frankinstore is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU Affero General Public License for more details.
+//
+//    You should have received a copy of the GNU Affero General Public
+//    License along with Frankinstore.  If not, see <http://www.gnu.org/licenses/>.
+
+package web
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/alphazero/borisdb/store"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+/// v2 api ////////////////////////////////////////////////////////////////////
+
+// The v2 api exposes value blobs as the resource /v2/blobs:
+//
+//	POST   /v2/blobs        stores the request body. Answers the key.
+//	PUT    /v2/blobs/<key>  stores the request body, which must hash to key.
+//	GET    /v2/blobs/<key>  answers the value.
+//	HEAD   /v2/blobs/<key>  answers the value headers.
+//	DELETE /v2/blobs/<key>  deletes the value.
+//
+// Stores are idempotent, as blobs are content addressed: storing an
+// existing blob answers 200, a new blob 201 Created. Keys must be
+// exactly 40 hex digits.
+
+const blobsPath = "/v2/blobs"
+
+// returns the location of blob 'key'.
+func blobLocation(key store.Key) string {
+	return blobsPath + "/" + key.String()
+}
+
+// returns the key of the /v2/blobs/<key> request 'req'. Responds with
+// an error and returns false if the key is blank or invalid.
+func blobKey(w http.ResponseWriter, req *http.Request) (store.Key, bool) {
+	return parseKey(w, strings.TrimPrefix(req.URL.Path, blobsPath+"/"))
+}
+
+// convenience dispatcher by request method. Unsupported methods are
+// answered 405 with the allowed methods.
+func methods(fns map[string]http.HandlerFunc) http.HandlerFunc {
+	var allowed []string
+	for m := range fns {
+		allowed = append(allowed, m)
+	}
+	sort.Strings(allowed)
+	allow := strings.Join(allowed, ", ")
+
+	return func(w http.ResponseWriter, req *http.Request) {
+		fn, ok := fns[req.Method]
+		if !ok {
+			w.Header().Set("Allow", allow)
+			onError(w, http.StatusMethodNotAllowed, "expect %s method - have %s", allow, req.Method)
+			return
+		}
+		fn(w, req)
+	}
+}
+
+// stores 'blob' and answers its key. 'want' is the expected key, if
+// not nil. Returns true if the blob is stored.
+func storeBlob(w http.ResponseWriter, req *http.Request, db store.Store, blob []byte, want *store.Key) bool {
+	if want != nil {
+		if key := store.KeyOf(blob); key != *want {
+			onStoreErrorf(w, store.InvalidKeyErr, "%s - value hashes to %s", store.InvalidKeyErr, key)
+			return false
+		}
+	}
+
+	code := http.StatusCreated
+	key, e := db.PutContext(req.Context(), blob)
+	if errors.Is(e, store.ExistingErr) {
+		code = http.StatusOK
+	} else if e != nil {
+		onStoreError(w, e)
+		return false
+	}
+
+	logKey(w, key.String())
+	w.Header().Set("Location", blobLocation(key))
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(code)
+	w.Write([]byte(key.String()))
+	return true
+}
+
+// returns a new http request handler function for POST /v2/blobs.
+//
+// Request bodies larger than 'maxsize' (if non-zero) are rejected.
+func getPostBlobHandler(db store.Store, maxsize int64) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, req *http.Request) {
+		blob, ok := readValue(w, req, maxsize)
+		if !ok {
+			return
+		}
+		storeBlob(w, req, db, blob, nil)
+	}
+}
+
+// returns a new http request handler function for PUT /v2/blobs/<key>.
+//
+// Request bodies larger than 'maxsize' (if non-zero), or not hashing
+// to key are rejected.
+func getPutBlobHandler(db store.Store, maxsize int64) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, req *http.Request) {
+		key, ok := blobKey(w, req)
+		if !ok {
+			return
+		}
+		blob, ok := readValue(w, req, maxsize)
+		if !ok {
+			return
+		}
+		storeBlob(w, req, db, blob, &key)
+	}
+}
+
+// returns a new http request handler function for GET and HEAD
+// /v2/blobs/<key>.
+//
+// See serveBlob.
+func getBlobHandler(db store.Store, opts Options) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, req *http.Request) {
+		key, ok := blobKey(w, req)
+		if !ok {
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		serveBlob(w, req, db, key, opts)
+	}
+}
+
+// serves blob 'key' with http.ServeContent. Blobs are immutable, so
+// the key is a strong ETag and responses may be cached for
+// opts.CacheMaxAge: by shared caches only if the service does not
+// require authentication and the request carries no credentials.
+// Supports conditional (e.g. If-None-Match) and (multi) range requests.
+//
+// Small blobs are served directly from the store's transaction. Larger
+// blobs are copied, as writing them may block on the client, and open
+// transactions delay the remapping of the db file by writers.
+func serveBlob(w http.ResponseWriter, req *http.Request, db store.Store, key store.Key, opts Options) {
+	scope := "public"
+	if opts.AuthRequired || req.Header.Get("Authorization") != "" {
+		scope = "private"
+	}
+	serve := func(val []byte) {
+		h := w.Header()
+		h.Set("ETag", `"`+key.String()+`"`)
+		if opts.CacheMaxAge > 0 {
+			h.Set("Cache-Control", fmt.Sprintf("%s, max-age=%d, immutable", scope, int64(opts.CacheMaxAge.Seconds())))
+		}
+		http.ServeContent(w, req, "", time.Time{}, bytes.NewReader(val))
+	}
+	var copied []byte
+	var written bool
+	e := db.ViewContext(req.Context(), key, func(val []byte) error {
+		if len(val) > zeroCopyMax {
+			copied = append([]byte(nil), val...)
+			return nil
+		}
+		written = true
+		serve(val)
+		return nil
+	})
+	switch {
+	case e != nil && !written:
+		onStoreError(w, e)
+	case copied != nil:
+		serve(copied)
+	}
+}
+
+// max size of blobs served from the store's transaction. Responses of
+// this size are buffered by net/http and do not block on the client.
+const zeroCopyMax = 2 << 10
+
+// returns a new http request handler function for DELETE /v2/blobs/<key>.
+// Answers 204, or if the request has 'Prefer: return=representation',
+// 200 and the deleted blob.
+func getDeleteBlobHandler(db store.Store) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, req *http.Request) {
+		key, ok := blobKey(w, req)
+		if !ok {
+			return
+		}
+		val, e := db.DelContext(req.Context(), key)
+		if e != nil {
+			onStoreError(w, e)
+			return
+		}
+		if req.Header.Get("Prefer") == preferRepresentation {
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Write(val)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// Prefer header (rfc 7240) of requests asking for the deleted blob
+const preferRepresentation = "return=representation"
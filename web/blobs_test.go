@@ -0,0 +1,209 @@
+//    Copyright © 2016 Joubin Houshyar. All rights reserved.
+//
+//    This file is part of Frankinstore.
+//
+//    Frankinstore is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU Affero General Public License as
+//    published by the Free Software Foundation, either version 3 of
+//    the License, or (at your option) any later version.
+//
+//    Frankinstore is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU Affero General Public License for more details.
+//
+//    You should have received a copy of the GNU Affero General Public
+//    License along with Frankinstore.  If not, see <http://www.gnu.org/licenses/>.
+
+package web
+
+import (
+	"bytes"
+	"github.com/alphazero/borisdb/store"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// starts a test service for 'opts' backed by a new test store.
+func startTestService(t *testing.T, opts Options) (store.Store, *httptest.Server) {
+	t.Helper()
+	db := openTestDb(t)
+	return db, serveTestDb(t, db, opts)
+}
+
+// starts a test service for 'opts' backed by 'db'.
+func serveTestDb(t *testing.T, db store.Store, opts Options) *httptest.Server {
+	t.Helper()
+	var state atomic.Int32
+	state.Store(stateReady)
+	uploads, e := newUploadManager(opts)
+	if e != nil {
+		t.Fatal(e)
+	}
+	srv := httptest.NewServer(newServeMux(db, opts, &state, uploads, newRateLimits(opts), func(e error) error { return e }))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// sends the request and returns the response and body. 'hdrs' are
+// header name, value pairs.
+func do(t *testing.T, method, uri string, body []byte, hdrs ...string) (*http.Response, string) {
+	t.Helper()
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+	req, e := http.NewRequest(method, uri, r)
+	if e != nil {
+		t.Fatal(e)
+	}
+	for i := 0; i+1 < len(hdrs); i += 2 {
+		req.Header.Set(hdrs[i], hdrs[i+1])
+	}
+	resp, e := http.DefaultClient.Do(req)
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer resp.Body.Close()
+	b, _ := io.ReadAll(resp.Body)
+	return resp, string(b)
+}
+
+func TestBlobsAPI(t *testing.T) {
+	_, srv := startTestService(t, Options{})
+	blobs := srv.URL + blobsPath
+	val := []byte("hello borisdb")
+	key := store.KeyOf(val).String()
+
+	resp, body := do(t, "POST", blobs, val)
+	if resp.StatusCode != http.StatusCreated || body != key {
+		t.Fatalf("POST = %d %q; want 201 %q", resp.StatusCode, body, key)
+	}
+	if loc := resp.Header.Get("Location"); loc != blobsPath+"/"+key {
+		t.Errorf("POST Location = %q", loc)
+	}
+	if resp, _ := do(t, "POST", blobs, val); resp.StatusCode != http.StatusOK {
+		t.Errorf("POST existing = %d; want 200", resp.StatusCode)
+	}
+
+	resp, body = do(t, "GET", blobs+"/"+key, nil)
+	if resp.StatusCode != http.StatusOK || body != string(val) {
+		t.Errorf("GET = %d %q; want 200 %q", resp.StatusCode, body, val)
+	}
+	resp, body = do(t, "HEAD", blobs+"/"+key, nil)
+	if resp.StatusCode != http.StatusOK || resp.ContentLength != int64(len(val)) || body != "" {
+		t.Errorf("HEAD = %d length %d %q; want 200 length %d", resp.StatusCode, resp.ContentLength, body, len(val))
+	}
+
+	if resp, _ := do(t, "DELETE", blobs+"/"+key, nil); resp.StatusCode != http.StatusNoContent {
+		t.Errorf("DELETE = %d; want 204", resp.StatusCode)
+	}
+	if resp, _ := do(t, "GET", blobs+"/"+key, nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("GET deleted = %d; want 404", resp.StatusCode)
+	}
+	if resp, _ := do(t, "DELETE", blobs+"/"+key, nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("DELETE deleted = %d; want 404", resp.StatusCode)
+	}
+
+	// put verifies the key
+	if resp, _ := do(t, "PUT", blobs+"/"+key, val); resp.StatusCode != http.StatusCreated {
+		t.Errorf("PUT = %d; want 201", resp.StatusCode)
+	}
+	other := store.KeyOf([]byte("other")).String()
+	if resp, body := do(t, "PUT", blobs+"/"+other, val); resp.StatusCode != http.StatusBadRequest || !strings.Contains(body, key) {
+		t.Errorf("PUT mismatched key = %d %q; want 400", resp.StatusCode, body)
+	}
+
+	if resp, _ := do(t, "PATCH", blobs+"/"+key, val); resp.StatusCode != http.StatusMethodNotAllowed || resp.Header.Get("Allow") == "" {
+		t.Errorf("PATCH = %d Allow %q; want 405", resp.StatusCode, resp.Header.Get("Allow"))
+	}
+}
+
+func TestStrictKeys(t *testing.T) {
+	_, srv := startTestService(t, Options{})
+	key := store.KeyOf([]byte("x")).String()
+	for _, uri := range []string{
+		blobsPath + "/00ff",
+		blobsPath + "/" + key + "00",
+		blobsPath + "/" + key[:39] + "z",
+		blobsPath + "/" + key + "/extra",
+		"/get/00ff",
+		"/del/" + key + "00",
+	} {
+		resp, body := do(t, "GET", srv.URL+uri, nil)
+		if resp.StatusCode != http.StatusBadRequest || !strings.Contains(body, store.InvalidKeyErr.Error()) {
+			t.Errorf("GET %s = %d %q; want 400 InvalidKeyErr", uri, resp.StatusCode, body)
+		}
+	}
+}
+
+func TestCaching(t *testing.T) {
+	db, srv := startTestService(t, Options{CacheMaxAge: time.Hour})
+	val := []byte("0123456789abcdef")
+	key, _ := db.Put(val)
+	etag := `"` + key.String() + `"`
+
+	for _, uri := range []string{blobsPath + "/" + key.String(), "/get/" + key.String()} {
+		resp, _ := do(t, "GET", srv.URL+uri, nil)
+		if resp.Header.Get("ETag") != etag {
+			t.Errorf("%s ETag = %q; want %q", uri, resp.Header.Get("ETag"), etag)
+		}
+		if cc := resp.Header.Get("Cache-Control"); cc != "public, max-age=3600, immutable" {
+			t.Errorf("%s Cache-Control = %q", uri, cc)
+		}
+
+		resp, body := do(t, "GET", srv.URL+uri, nil, "If-None-Match", etag)
+		if resp.StatusCode != http.StatusNotModified || body != "" {
+			t.Errorf("%s If-None-Match = %d %q; want 304", uri, resp.StatusCode, body)
+		}
+
+		resp, body = do(t, "GET", srv.URL+uri, nil, "Range", "bytes=2-5")
+		if resp.StatusCode != http.StatusPartialContent || body != "2345" ||
+			resp.Header.Get("Content-Range") != "bytes 2-5/16" {
+			t.Errorf("%s Range = %d %q %q; want 206 2345", uri, resp.StatusCode, body, resp.Header.Get("Content-Range"))
+		}
+
+		resp, body = do(t, "GET", srv.URL+uri, nil, "Range", "bytes=0-1,14-")
+		if resp.StatusCode != http.StatusPartialContent ||
+			!strings.HasPrefix(resp.Header.Get("Content-Type"), "multipart/byteranges") ||
+			!strings.Contains(body, "01") || !strings.Contains(body, "ef") {
+			t.Errorf("%s multi-range = %d %q; want 206 multipart/byteranges", uri, resp.StatusCode, resp.Header.Get("Content-Type"))
+		}
+
+		resp, _ = do(t, "GET", srv.URL+uri, nil, "Range", "bytes=100-")
+		if resp.StatusCode != http.StatusRequestedRangeNotSatisfiable {
+			t.Errorf("%s unsatisfiable range = %d; want 416", uri, resp.StatusCode)
+		}
+	}
+
+	// responses to authenticated requests or services are private
+	for _, c := range []struct {
+		opts   Options
+		header []string
+		want   string
+	}{
+		{Options{AdminToken: "secret"}, nil, "public"},
+		{Options{AdminToken: "secret"}, []string{"Authorization", "Bearer secret"}, "private"},
+		{Options{AdminToken: "secret", AuthRequired: true}, []string{"Authorization", "Bearer secret"}, "private"},
+	} {
+		c.opts.CacheMaxAge = time.Hour
+		adb, asrv := startTestService(t, c.opts)
+		akey, _ := adb.Put(val)
+		resp, _ := do(t, "GET", asrv.URL+blobsPath+"/"+akey.String(), nil, c.header...)
+		if cc := resp.Header.Get("Cache-Control"); resp.StatusCode != http.StatusOK || cc != c.want+", max-age=3600, immutable" {
+			t.Errorf("%+v %q = %d, Cache-Control %q", c.opts, c.header, resp.StatusCode, cc)
+		}
+	}
+
+	// deleted blobs are not answered from stale validators
+	db.Del(key)
+	resp, _ := do(t, "GET", srv.URL+blobsPath+"/"+key.String(), nil, "If-None-Match", etag)
+	if resp.StatusCode != http.StatusNotFound || resp.Header.Get("ETag") != "" {
+		t.Errorf("deleted If-None-Match = %d ETag %q; want 404", resp.StatusCode, resp.Header.Get("ETag"))
+	}
+}
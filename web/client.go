@@ -2,97 +2,674 @@ package web
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"io/ioutil"
+	"github.com/alphazero/borisdb/store"
+	"io"
+	"math/rand/v2"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
 )
 
 const mimetype = "application/binary"
 
+// client defaults - see ClientOption
+const (
+	DefaultRetries      = 2
+	DefaultRetryBackoff = 100 * time.Millisecond
+	DefaultMaxBackoff   = 2 * time.Second
+	DefaultMaxIdleConns = 16
+)
+
 type Client struct {
 	hostport string
-	setUri   string
+	token    string
+	scheme   string
+	http     *http.Client
+
+	transport   http.RoundTripper // nil for the default transport
+	timeout     time.Duration     // per-call timeout, if non-zero
+	retries     int               // max retries of idempotent calls
+	backoff     time.Duration     // base backoff of retries
+	maxBackoff  time.Duration     // max backoff of retries
+	maxIdle     int               // max idle connections per host
+	idleTimeout time.Duration     // idle connections are closed after idleTimeout
+	verify      bool              // verify blobs of Get hash to their key
+}
+
+// ClientOption configures a Client. See NewClient.
+type ClientOption func(*Client)
+
+// WithHTTPClient sets the http client of the Client. The transport
+// and pool options do not apply to 'c'.
+func WithHTTPClient(c *http.Client) ClientOption {
+	return func(p *Client) { p.http = c }
+}
+
+// WithTransport sets the transport of the Client, e.g. for tracing or
+// tests. The pool options do not apply to 'rt'.
+func WithTransport(rt http.RoundTripper) ClientOption {
+	return func(p *Client) { p.transport = rt }
+}
+
+// WithTimeout bounds each call, including its retries and reading its
+// response, by 'd'. Streaming calls (Backup, Export, Import) are only
+// bounded by their context. Not bounded if zerovalue (the default).
+func WithTimeout(d time.Duration) ClientOption {
+	return func(p *Client) { p.timeout = d }
+}
+
+// WithRetries sets the max retries of idempotent calls (Get, Put and
+// Info) on transient errors, and the backoff between attempts. The
+// n-th retry waits a random duration up to min(max, backoff*2^n), or
+// as asked by the service (Retry-After). Not retried if n is 0.
+func WithRetries(n int, backoff, max time.Duration) ClientOption {
+	return func(p *Client) {
+		p.retries, p.backoff, p.maxBackoff = n, backoff, max
+	}
+}
+
+// WithPool sets the max idle (keep-alive) connections to the service,
+// and their idle timeout.
+func WithPool(maxIdle int, idleTimeout time.Duration) ClientOption {
+	return func(p *Client) {
+		p.maxIdle, p.idleTimeout = maxIdle, idleTimeout
+	}
 }
 
-func NewClient(host string, port int) (*Client, error) {
+// WithVerify sets whether Get verifies blobs hash to their key. Blobs
+// are not verified by default.
+func WithVerify(verify bool) ClientOption {
+	return func(p *Client) { p.verify = verify }
+}
+
+func NewClient(host string, port int, opts ...ClientOption) (*Client, error) {
 	if host == "" {
 		return nil, fmt.Errorf("host is zerovalue")
 	}
 
 	c := &Client{
-		hostport: fmt.Sprintf("%s:%d", host, port),
+		hostport:    fmt.Sprintf("%s:%d", host, port),
+		scheme:      "http",
+		retries:     DefaultRetries,
+		backoff:     DefaultRetryBackoff,
+		maxBackoff:  DefaultMaxBackoff,
+		maxIdle:     DefaultMaxIdleConns,
+		idleTimeout: 90 * time.Second,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.retries < 0 || c.backoff < 0 || c.maxBackoff < 0 {
+		return nil, fmt.Errorf("retry options can not be negative")
+	}
+	if c.http == nil {
+		transport := c.transport
+		if transport == nil {
+			t := http.DefaultTransport.(*http.Transport).Clone()
+			t.MaxIdleConnsPerHost = c.maxIdle
+			t.IdleConnTimeout = c.idleTimeout
+			transport = t
+		}
+		c.http = &http.Client{Transport: transport}
 	}
 	return c, nil
 }
 
-func (p *Client) Put(v []byte) ([]byte, error) {
+// stores blob 'v' and returns its key. The key answered by the service
+// must match the key of 'v', or DataCorruptedErr is returned.
+func (p *Client) Put(v []byte) (store.Key, error) {
+	return p.PutContext(context.Background(), v)
+}
+
+// Put is idempotent, as blobs are content addressed, and is retried
+// on transient errors.
+func (p *Client) PutContext(ctx context.Context, v []byte) (store.Key, error) {
 	if v == nil {
-		return nil, fmt.Errorf("nil value")
+		return store.Key{}, store.NilValueErr
 	}
 	if len(v) == 0 {
-		return nil, fmt.Errorf("value must be atleast 1 bytes.")
+		return store.Key{}, store.ZeroValueErr
 	}
 
-	buf := bytes.NewReader(v)
+	key, _, e := p.put(ctx, v)
+	return key, e
+}
 
-	uri := fmt.Sprintf("http://%s/set", p.hostport)
-	resp, e := http.Post(uri, mimetype, buf)
+// stores blob 'v'. Also returns true if the blob is new. Retried puts
+// are reported as new, as an earlier attempt may have stored the blob.
+func (p *Client) put(ctx context.Context, v []byte) (store.Key, bool, error) {
+	// the service verifies the blob hashes to key
+	key := store.KeyOf(v)
+	body, code, retried, e := p.callStatus(ctx, "PUT", p.blobUri(key), v, true)
 	if e != nil {
-		return nil, fmt.Errorf("%s", e)
+		return key, false, e
 	}
-	defer resp.Body.Close()
+	return key, code == http.StatusCreated || retried, verifyKey(body, key)
+}
 
-	err := responseErrorIfAny(resp)
+// returns the blob of 'key'. With WithVerify, the blob is re-hashed
+// and DataCorruptedErr returned if it does not match 'key'.
+func (p *Client) Get(key store.Key) ([]byte, error) {
+	return p.GetContext(context.Background(), key)
+}
 
-	body, e := ioutil.ReadAll(resp.Body)
+func (p *Client) GetContext(ctx context.Context, key store.Key) ([]byte, error) {
+	v, e := p.call(ctx, "GET", p.blobUri(key), nil, true)
 	if e != nil {
-		err = fmt.Errorf("%s - with error:%s", e)
+		return nil, e
+	}
+	if p.verify {
+		if vkey := store.KeyOf(v); vkey != key {
+			return nil, fmt.Errorf("%w - blob %s hashes to %s", store.DataCorruptedErr, key, vkey)
+		}
 	}
-	return body, err
+	return v, nil
 }
 
-func (p *Client) Get(key string) ([]byte, error) {
-	uri := fmt.Sprintf("http://%s/get/%s", p.hostport, key)
-	return p.httpGet(uri)
+// deletes the blob of 'key'. Returns the deleted blob.
+func (p *Client) Del(key store.Key) ([]byte, error) {
+	return p.DelContext(context.Background(), key)
 }
 
-func (p *Client) Del(key string) ([]byte, error) {
-	uri := fmt.Sprintf("http://%s/del/%s", p.hostport, key)
-	return p.httpGet(uri)
+// Del is not retried, as a retried delete would fail with NotFoundErr.
+func (p *Client) DelContext(ctx context.Context, key store.Key) ([]byte, error) {
+	return p.call(ctx, "DELETE", p.blobUri(key), nil, false, "Prefer", preferRepresentation)
 }
 
 func (p *Client) Info() ([]byte, error) {
-	uri := fmt.Sprintf("http://%s/info", p.hostport)
-	return p.httpGet(uri)
+	return p.InfoContext(context.Background())
+}
+
+func (p *Client) InfoContext(ctx context.Context) ([]byte, error) {
+	uri := fmt.Sprintf("%s://%s/info", p.scheme, p.hostport)
+	return p.call(ctx, "GET", uri, nil, true)
 }
 
 func (p *Client) Shutdown() ([]byte, error) {
-	uri := fmt.Sprintf("http://%s/shutdown", p.hostport)
-	return p.httpGet(uri)
+	return p.ShutdownContext(context.Background())
+}
+
+func (p *Client) ShutdownContext(ctx context.Context) ([]byte, error) {
+	uri := fmt.Sprintf("%s://%s/shutdown", p.scheme, p.hostport)
+	return p.call(ctx, "GET", uri, nil, false)
+}
+
+// sets the bearer token presented to the service. The role of the
+// token must permit the requested operations - see Role.
+func (p *Client) SetToken(token string) {
+	p.token = token
+}
+
+// sets the token presented to the /admin/ endpoints of the service.
+//
+// Deprecated: tokens are presented on all requests. Use SetToken.
+func (p *Client) SetAdminToken(token string) {
+	p.SetToken(token)
+}
+
+// switches the client to https, using 'cfg' to verify the service
+// and, for mutual-TLS, to present the client certificate.
+// See LoadClientTLS. The transport of the client, unless an
+// *http.Transport, is replaced by a default transport.
+func (p *Client) SetTLS(cfg *tls.Config) {
+	transport, ok := p.http.Transport.(*http.Transport)
+	if ok {
+		transport = transport.Clone()
+	} else {
+		transport = http.DefaultTransport.(*http.Transport).Clone()
+		transport.MaxIdleConnsPerHost = p.maxIdle
+		transport.IdleConnTimeout = p.idleTimeout
+	}
+	transport.TLSClientConfig = cfg
+	c := *p.http
+	c.Transport = transport
+	p.http = &c
+	p.scheme = "https"
+}
+
+// streams a backup of the remote database to 'w'.
+// Returns the number of bytes written.
+func (p *Client) Backup(w io.Writer) (int64, error) {
+	return p.BackupContext(context.Background(), w)
+}
+
+func (p *Client) BackupContext(ctx context.Context, w io.Writer) (int64, error) {
+	uri := fmt.Sprintf("%s://%s/admin/backup", p.scheme, p.hostport)
+	return p.adminStream(ctx, uri, w)
+}
+
+// streams an export archive of the remote database to 'w'.
+// Returns the number of bytes written.
+func (p *Client) Export(w io.Writer) (int64, error) {
+	return p.ExportContext(context.Background(), w)
+}
+
+func (p *Client) ExportContext(ctx context.Context, w io.Writer) (int64, error) {
+	uri := fmt.Sprintf("%s://%s/admin/export", p.scheme, p.hostport)
+	return p.adminStream(ctx, uri, w)
+}
+
+// sends the export archive read from 'r' to the remote database.
+// Returns the response of the service, i.e. the count of imported blobs.
+func (p *Client) Import(r io.Reader) ([]byte, error) {
+	return p.ImportContext(context.Background(), r)
+}
+
+func (p *Client) ImportContext(ctx context.Context, r io.Reader) ([]byte, error) {
+	uri := fmt.Sprintf("%s://%s/admin/import", p.scheme, p.hostport)
+	return p.adminPost(ctx, uri, r)
+}
+
+// compacts the remote database.
+// Returns the response of the service, i.e. before and after sizes.
+func (p *Client) Compact() ([]byte, error) {
+	return p.CompactContext(context.Background())
+}
+
+func (p *Client) CompactContext(ctx context.Context) ([]byte, error) {
+	uri := fmt.Sprintf("%s://%s/admin/compact", p.scheme, p.hostport)
+	return p.call(ctx, "POST", uri, nil, false)
+}
+
+// creates a new token of role 'role' (read, write or admin), named
+// 'name'. The returned info includes the secret token, which can not
+// be retrieved later.
+func (p *Client) CreateToken(role, name string) (TokenInfo, error) {
+	return p.CreateTokenContext(context.Background(), role, name)
+}
+
+func (p *Client) CreateTokenContext(ctx context.Context, role, name string) (TokenInfo, error) {
+	form := url.Values{"role": {role}, "name": {name}}
+	uri := fmt.Sprintf("%s://%s/admin/tokens?%s", p.scheme, p.hostport, form.Encode())
+	var info TokenInfo
+	body, e := p.call(ctx, "POST", uri, nil, false)
+	if e != nil {
+		return info, e
+	}
+	if e := json.Unmarshal(body, &info); e != nil {
+		return info, fmt.Errorf("invalid token response - %w", e)
+	}
+	return info, nil
+}
+
+// lists the issued tokens, without their secrets.
+func (p *Client) ListTokens() ([]TokenInfo, error) {
+	return p.ListTokensContext(context.Background())
+}
+
+func (p *Client) ListTokensContext(ctx context.Context) ([]TokenInfo, error) {
+	uri := fmt.Sprintf("%s://%s/admin/tokens", p.scheme, p.hostport)
+	body, e := p.call(ctx, "GET", uri, nil, true)
+	if e != nil {
+		return nil, e
+	}
+	var tokens []TokenInfo
+	if e := json.Unmarshal(body, &tokens); e != nil {
+		return nil, fmt.Errorf("invalid tokens response - %w", e)
+	}
+	return tokens, nil
+}
+
+// revokes the token with id 'id'.
+func (p *Client) RevokeToken(id string) error {
+	return p.RevokeTokenContext(context.Background(), id)
+}
+
+func (p *Client) RevokeTokenContext(ctx context.Context, id string) error {
+	uri := fmt.Sprintf("%s://%s/admin/tokens/%s", p.scheme, p.hostport, url.PathEscape(id))
+	_, e := p.call(ctx, "DELETE", uri, nil, false)
+	return e
+}
+
+// default part size of uploads
+const DefaultPartSize = 8 << 20
+
+// Uploader uploads a large blob in parts, in an upload session of the
+// service. An interrupted upload is resumed by a new Uploader of the
+// same session ID, which only sends the parts not yet received.
+type Uploader struct {
+	// the client sending the parts
+	Client *Client
+	// upload session id. A new session is created on upload if blank.
+	ID string
+	// size of parts. DefaultPartSize if zerovalue.
+	PartSize int64
+}
+
+// NewUploader returns an uploader of a new upload session. To resume
+// session 'id', set the ID of the returned uploader.
+func (p *Client) NewUploader() *Uploader {
+	return &Uploader{Client: p, PartSize: DefaultPartSize}
+}
+
+// uploads the 'size' bytes of 'r' and commits the session.
+// Returns the key of the stored blob. The service verifies the blob
+// hashes to the key of 'r'.
+func (u *Uploader) Upload(r io.ReaderAt, size int64) (store.Key, error) {
+	return u.UploadContext(context.Background(), r, size)
+}
+
+func (u *Uploader) UploadContext(ctx context.Context, r io.ReaderAt, size int64) (store.Key, error) {
+	var key store.Key
+	if size <= 0 {
+		return key, store.ZeroValueErr
+	}
+	partSize := u.PartSize
+	if partSize <= 0 {
+		partSize = DefaultPartSize
+	}
+
+	// the received parts of a resumed session are skipped
+	var status UploadStatus
+	var e error
+	if u.ID == "" {
+		status, e = u.Client.uploadRequest(ctx, "POST", "", nil)
+		u.ID = status.ID
+	} else {
+		status, e = u.Client.uploadRequest(ctx, "GET", u.ID, nil)
+	}
+	if e != nil {
+		return key, e
+	}
+	received := make(map[int]UploadPart, len(status.Parts))
+	for _, part := range status.Parts {
+		received[part.Number] = part
+	}
+
+	// all parts are read, to hash the blob
+	h := sha1.New()
+	buf := make([]byte, partSize)
+	for n, offset := 1, int64(0); offset < size; n, offset = n+1, offset+partSize {
+		psize := partSize
+		if offset+psize > size {
+			psize = size - offset
+		}
+		if _, e := r.ReadAt(buf[:psize], offset); e != nil && e != io.EOF {
+			return key, e
+		}
+		h.Write(buf[:psize])
+		if part, ok := received[n]; ok && part.Offset == offset && part.SHA1 == fmt.Sprintf("%x", sha1.Sum(buf[:psize])) {
+			continue
+		}
+		path := fmt.Sprintf("%s/%d?offset=%d", u.ID, n, offset)
+		if _, e := u.Client.uploadRequest(ctx, "PUT", path, buf[:psize]); e != nil {
+			return key, e
+		}
+	}
+	copy(key[:], h.Sum(nil))
+
+	uri := fmt.Sprintf("%s://%s%s/%s/commit?key=%s", u.Client.scheme, u.Client.hostport, uploadsPath, u.ID, key)
+	body, e := u.Client.call(ctx, "POST", uri, nil, false)
+	if e != nil {
+		return key, e
+	}
+	return key, verifyKey(body, key)
+}
+
+// aborts the upload session, removing its received parts.
+func (u *Uploader) Abort() error {
+	return u.AbortContext(context.Background())
+}
+
+func (u *Uploader) AbortContext(ctx context.Context) error {
+	_, e := u.Client.uploadRequest(ctx, "DELETE", u.ID, nil)
+	return e
+}
+
+// returns the status of the upload session.
+func (u *Uploader) Status() (UploadStatus, error) {
+	return u.StatusContext(context.Background())
+}
+
+func (u *Uploader) StatusContext(ctx context.Context) (UploadStatus, error) {
+	return u.Client.uploadRequest(ctx, "GET", u.ID, nil)
+}
+
+// sends an upload session request for 'path' (relative to the uploads
+// resource), and returns the session status in the response, if any.
+func (p *Client) uploadRequest(ctx context.Context, method, path string, body []byte) (UploadStatus, error) {
+	var status UploadStatus
+	uri := fmt.Sprintf("%s://%s%s", p.scheme, p.hostport, uploadsPath)
+	if path != "" {
+		uri += "/" + path
+	}
+	// parts and status are idempotent
+	rbody, e := p.call(ctx, method, uri, body, method == "PUT" || method == "GET")
+	if e != nil {
+		return status, e
+	}
+	if method == "POST" || method == "GET" {
+		if e := json.Unmarshal(rbody, &status); e != nil {
+			return status, fmt.Errorf("invalid upload response - %w", e)
+		}
+	}
+	return status, nil
 }
 
 /* util */
 
-func (p *Client) httpGet(uri string) ([]byte, error) {
-	resp, e := http.Get(uri)
+// sends the request with the client token, if any.
+func (p *Client) do(req *http.Request) (*http.Response, error) {
+	if p.token != "" {
+		req.Header.Set("Authorization", "Bearer "+p.token)
+	}
+	return p.http.Do(req)
+}
+
+// sends a request and returns the response body, or the service error.
+// Calls are bounded by the client timeout, and retried on transient
+// errors if 'retry' is set. 'header' are request header name, value
+// pairs.
+func (p *Client) call(ctx context.Context, method, uri string, body []byte, retry bool, header ...string) ([]byte, error) {
+	rbody, _, _, e := p.callStatus(ctx, method, uri, body, retry, header...)
+	return rbody, e
+}
+
+// call that also returns the response status code, and whether the
+// request was retried.
+func (p *Client) callStatus(ctx context.Context, method, uri string, body []byte, retry bool, header ...string) ([]byte, int, bool, error) {
+	if p.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.timeout)
+		defer cancel()
+	}
+	for attempt := 0; ; attempt++ {
+		rbody, code, wait, e := p.roundTrip(ctx, method, uri, body, header)
+		if e == nil || !retry || wait < 0 || attempt == p.retries {
+			return rbody, code, attempt > 0, e
+		}
+		if d := p.backoffFor(attempt); d > wait {
+			wait = d
+		}
+		select {
+		case <-ctx.Done():
+			return nil, code, attempt > 0, fmt.Errorf("%w - last error - %s", ctx.Err(), e)
+		case <-time.After(wait):
+		}
+	}
+}
+
+// sends a single request. On error, also returns the min wait before
+// a retry, or -1 if the error is not transient.
+func (p *Client) roundTrip(ctx context.Context, method, uri string, body []byte, header []string) ([]byte, int, time.Duration, error) {
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+	req, e := http.NewRequestWithContext(ctx, method, uri, r)
+	if e != nil {
+		return nil, 0, -1, e
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", mimetype)
+	}
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	// transport errors are transient, unless ctx is done
+	transient := func() time.Duration {
+		if ctx.Err() != nil {
+			return -1
+		}
+		return 0
+	}
+	resp, e := p.do(req)
 	if e != nil {
-		return nil, fmt.Errorf("%s", e)
+		return nil, 0, transient(), e
 	}
 	defer resp.Body.Close()
 
-	err := responseErrorIfAny(resp)
+	rbody, e := io.ReadAll(resp.Body)
+	if e != nil {
+		return nil, resp.StatusCode, transient(), fmt.Errorf("%s - reading response - %w", resp.Status, e)
+	}
+	if e := responseErrorIfAny(resp, rbody); e != nil {
+		return nil, resp.StatusCode, retryAfter(resp), e
+	}
+	return rbody, resp.StatusCode, 0, nil
+}
+
+// returns the random backoff of retry 'attempt' (from 0), i.e. "full
+// jitter" up to min(maxBackoff, backoff*2^attempt).
+func (p *Client) backoffFor(attempt int) time.Duration {
+	d := p.maxBackoff
+	if attempt < 32 && p.backoff<<attempt < d {
+		d = p.backoff << attempt
+	}
+	if d <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int64N(int64(d)))
+}
 
-	// results
-	body, e := ioutil.ReadAll(resp.Body)
+// returns the wait asked by the service before retrying a failed
+// request, or -1 if the request should not be retried.
+func retryAfter(resp *http.Response) time.Duration {
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable,
+		http.StatusBadGateway, http.StatusGatewayTimeout:
+	default:
+		return -1
+	}
+	secs, e := strconv.Atoi(resp.Header.Get("Retry-After"))
+	if e != nil || secs < 0 {
+		return 0
+	}
+	return time.Duration(secs) * time.Second
+}
+
+func (p *Client) adminRequest(ctx context.Context, method, uri string, body io.Reader) (*http.Response, error) {
+	req, e := http.NewRequestWithContext(ctx, method, uri, body)
 	if e != nil {
-		err = fmt.Errorf("%s - with error:%s", e)
+		return nil, e
 	}
-	return body, err
+	return p.do(req)
 }
 
-func responseErrorIfAny(resp *http.Response) error {
+func (p *Client) adminPost(ctx context.Context, uri string, body io.Reader) ([]byte, error) {
+	resp, e := p.adminRequest(ctx, "POST", uri, body)
+	if e != nil {
+		return nil, e
+	}
+	defer resp.Body.Close()
+
+	rbody, e := io.ReadAll(resp.Body)
+	if e != nil {
+		return nil, e
+	}
+	if e := responseErrorIfAny(resp, rbody); e != nil {
+		return rbody, e
+	}
+	return rbody, nil
+}
+
+func (p *Client) adminStream(ctx context.Context, uri string, w io.Writer) (int64, error) {
+	resp, e := p.adminRequest(ctx, "GET", uri, nil)
+	if e != nil {
+		return 0, e
+	}
+	defer resp.Body.Close()
+
 	if resp.StatusCode > 299 {
-		return fmt.Errorf("%s", resp.Status)
+		body, _ := io.ReadAll(resp.Body)
+		return 0, responseErrorIfAny(resp, body)
+	}
+	if sw, ok := w.(store.SizedWriter); ok && resp.ContentLength >= 0 {
+		sw.SetSize(resp.ContentLength)
+	}
+	return io.Copy(w, resp.Body)
+}
+
+// returns the uri of blob 'key'.
+func (p *Client) blobUri(key store.Key) string {
+	return fmt.Sprintf("%s://%s%s", p.scheme, p.hostport, blobLocation(key))
+}
+
+// verifies the key answered by the service is 'key'.
+func verifyKey(body []byte, key store.Key) error {
+	rkey, e := store.ParseKey(strings.TrimSpace(string(body)))
+	if e != nil {
+		return fmt.Errorf("%w - invalid key response - %s", store.DataCorruptedErr, e)
+	}
+	if rkey != key {
+		return fmt.Errorf("%w - service answered key %s - expect %s", store.DataCorruptedErr, rkey, key)
 	}
 	return nil
 }
+
+// access control and admission errors of the service
+var (
+	UnauthorizedErr = errors.New("unauthorized")
+	ForbiddenErr    = errors.New("forbidden")
+	RateLimitedErr  = errors.New("rate limited")
+)
+
+// service status codes that map to a single store error. Used if the
+// response does not identify the store error. See errorHeader.
+var statusErrors = map[int]error{
+	http.StatusNotFound:              store.NotFoundErr,
+	http.StatusConflict:              store.ExistingErr,
+	http.StatusRequestEntityTooLarge: store.TooLargeErr,
+	http.StatusInsufficientStorage:   store.DiskFullErr,
+}
+
+// returns the error, if any, of the service response. store errors
+// reported by the service are returned as (wrapped) store errors.
+func responseErrorIfAny(resp *http.Response, body []byte) error {
+	if resp.StatusCode < 300 {
+		return nil
+	}
+	msg := strings.TrimSpace(string(body))
+	if err := errorFor(resp.Header.Get(errorHeader)); err != nil {
+		return wrapMessage(err, msg)
+	}
+	if err, ok := statusErrors[resp.StatusCode]; ok {
+		return wrapMessage(err, msg)
+	}
+	switch resp.StatusCode {
+	case http.StatusUnauthorized:
+		return wrapMessage(UnauthorizedErr, msg)
+	case http.StatusForbidden:
+		return wrapMessage(ForbiddenErr, msg)
+	case http.StatusTooManyRequests:
+		return wrapMessage(RateLimitedErr, msg)
+	}
+	return fmt.Errorf("%s - %s", resp.Status, msg)
+}
+
+// wraps 'err' with the service error message 'msg', which typically
+// is prefixed by err's message.
+func wrapMessage(err error, msg string) error {
+	if strings.HasPrefix(msg, err.Error()) {
+		return fmt.Errorf("%w%s", err, strings.TrimPrefix(msg, err.Error()))
+	}
+	return fmt.Errorf("%w - %s", err, msg)
+}
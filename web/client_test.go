@@ -0,0 +1,230 @@
+//    Copyright © 2016 Joubin Houshyar. All rights reserved.
+//
+//    This file is part of Frankinstore.
+//
+//    Frankinstore is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU Affero General Public License as
+//    published by the Free Software Foundation, either version 3 of
+//    the License, or (at your option) any later version.
+//
+//    Frankinstore is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU Affero General Public License for more details.
+//
+//    You should have received a copy of the GNU Affero General Public
+//    License along with Frankinstore.  If not, see <http://www.gnu.org/licenses/>.
+
+package web
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/alphazero/borisdb/store"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// returns a test server failing the first 'failures' requests with
+// status 'code', and the count of received requests.
+func startFlakyServer(t *testing.T, failures int32, code int) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var count atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if count.Add(1) <= failures {
+			http.Error(w, http.StatusText(code), code)
+			return
+		}
+		w.Write([]byte(store.KeyOf([]byte("v")).String()))
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &count
+}
+
+type countingTransport struct {
+	n atomic.Int32
+}
+
+func (t *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.n.Add(1)
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestClientRetries(t *testing.T) {
+	fast := WithRetries(2, time.Millisecond, 5*time.Millisecond)
+	cases := []struct {
+		name     string
+		failures int32
+		code     int
+		call     func(c *Client) ([]byte, error)
+		attempts int32
+		ok       bool
+	}{
+		{"get recovers", 2, http.StatusServiceUnavailable, func(c *Client) ([]byte, error) { return c.Get(store.KeyOf([]byte("v"))) }, 3, true},
+		{"put recovers", 1, http.StatusBadGateway, func(c *Client) ([]byte, error) { _, e := c.Put([]byte("v")); return nil, e }, 2, true},
+		{"get gives up", 3, http.StatusServiceUnavailable, func(c *Client) ([]byte, error) { return c.Get(store.KeyOf([]byte("v"))) }, 3, false},
+		{"get not found", 1, http.StatusNotFound, func(c *Client) ([]byte, error) { return c.Get(store.KeyOf([]byte("v"))) }, 1, false},
+		{"del not retried", 1, http.StatusServiceUnavailable, func(c *Client) ([]byte, error) { return c.Del(store.KeyOf([]byte("v"))) }, 1, false},
+	}
+	for _, c := range cases {
+		srv, count := startFlakyServer(t, c.failures, c.code)
+		client := testClient(t, srv, fast)
+		_, e := c.call(client)
+		if (e == nil) != c.ok {
+			t.Errorf("%s: error = %v", c.name, e)
+		}
+		if n := count.Load(); n != c.attempts {
+			t.Errorf("%s: attempts = %d - expect %d", c.name, n, c.attempts)
+		}
+	}
+
+	// error identities are kept
+	srv, _ := startFlakyServer(t, 1, http.StatusNotFound)
+	client := testClient(t, srv)
+	if _, e := client.Get(store.Key{}); !errors.Is(e, store.NotFoundErr) {
+		t.Errorf("get error = %v - expect NotFoundErr", e)
+	}
+}
+
+// transport that records the method and path of requests.
+type recordingTransport struct {
+	requests []string
+}
+
+func (t *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.requests = append(t.requests, req.Method+" "+req.URL.Path)
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestClientDel(t *testing.T) {
+	_, srv := startTestService(t, Options{})
+	transport := &recordingTransport{}
+	client := testClient(t, srv, WithTransport(transport))
+	key, _ := client.Put([]byte("blob"))
+
+	if v, e := client.Del(key); e != nil || string(v) != "blob" {
+		t.Errorf("Del = %q, %v - expect blob", v, e)
+	}
+	if _, e := client.Del(key); !errors.Is(e, store.NotFoundErr) {
+		t.Errorf("Del deleted error = %v - expect NotFoundErr", e)
+	}
+	uri := "DELETE " + blobsPath + "/" + key.String()
+	if n := len(transport.requests); n != 3 || transport.requests[1] != uri || transport.requests[2] != uri {
+		t.Errorf("requests = %q - expect %q", transport.requests, uri)
+	}
+
+	// the deleted blob is answered if asked
+	key, _ = client.Put([]byte("blob"))
+	if resp, body := do(t, "DELETE", srv.URL+blobsPath+"/"+key.String(), nil); resp.StatusCode != http.StatusNoContent || body != "" {
+		t.Errorf("DELETE = %d %q - expect 204", resp.StatusCode, body)
+	}
+}
+
+func TestClientOptions(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+		w.Write([]byte("ok"))
+	}))
+	t.Cleanup(srv.Close)
+
+	transport := &countingTransport{}
+	client := testClient(t, srv, WithTransport(transport), WithTimeout(20*time.Millisecond), WithRetries(0, 0, 0))
+	if _, e := client.Get(store.Key{}); !errors.Is(e, context.DeadlineExceeded) {
+		t.Errorf("get error = %v - expect DeadlineExceeded", e)
+	}
+	if n := transport.n.Load(); n != 1 {
+		t.Errorf("transport requests = %d - expect 1", n)
+	}
+
+	if _, e := NewClient("127.0.0.1", 1, WithRetries(-1, 0, 0)); e == nil {
+		t.Error("expect error for negative retries")
+	}
+}
+
+func TestClientVerify(t *testing.T) {
+	// a service answering a corrupted blob and a wrong key
+	blob := []byte("the blob")
+	key := store.KeyOf(blob)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == "PUT" {
+			w.Write([]byte(store.KeyOf([]byte("other")).String()))
+			return
+		}
+		w.Write([]byte("the blub"))
+	}))
+	t.Cleanup(srv.Close)
+
+	if _, e := testClient(t, srv).Get(key); e != nil {
+		t.Errorf("unverified get error = %v", e)
+	}
+	client := testClient(t, srv, WithVerify(true))
+	if _, e := client.Get(key); !errors.Is(e, store.DataCorruptedErr) {
+		t.Errorf("verified get error = %v - expect DataCorruptedErr", e)
+	}
+	if _, e := client.Put(blob); !errors.Is(e, store.DataCorruptedErr) {
+		t.Errorf("put error = %v - expect DataCorruptedErr", e)
+	}
+
+	// against the service
+	_, srv = startTestService(t, Options{})
+	client = testClient(t, srv, WithVerify(true))
+	k, e := client.Put(blob)
+	if e != nil || k != key {
+		t.Fatalf("put = %s, %v - expect %s", k, e, key)
+	}
+	if v, e := client.Get(key); e != nil || string(v) != string(blob) {
+		t.Errorf("get = %q, %v", v, e)
+	}
+	if _, e := client.Put(blob); e != nil {
+		t.Errorf("put existing error = %v", e)
+	}
+}
+
+// type fails all blob reads with err.
+type errStore struct {
+	store.Store
+	err error
+}
+
+func (p errStore) GetContext(ctx context.Context, key store.Key) ([]byte, error) {
+	return nil, p.err
+}
+
+func (p errStore) ViewContext(ctx context.Context, key store.Key, fn func([]byte) error) error {
+	return p.err
+}
+
+// store errors are identified by the service, and mapped by the client.
+func TestErrorMapping(t *testing.T) {
+	for _, tc := range []struct {
+		err    error
+		status int
+		code   string
+	}{
+		{store.NotFoundErr, http.StatusNotFound, "not-found"},
+		{store.ExistingErr, http.StatusConflict, "existing"},
+		{store.TooLargeErr, http.StatusRequestEntityTooLarge, "too-large"},
+		{store.InternalErr, http.StatusInternalServerError, "internal"},
+		{store.DataCorruptedErr, http.StatusInternalServerError, "data-corrupted"},
+		{store.UnavailableErr, http.StatusServiceUnavailable, "unavailable"},
+		{store.BusyErr, http.StatusServiceUnavailable, "busy"},
+		{store.ClosedErr, http.StatusServiceUnavailable, "closed"},
+	} {
+		srv := serveTestDb(t, errStore{openTestDb(t), fmt.Errorf("err - test - %w", tc.err)}, Options{})
+		key := store.KeyOf([]byte("key"))
+
+		resp, body := do(t, "GET", srv.URL+blobsPath+"/"+key.String(), nil)
+		if resp.StatusCode != tc.status || resp.Header.Get(errorHeader) != tc.code {
+			t.Errorf("%s: GET = %d %s %q; want %d %s", tc.err, resp.StatusCode, resp.Header.Get(errorHeader), body, tc.status, tc.code)
+		}
+
+		client := testClient(t, srv, WithRetries(0, 0, 0))
+		if _, e := client.Get(key); !errors.Is(e, tc.err) {
+			t.Errorf("%s: client Get error = %v", tc.err, e)
+		}
+	}
+}
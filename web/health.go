@@ -0,0 +1,144 @@
+//    Copyright © 2016 Joubin Houshyar. All rights reserved.
+//
+//    This file is part of Frankinstore.
+//
+//    Frankinstore is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU Affero General Public License as
+//    published by the Free Software Foundation, either version 3 of
+//    the License, or (at your option) any later version.
+//
+//    Frankinstore is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU Affero General Public License for more details.
+//
+//    You should have received a copy of the GNU Affero General Public
+//    License along with Frankinstore.  If not, see <http://www.gnu.org/licenses/>.
+
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/alphazero/borisdb/store"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+/// service state /////////////////////////////////////////////////////////////
+
+// service lifecycle states reported by the readiness check.
+const (
+	stateStarting int32 = iota
+	stateReady
+	stateStopping
+)
+
+var stateNames = []string{"starting", "ready", "stopping"}
+
+// max duration of the store readiness check
+const readyCheckTimeout = 2 * time.Second
+
+/// health checks /////////////////////////////////////////////////////////////
+
+// result of a single readiness check
+type checkResult struct {
+	Name     string `json:"name"`
+	OK       bool   `json:"ok"`
+	Error    string `json:"error,omitempty"`
+	Duration string `json:"duration"`
+}
+
+// response of the health endpoints
+type healthResponse struct {
+	Status string        `json:"status"`
+	Checks []checkResult `json:"checks,omitempty"`
+}
+
+// runs check fn 'name' and records the outcome.
+func runCheck(name string, fn func() error) checkResult {
+	start := time.Now()
+	r := checkResult{Name: name, OK: true}
+	if e := fn(); e != nil {
+		r.OK = false
+		r.Error = e.Error()
+	}
+	r.Duration = time.Since(start).String()
+	return r
+}
+
+func writeHealth(w http.ResponseWriter, code int, resp healthResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// returns a new http request handler function for the liveness endpoint.
+//
+// The returned handler always answers 200 while the process serves http.
+func getHealthzHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, req *http.Request) {
+		/* assert constraints */
+		if req.Method != "GET" && req.Method != "HEAD" {
+			onError(w, http.StatusBadRequest, "expect GET method - have %s", req.Method)
+			return
+		}
+		writeHealth(w, http.StatusOK, healthResponse{Status: "alive"})
+	}
+}
+
+// returns a new http request handler function for the readiness endpoint.
+//
+// The returned handler checks the service state, runs a store read
+// transaction and, if configured, checks free disk space against
+// opts.MinDiskFree. It answers 200 if all checks pass, 503 otherwise.
+func getReadyzHandler(db store.Store, opts Options, state *atomic.Int32) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, req *http.Request) {
+		/* assert constraints */
+		if req.Method != "GET" && req.Method != "HEAD" {
+			onError(w, http.StatusBadRequest, "expect GET method - have %s", req.Method)
+			return
+		}
+
+		// process request
+		checks := []checkResult{
+			runCheck("service", func() error {
+				if s := state.Load(); s != stateReady {
+					return fmt.Errorf("service is %s", stateNames[s])
+				}
+				return nil
+			}),
+			runCheck("store", func() error {
+				ctx, cancel := context.WithTimeout(req.Context(), readyCheckTimeout)
+				defer cancel()
+				return db.CheckContext(ctx)
+			}),
+		}
+		if opts.MinDiskFree > 0 {
+			checks = append(checks, runCheck("disk", func() error {
+				free, e := store.DiskFree(opts.DbPath)
+				if e != nil {
+					return e
+				}
+				if free < opts.MinDiskFree {
+					return fmt.Errorf("free:%d - min:%d", free, opts.MinDiskFree)
+				}
+				return nil
+			}))
+		}
+
+		// post response
+		resp := healthResponse{Status: "ready", Checks: checks}
+		code := http.StatusOK
+		for _, c := range checks {
+			if !c.OK {
+				resp.Status = "not ready"
+				code = http.StatusServiceUnavailable
+			}
+		}
+		writeHealth(w, code, resp)
+	}
+}
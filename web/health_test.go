@@ -0,0 +1,100 @@
+//    Copyright © 2016 Joubin Houshyar. All rights reserved.
+//
+//    This file is part of Frankinstore.
+//
+//    Frankinstore is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU Affero General Public License as
+//    published by the Free Software Foundation, either version 3 of
+//    the License, or (at your option) any later version.
+//
+//    Frankinstore is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU Affero General Public License for more details.
+//
+//    You should have received a copy of the GNU Affero General Public
+//    License along with Frankinstore.  If not, see <http://www.gnu.org/licenses/>.
+
+package web
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// gets /readyz and returns the status code and decoded response.
+func getReadyz(t *testing.T, uri string) (int, healthResponse) {
+	t.Helper()
+	resp, body := do(t, "GET", uri+"/readyz", nil)
+	var hr healthResponse
+	if e := json.Unmarshal([]byte(body), &hr); e != nil {
+		t.Fatalf("readyz response %q: %v", body, e)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+		t.Errorf("readyz Content-Type = %q", ct)
+	}
+	return resp.StatusCode, hr
+}
+
+// returns the named check of 'hr'.
+func checkOf(hr healthResponse, name string) checkResult {
+	for _, c := range hr.Checks {
+		if c.Name == name {
+			return c
+		}
+	}
+	return checkResult{Name: name, Error: "missing"}
+}
+
+func TestReadyz(t *testing.T) {
+	db, srv := startTestService(t, Options{})
+	code, hr := getReadyz(t, srv.URL)
+	if code != http.StatusOK || hr.Status != "ready" || !checkOf(hr, "service").OK || !checkOf(hr, "store").OK {
+		t.Fatalf("readyz = %d %+v; want 200 ready", code, hr)
+	}
+
+	// not ready while a backup is in progress
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		_, e := db.Backup(pw)
+		pw.CloseWithError(e)
+		done <- e
+	}()
+	if _, e := pr.Read(make([]byte, 1)); e != nil {
+		t.Fatal(e)
+	}
+	code, hr = getReadyz(t, srv.URL)
+	if c := checkOf(hr, "store"); code != http.StatusServiceUnavailable || hr.Status != "not ready" || c.OK || !strings.Contains(c.Error, "maintenance") {
+		t.Errorf("readyz during backup = %d %+v; want 503 not ready", code, hr)
+	}
+	io.Copy(io.Discard, pr)
+	if e := <-done; e != nil {
+		t.Fatal(e)
+	}
+	if code, hr = getReadyz(t, srv.URL); code != http.StatusOK {
+		t.Errorf("readyz after backup = %d %+v; want 200", code, hr)
+	}
+
+	// not ready if short of disk space
+	_, srv = startTestService(t, Options{DbPath: t.TempDir(), MinDiskFree: 1 << 62})
+	code, hr = getReadyz(t, srv.URL)
+	if code != http.StatusServiceUnavailable || checkOf(hr, "disk").OK {
+		t.Errorf("readyz short of disk = %d %+v; want 503", code, hr)
+	}
+}
+
+func TestReadyzStopping(t *testing.T) {
+	svc, uri := runTestService(t, openTestDb(t), Options{})
+	if code, hr := getReadyz(t, uri); code != http.StatusOK {
+		t.Fatalf("readyz = %d %+v; want 200", code, hr)
+	}
+	svc.state.Store(stateStopping)
+	code, hr := getReadyz(t, uri)
+	if c := checkOf(hr, "service"); code != http.StatusServiceUnavailable || c.OK || !strings.Contains(c.Error, "stopping") {
+		t.Errorf("readyz stopping = %d %+v; want 503", code, hr)
+	}
+}
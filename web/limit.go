@@ -0,0 +1,172 @@
+//    Copyright © 2016 Joubin Houshyar. All rights reserved.
+//
+//    This file is part of Frankinstore.
+//
+//    Frankinstore is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU Affero General Public License as
+//    published by the Free Software Foundation, either version 3 of
+//    the License, or (at your option) any later version.
+//
+//    Frankinstore is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU Affero General Public License for more details.
+//
+//    You should have received a copy of the GNU Affero General Public
+//    License along with Frankinstore.  If not, see <http://www.gnu.org/licenses/>.
+
+package web
+
+import (
+	"context"
+	"github.com/alphazero/borisdb/metrics"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// rate limiting metrics are registered with metrics.Default.
+var rateLimited = metrics.Default.Counter("borisdb_http_rate_limited_total",
+	"Count of requests rejected by per-client rate limits, by kind.", "kind")
+
+// idle client buckets are evicted after this duration.
+const limiterIdleTTL = 10 * time.Minute
+
+/// client identity ///////////////////////////////////////////////////////////
+
+type clientKey struct{}
+
+// returns a copy of ctx carrying the authenticated client id.
+func withClient(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, clientKey{}, id)
+}
+
+// returns the rate limiting identity of 'req': the authenticated client
+// id if any, otherwise the remote ip.
+func clientIdentity(req *http.Request) string {
+	id, _ := req.Context().Value(clientKey{}).(string)
+	return identity(id, req.RemoteAddr)
+}
+
+// returns the rate limiting identity of authenticated client 'id', or
+// if blank, of remote address 'addr'.
+func identity(id, addr string) string {
+	if id != "" {
+		return "token:" + id
+	}
+	host, _, e := net.SplitHostPort(addr)
+	if e != nil {
+		host = addr
+	}
+	return "ip:" + host
+}
+
+/// token buckets /////////////////////////////////////////////////////////////
+
+// type rate limits requests per client identity with token buckets
+// of 'rate' tokens per second and capacity 'burst'.
+type rateLimiter struct {
+	kind      string // metrics label
+	rate      float64
+	burst     float64
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+// per-client read and write limits, shared by the http and RESP front
+// ends. Limiters are nil if not configured.
+type rateLimits struct {
+	read  *rateLimiter
+	write *rateLimiter
+}
+
+func newRateLimits(opts Options) rateLimits {
+	return rateLimits{
+		read:  newRateLimiter("read", opts.ReadRate, opts.ReadBurst),
+		write: newRateLimiter("write", opts.WriteRate, opts.WriteBurst),
+	}
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// returns a new limiter, or nil if 'rate' is zerovalue. 'burst' defaults
+// to the rate, rounded up.
+func newRateLimiter(kind string, rate float64, burst int) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	if burst <= 0 {
+		burst = int(math.Ceil(rate))
+	}
+	l := &rateLimiter{
+		kind:    kind,
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: make(map[string]*tokenBucket),
+	}
+	metrics.Default.GaugeFunc("borisdb_http_"+kind+"_rate_limit",
+		"Configured per-client "+kind+" requests per second.", func() float64 { return l.rate })
+	metrics.Default.GaugeFunc("borisdb_http_"+kind+"_rate_burst",
+		"Configured per-client "+kind+" burst size.", func() float64 { return l.burst })
+	metrics.Default.GaugeFunc("borisdb_http_"+kind+"_rate_clients",
+		"Count of clients tracked by the "+kind+" rate limiter.", func() float64 {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			return float64(len(l.buckets))
+		})
+	return l
+}
+
+// takes a token of client 'id' at time 'now'. Returns false and the
+// wait until the next token if the bucket is empty.
+func (l *rateLimiter) allow(id string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.lastSweep) > limiterIdleTTL {
+		for k, b := range l.buckets {
+			if now.Sub(b.last) > limiterIdleTTL {
+				delete(l.buckets, k)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	b, ok := l.buckets[id]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[id] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens < 1 {
+		wait := time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+		return false, wait
+	}
+	b.tokens--
+	return true, 0
+}
+
+// convenience wrapper for rate limited handlers. Requests exceeding the
+// limit of their client are rejected with 429 and Retry-After.
+func limited(l *rateLimiter, fn http.HandlerFunc) http.HandlerFunc {
+	if l == nil {
+		return fn
+	}
+	return func(w http.ResponseWriter, req *http.Request) {
+		if ok, wait := l.allow(clientIdentity(req), time.Now()); !ok {
+			rateLimited.With(l.kind).Inc()
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			onError(w, http.StatusTooManyRequests, "%s rate limit exceeded", l.kind)
+			return
+		}
+		fn(w, req)
+	}
+}
@@ -0,0 +1,78 @@
+//    Copyright © 2016 Joubin Houshyar. All rights reserved.
+//
+//    This file is part of Frankinstore.
+//
+//    Frankinstore is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU Affero General Public License as
+//    published by the Free Software Foundation, either version 3 of
+//    the License, or (at your option) any later version.
+//
+//    Frankinstore is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU Affero General Public License for more details.
+//
+//    You should have received a copy of the GNU Affero General Public
+//    License along with Frankinstore.  If not, see <http://www.gnu.org/licenses/>.
+
+package web
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter("test", 2, 3)
+	now := time.Now()
+
+	for i := 0; i < 3; i++ {
+		if ok, _ := l.allow("a", now); !ok {
+			t.Fatalf("request %d within burst rejected", i)
+		}
+	}
+	ok, wait := l.allow("a", now)
+	if ok || wait != 500*time.Millisecond {
+		t.Errorf("request over burst = %t, %s; want false, 500ms", ok, wait)
+	}
+	if ok, _ := l.allow("b", now); !ok {
+		t.Errorf("request of other client rejected")
+	}
+	if ok, _ := l.allow("a", now.Add(500*time.Millisecond)); !ok {
+		t.Errorf("request after refill rejected")
+	}
+
+	// idle buckets are evicted
+	l.allow("c", now.Add(2*limiterIdleTTL))
+	if n := len(l.buckets); n != 1 {
+		t.Errorf("tracked clients after idle ttl = %d; want 1", n)
+	}
+}
+
+func TestLimited(t *testing.T) {
+	if newRateLimiter("test", 0, 0) != nil {
+		t.Fatalf("zerovalue rate limiter is not nil")
+	}
+	fn := limited(newRateLimiter("test", 1, 1), okHandler)
+
+	req := httptest.NewRequest("GET", "/", nil)
+	w := httptest.NewRecorder()
+	fn(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("first request status = %d; want 200", w.Code)
+	}
+	w = httptest.NewRecorder()
+	fn(w, req)
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "1" {
+		t.Errorf("second request = %d, Retry-After %q; want 429, 1", w.Code, w.Header().Get("Retry-After"))
+	}
+
+	// authenticated clients are limited by token, not by ip
+	w = httptest.NewRecorder()
+	fn(w, req.WithContext(withClient(req.Context(), "token-id")))
+	if w.Code != http.StatusOK {
+		t.Errorf("request of token client status = %d; want 200", w.Code)
+	}
+}
@@ -0,0 +1,167 @@
+//    Copyright © 2016 Joubin Houshyar. All rights reserved.
+//
+//    This file is part of Frankinstore.
+//
+//    Frankinstore is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU Affero General Public License as
+//    published by the Free Software Foundation, either version 3 of
+//    the License, or (at your option) any later version.
+//
+//    Frankinstore is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU Affero General Public License for more details.
+//
+//    You should have received a copy of the GNU Affero General Public
+//    License along with Frankinstore.  If not, see <http://www.gnu.org/licenses/>.
+
+package web
+
+import (
+	"github.com/alphazero/borisdb/logging"
+	"github.com/alphazero/borisdb/metrics"
+	"log/slog"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// request id header; taken from the request if present and valid,
+// and always echoed in the response.
+const requestIDHeader = "X-Request-ID"
+
+// http metrics are registered with metrics.Default.
+var (
+	httpRequests = metrics.Default.Counter("borisdb_http_requests_total",
+		"Count of http requests by handler and status code.", "handler", "code")
+	httpDuration = metrics.Default.Histogram("borisdb_http_request_duration_seconds",
+		"Latency of http requests by handler.", metrics.DefaultBuckets, "handler")
+)
+
+// wraps handler fn to record request metrics under label 'name', tag
+// the request with a request id, and write an access log record.
+func instrument(name string, fn http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		id := req.Header.Get(requestIDHeader)
+		if !validRequestID(id) {
+			id = logging.NewRequestID()
+		}
+		w.Header().Set(requestIDHeader, id)
+		ctx := logging.WithRequestID(req.Context(), id)
+
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		fn(sw, req.WithContext(ctx))
+
+		elapsed := time.Since(start)
+		httpRequests.With(name, strconv.Itoa(sw.status)).Inc()
+		httpDuration.With(name).Observe(elapsed.Seconds())
+
+		key := sw.key
+		if key == "" && (name == "get" || name == "del" || strings.HasPrefix(req.URL.Path, blobsPath+"/")) {
+			key = path.Base(req.URL.Path)
+		}
+		logging.FromContext(ctx).LogAttrs(ctx, slog.LevelInfo, "access",
+			slog.String("handler", name),
+			slog.String("method", req.Method),
+			slog.String("path", req.URL.Path),
+			slog.String("key", key),
+			slog.Int("status", sw.status),
+			slog.Int64("bytes", sw.bytes),
+			slog.Duration("duration", elapsed),
+			slog.String("remote", req.RemoteAddr),
+			slog.String("client", sw.client),
+		)
+	}
+}
+
+// accept client supplied ids of reasonable length and charset only, as
+// they are echoed in logs and headers.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-' || c == '_' || c == '.':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// annotates the access log record of the request with 'key', for
+// handlers where the key is not in the request path, e.g. set.
+func logKey(w http.ResponseWriter, key string) {
+	if sw, ok := w.(*statusWriter); ok {
+		sw.key = key
+	}
+}
+
+// annotates the access log record of the request with the id of the
+// authenticated client.
+func logClient(w http.ResponseWriter, id string) {
+	if sw, ok := w.(*statusWriter); ok {
+		sw.client = id
+	}
+}
+
+// http.ResponseWriter that records the response status code and
+// number of body bytes written.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	wrote  bool
+	bytes  int64
+	key    string
+	client string
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if !w.wrote {
+		w.status = code
+		w.wrote = true
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	w.wrote = true
+	n, e := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, e
+}
+
+// exposes the wrapped writer to http.ResponseController, e.g. to flush
+// or set deadlines.
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// supports streaming responses, e.g. backups and exports.
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// returns a new http request handler function for the metrics endpoint.
+//
+// The returned handler writes metrics.Default in the Prometheus text
+// exposition format.
+func getMetricsHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, req *http.Request) {
+		/* assert constraints */
+		if req.Method != "GET" {
+			onError(w, http.StatusBadRequest, "expect GET method - have %s", req.Method)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		metrics.Default.WriteTo(w)
+	}
+}
@@ -0,0 +1,295 @@
+//    Copyright © 2016 Joubin Houshyar. All rights reserved.
+//
+//    This file is part of Frankinstore.
+//
+//    Frankinstore is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU Affero General Public License as
+//    published by the Free Software Foundation, either version 3 of
+//    the License, or (at your option) any later version.
+//
+//    Frankinstore is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU Affero General Public License for more details.
+//
+//    You should have received a copy of the GNU Affero General Public
+//    License along with Frankinstore.  If not, see <http://www.gnu.org/licenses/>.
+
+package web
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/alphazero/borisdb/store"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+/// remote store //////////////////////////////////////////////////////////////
+
+// RemoteStore is a store.Store backed by a borisdb service. Errors
+// have the same identities as errors of the local store, e.g.
+// NotFoundErr, and ops stop once their context is done.
+//
+// Backup, ForEach (which reads an export stream) and Compact are
+// admin operations, and require an admin token. See Client.SetToken.
+type RemoteStore struct {
+	client *Client
+	closed atomic.Bool
+}
+
+// assert RemoteStore is a store.Store
+var _ store.Store = (*RemoteStore)(nil)
+
+// NewRemoteStore returns a store backed by the service of 'client'.
+func NewRemoteStore(client *Client) *RemoteStore {
+	return &RemoteStore{client: client}
+}
+
+// OpenStore opens the store at 'location', which is either the path of
+// a local db file, opened with 'opts', or the url of a borisdb service,
+// e.g. http://localhost:5722 or https://<token>@host:5722, using a
+// client with options 'copts'.
+func OpenStore(location string, opts *store.Options, copts ...ClientOption) (store.Store, error) {
+	if !strings.HasPrefix(location, "http://") && !strings.HasPrefix(location, "https://") {
+		return store.OpenDb(location, opts)
+	}
+
+	u, e := url.Parse(location)
+	if e != nil {
+		return nil, fmt.Errorf("err - OpenStore - %w", e)
+	}
+	host, portstr, e := net.SplitHostPort(u.Host)
+	if e != nil {
+		return nil, fmt.Errorf("err - OpenStore - %w", e)
+	}
+	port, e := strconv.Atoi(portstr)
+	if e != nil {
+		return nil, fmt.Errorf("err - OpenStore - invalid port %q", portstr)
+	}
+	client, e := NewClient(host, port, copts...)
+	if e != nil {
+		return nil, fmt.Errorf("err - OpenStore - %w", e)
+	}
+	if u.Scheme == "https" {
+		client.SetTLS(&tls.Config{MinVersion: tls.VersionTLS12})
+	}
+	if u.User != nil {
+		client.SetToken(u.User.Username())
+	}
+	return NewRemoteStore(client), nil
+}
+
+// returns ClosedErr once the store is closed.
+func (p *RemoteStore) checkOpen() error {
+	if p.closed.Load() {
+		return fmt.Errorf("%w - remote %s", store.ClosedErr, p.client.hostport)
+	}
+	return nil
+}
+
+/// interface: Store //////////////////////////////////////////////////////////
+
+// support Store.Close
+// closes idle connections to the service. The service is not affected.
+func (p *RemoteStore) Close() error {
+	if p.closed.Swap(true) {
+		return nil
+	}
+	p.client.http.CloseIdleConnections()
+	return nil
+}
+
+// support Store.Info
+func (p *RemoteStore) Info() ([]byte, error) {
+	return p.InfoContext(context.Background())
+}
+
+// support Store.InfoContext
+func (p *RemoteStore) InfoContext(ctx context.Context) ([]byte, error) {
+	if e := p.checkOpen(); e != nil {
+		return nil, e
+	}
+	return p.client.InfoContext(ctx)
+}
+
+// support Store.Backup
+func (p *RemoteStore) Backup(w io.Writer) (int64, error) {
+	return p.BackupContext(context.Background(), w)
+}
+
+// support Store.BackupContext
+func (p *RemoteStore) BackupContext(ctx context.Context, w io.Writer) (int64, error) {
+	if e := p.checkOpen(); e != nil {
+		return 0, e
+	}
+	return p.client.BackupContext(ctx, w)
+}
+
+// support Store.ForEach
+func (p *RemoteStore) ForEach(fn func(store.Key, []byte) error) error {
+	return p.ForEachContext(context.Background(), fn)
+}
+
+// support Store.ForEachContext
+// blobs are read from an export stream of the service, and verified
+// as they are read.
+func (p *RemoteStore) ForEachContext(ctx context.Context, fn func(store.Key, []byte) error) error {
+	if e := p.checkOpen(); e != nil {
+		return e
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	pr, pw := io.Pipe()
+	exported := make(chan error, 1)
+	go func() {
+		_, e := p.client.ExportContext(ctx, pw)
+		pw.CloseWithError(e)
+		exported <- e
+	}()
+
+	var fnErr error
+	e := store.ReadArchive(ctx, pr, 0, func(key store.Key, val []byte) error {
+		fnErr = fn(key, val)
+		return fnErr
+	})
+	if e == nil {
+		io.Copy(io.Discard, pr) // end of the tar stream
+	}
+	cancel()
+	pr.Close()
+	xe := <-exported
+
+	// errors of fn, then of the export request, take precedence
+	switch {
+	case fnErr != nil:
+		return fnErr
+	case xe != nil && !errors.Is(xe, io.ErrClosedPipe):
+		return xe
+	}
+	return e
+}
+
+// support Store.Compact
+func (p *RemoteStore) Compact() (before, after int64, err error) {
+	return p.CompactContext(context.Background())
+}
+
+// support Store.CompactContext
+func (p *RemoteStore) CompactContext(ctx context.Context) (before, after int64, err error) {
+	if e := p.checkOpen(); e != nil {
+		return 0, 0, e
+	}
+	body, e := p.client.CompactContext(ctx)
+	if e != nil {
+		return 0, 0, e
+	}
+	if _, e := fmt.Sscanf(string(body), "compact: before:%d - after:%d", &before, &after); e != nil {
+		return 0, 0, fmt.Errorf("err - Compact - %w - invalid response %q", store.InternalErr, body)
+	}
+	return before, after, nil
+}
+
+// support Store.Check
+func (p *RemoteStore) Check() error {
+	return p.CheckContext(context.Background())
+}
+
+// support Store.CheckContext
+// the check is the readiness check of the service. A service that is
+// not ready is reported as UnavailableErr.
+func (p *RemoteStore) CheckContext(ctx context.Context) error {
+	if e := p.checkOpen(); e != nil {
+		return e
+	}
+	uri := fmt.Sprintf("%s://%s/readyz", p.client.scheme, p.client.hostport)
+	_, code, _, e := p.client.callStatus(ctx, "GET", uri, nil, false)
+	if e != nil && code == http.StatusServiceUnavailable &&
+		!errors.Is(e, store.UnavailableErr) && !errors.Is(e, store.ClosedErr) {
+		return fmt.Errorf("err - Check - %w - %s", store.UnavailableErr, e)
+	}
+	if e != nil {
+		return fmt.Errorf("err - Check - %w", e)
+	}
+	return nil
+}
+
+/// interface: KVStore ////////////////////////////////////////////////////////
+
+// support KVStore.Put
+func (p *RemoteStore) Put(v []byte) (store.Key, error) {
+	return p.PutContext(context.Background(), v)
+}
+
+// support KVStore.PutContext
+// returns ExistingErr (and the key) if the blob is already stored. Puts
+// retried after transient errors may have stored the blob themselves,
+// and do not return ExistingErr.
+func (p *RemoteStore) PutContext(ctx context.Context, v []byte) (store.Key, error) {
+	if e := p.checkOpen(); e != nil {
+		return store.Key{}, e
+	}
+	if v == nil {
+		return store.Key{}, store.NilValueErr
+	}
+	if len(v) == 0 {
+		return store.Key{}, store.ZeroValueErr
+	}
+	key, created, e := p.client.put(ctx, v)
+	if e != nil {
+		return key, e
+	}
+	if !created {
+		return key, fmt.Errorf("%w - %s", store.ExistingErr, key)
+	}
+	return key, nil
+}
+
+// support KVStore.Get
+func (p *RemoteStore) Get(key store.Key) ([]byte, error) {
+	return p.GetContext(context.Background(), key)
+}
+
+// support KVStore.GetContext
+func (p *RemoteStore) GetContext(ctx context.Context, key store.Key) ([]byte, error) {
+	if e := p.checkOpen(); e != nil {
+		return nil, e
+	}
+	return p.client.GetContext(ctx, key)
+}
+
+// support KVStore.View
+func (p *RemoteStore) View(key store.Key, fn func([]byte) error) error {
+	return p.ViewContext(context.Background(), key, fn)
+}
+
+// support KVStore.ViewContext
+// fn is called with a copy of the value, as read from the service.
+func (p *RemoteStore) ViewContext(ctx context.Context, key store.Key, fn func([]byte) error) error {
+	v, e := p.GetContext(ctx, key)
+	if e != nil {
+		return e
+	}
+	return fn(v)
+}
+
+// support KVStore.Del
+func (p *RemoteStore) Del(key store.Key) ([]byte, error) {
+	return p.DelContext(context.Background(), key)
+}
+
+// support KVStore.DelContext
+func (p *RemoteStore) DelContext(ctx context.Context, key store.Key) ([]byte, error) {
+	if e := p.checkOpen(); e != nil {
+		return nil, e
+	}
+	return p.client.DelContext(ctx, key)
+}
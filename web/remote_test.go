@@ -0,0 +1,117 @@
+//    Copyright © 2016 Joubin Houshyar. All rights reserved.
+//
+//    This file is part of Frankinstore.
+//
+//    Frankinstore is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU Affero General Public License as
+//    published by the Free Software Foundation, either version 3 of
+//    the License, or (at your option) any later version.
+//
+//    Frankinstore is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU Affero General Public License for more details.
+//
+//    You should have received a copy of the GNU Affero General Public
+//    License along with Frankinstore.  If not, see <http://www.gnu.org/licenses/>.
+
+package web
+
+import (
+	"errors"
+	"github.com/alphazero/borisdb/store"
+	"github.com/alphazero/borisdb/store/storetest"
+	"net/http"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRemoteStoreConformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) store.Store {
+		_, srv := startTestService(t, Options{AdminToken: "secret"})
+		client := testClient(t, srv, WithVerify(true))
+		client.SetToken("secret")
+		s := NewRemoteStore(client)
+		t.Cleanup(func() { s.Close() })
+		return s
+	})
+}
+
+func TestRemoteStoreErrors(t *testing.T) {
+	_, srv := startTestService(t, Options{AdminToken: "secret", ReadOnly: true})
+	s := NewRemoteStore(testClient(t, srv))
+
+	if _, e := s.Put([]byte("blob")); !errors.Is(e, store.ReadOnlyErr) {
+		t.Errorf("read-only Put error = %v - expect ReadOnlyErr", e)
+	}
+	// admin ops require an admin token
+	if e := s.ForEach(func(store.Key, []byte) error { return nil }); !errors.Is(e, UnauthorizedErr) {
+		t.Errorf("ForEach error = %v - expect UnauthorizedErr", e)
+	}
+}
+
+// transport that loses the response of its first request.
+type lossyTransport struct {
+	n atomic.Int32
+}
+
+func (t *lossyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, e := http.DefaultTransport.RoundTrip(req)
+	if e == nil && t.n.Add(1) == 1 {
+		resp.Body.Close()
+		return nil, errors.New("connection reset")
+	}
+	return resp, e
+}
+
+// puts retried after their blob was stored are not reported as existing.
+func TestRemoteStorePutRetried(t *testing.T) {
+	db, srv := startTestService(t, Options{})
+	transport := &lossyTransport{}
+	s := NewRemoteStore(testClient(t, srv, WithTransport(transport), WithRetries(2, time.Millisecond, 5*time.Millisecond)))
+	defer s.Close()
+
+	key, e := s.Put([]byte("blob"))
+	if e != nil {
+		t.Fatalf("Put error = %v", e)
+	}
+	if n := transport.n.Load(); n != 2 {
+		t.Errorf("Put attempts = %d - expect 2", n)
+	}
+	if _, e := db.Get(key); e != nil {
+		t.Errorf("Get error = %v", e)
+	}
+	if _, e := s.Put([]byte("blob")); !errors.Is(e, store.ExistingErr) {
+		t.Errorf("Put existing error = %v - expect ExistingErr", e)
+	}
+}
+
+func TestOpenStore(t *testing.T) {
+	dir := t.TempDir()
+	local, e := OpenStore(filepath.Join(dir, "test.db"), nil)
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer local.Close()
+	if _, ok := local.(*RemoteStore); ok {
+		t.Errorf("OpenStore(path) = %T - expect local store", local)
+	}
+
+	_, srv := startTestService(t, Options{AdminToken: "secret", AuthRequired: true})
+	remote, e := OpenStore("http://secret@"+srv.Listener.Addr().String(), nil)
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer remote.Close()
+	if _, e := remote.Put([]byte("blob")); e != nil {
+		t.Errorf("remote Put error = %v", e)
+	}
+
+	for _, location := range []string{"http://localhost", "http://localhost:port", "https://%zz"} {
+		if _, e := OpenStore(location, nil); e == nil {
+			t.Errorf("OpenStore(%q) expect error", location)
+		}
+	}
+}
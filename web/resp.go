@@ -0,0 +1,800 @@
+//    Copyright © 2016 Joubin Houshyar. All rights reserved.
+//
+//    This file is part of Frankinstore.
+//
+//    Frankinstore is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU Affero General Public License as
+//    published by the Free Software Foundation, either version 3 of
+//    the License, or (at your option) any later version.
+//
+//    Frankinstore is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU Affero General Public License for more details.
+//
+//    You should have received a copy of the GNU Affero General Public
+//    License along with Frankinstore.  If not, see <http://www.gnu.org/licenses/>.
+
+package web
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/alphazero/borisdb/logging"
+	"github.com/alphazero/borisdb/metrics"
+	"github.com/alphazero/borisdb/store"
+	"io"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/// RESP front end ////////////////////////////////////////////////////////////
+
+// The RESP (redis serialization protocol, version 2) front end serves
+// blobs to redis clients, e.g. redis-cli, on Options.RESPPort:
+//
+//	SET <value>           stores the value. Replies the key.
+//	SET <key> <value>     stores the value, which must hash to key.
+//	GET <key>             replies the value, or nil.
+//	MGET <key> ...        replies the values, or nils.
+//	EXISTS <key> ...      replies the count of existing keys.
+//	DEL <key> ...         deletes the values. Replies the count deleted.
+//	INFO [section]        replies the store info.
+//	AUTH [user] <token>   authenticates the connection with a token.
+//	PING, ECHO, SELECT 0, COMMAND, CLIENT, HELLO 2 and QUIT are
+//	supported for clients.
+//
+// Keys are hex encoded, i.e. 40 hex digits. Commands with malformed keys
+// are rejected. Commands are served in order, one goroutine per
+// connection, and replies to pipelined commands are written in batches.
+//
+// Read and write commands require a token of the respective role if
+// Options.AuthRequired is set, and write commands are rejected if the
+// service is read-only. Read and write commands are subject to the
+// per-client rate limits of the http api, by token once authenticated,
+// otherwise by remote ip.
+//
+// Commands are limited to the max blob size plus a small overhead, and
+// while a connection is not authenticated (with Options.AuthRequired),
+// to the few small args of AUTH, HELLO, PING and QUIT. Connections are
+// closed if idle for longer than Options.IdleTimeout, or if reading a
+// command or writing its reply exceeds Options.WriteTimeout.
+
+// RESP metrics are registered with metrics.Default.
+var (
+	respCommands = metrics.Default.Counter("borisdb_resp_commands_total",
+		"Count of RESP commands by command and status (ok or error).", "command", "status")
+	respConnections atomic.Int64
+)
+
+func init() {
+	metrics.Default.GaugeFunc("borisdb_resp_connections",
+		"Count of open RESP connections.", func() float64 { return float64(respConnections.Load()) })
+}
+
+// protocol limits
+const (
+	respMaxArgs      = 1024 * 1024 // max args of a command
+	respMaxInline    = 64 * 1024   // max size of an inline command
+	respMaxBulkValue = 512 << 20   // max bulk size unless Options.MaxBlobSize
+	respMaxOverhead  = 1 << 20     // max command size in excess of the max bulk size
+	respArgOverhead  = 16          // command size of an arg in excess of its bulk size
+)
+
+// limits of a command: the max count of args, size of a bulk string and
+// total size.
+type respLimits struct {
+	args  int64
+	bulk  int64
+	total int64
+}
+
+// command limits of connections yet to authenticate
+var respAuthLimits = respLimits{args: 8, bulk: 1024, total: 4 * 1024}
+
+// malformed commands. Protocol errors close the connection after
+// their reply.
+var (
+	respProtocolErr = errors.New("Protocol error")
+	respSyntaxErr   = errors.New("syntax error")
+)
+
+/// server ////////////////////////////////////////////////////////////////////
+
+// type serves the RESP front end - see RunService.
+type respServer struct {
+	db       store.Store
+	opts     Options
+	auth     *authenticator
+	limits   respLimits
+	rate     rateLimits
+	idle     time.Duration   // read timeout awaiting a command
+	timeout  time.Duration   // read timeout of a command, and write timeout of its reply
+	ctx      context.Context // canceled once connections are closed
+	cancel   context.CancelFunc
+	mu       sync.Mutex
+	ln       net.Listener
+	conns    map[net.Conn]struct{}
+	closing  atomic.Bool
+	handlers sync.WaitGroup
+}
+
+func newRESPServer(db store.Store, opts Options, rate rateLimits) *respServer {
+	maxbulk := opts.MaxBlobSize
+	if maxbulk <= 0 {
+		maxbulk = respMaxBulkValue
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &respServer{
+		db:      db,
+		opts:    opts,
+		auth:    newAuthenticator(db, opts),
+		limits:  respLimits{args: respMaxArgs, bulk: maxbulk, total: maxbulk + respMaxOverhead},
+		rate:    rate,
+		idle:    orDefault(opts.IdleTimeout, DefaultIdleTimeout),
+		timeout: orDefault(opts.WriteTimeout, DefaultWriteTimeout),
+		ctx:     ctx,
+		cancel:  cancel,
+		conns:   make(map[net.Conn]struct{}),
+	}
+}
+
+// accepts connections on 'ln' until shutdown. Returns nil on shutdown.
+func (s *respServer) serve(ln net.Listener) error {
+	s.mu.Lock()
+	s.ln = ln
+	s.mu.Unlock()
+	for {
+		conn, e := ln.Accept()
+		if e != nil {
+			if s.closing.Load() {
+				return nil
+			}
+			var ne net.Error
+			if errors.As(e, &ne) && ne.Timeout() {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			return e
+		}
+		s.mu.Lock()
+		if s.closing.Load() {
+			s.mu.Unlock()
+			conn.Close()
+			return nil
+		}
+		s.conns[conn] = struct{}{}
+		s.handlers.Add(1)
+		s.mu.Unlock()
+		go s.handle(conn)
+	}
+}
+
+// stops accepting connections, and waits for connections to complete
+// their current command. Remaining connections are closed if ctx is
+// done first, in which case the ctx error is returned.
+func (s *respServer) shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closing.Store(true)
+	if s.ln != nil {
+		s.ln.Close()
+	}
+	// idle connections fail their next read
+	for conn := range s.conns {
+		conn.SetReadDeadline(time.Now())
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.handlers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		s.cancel()
+		return nil
+	case <-ctx.Done():
+	}
+	s.cancel()
+	s.mu.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	<-done
+	return ctx.Err()
+}
+
+/// connections ///////////////////////////////////////////////////////////////
+
+// state of a client connection
+type respConn struct {
+	s      *respServer
+	conn   net.Conn
+	r      *bufio.Reader
+	w      *bufio.Writer
+	client string // authenticated client id, if any
+	role   Role
+	quit   bool
+}
+
+// serves the commands of 'conn' in order. Replies are flushed once no
+// pipelined commands are buffered.
+func (s *respServer) handle(conn net.Conn) {
+	respConnections.Add(1)
+	defer func() {
+		conn.Close()
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		respConnections.Add(-1)
+		s.handlers.Done()
+	}()
+	log := logging.Default().With("remote", conn.RemoteAddr().String())
+	log.Debug("resp connection")
+
+	c := &respConn{s: s, conn: conn, r: bufio.NewReader(conn), w: bufio.NewWriter(conn)}
+	for !c.quit {
+		args, e := c.readCommand()
+		if e != nil {
+			if errors.Is(e, respProtocolErr) {
+				conn.SetWriteDeadline(time.Now().Add(s.timeout))
+				writeError(c.w, "ERR", e.Error())
+				c.w.Flush()
+				log.Warn("resp protocol error", "error", e)
+			} else if e != io.EOF && !s.closing.Load() {
+				log.Debug("resp connection error", "error", e)
+			}
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+		conn.SetWriteDeadline(time.Now().Add(s.timeout))
+		c.exec(args)
+		if c.r.Buffered() == 0 || c.w.Buffered() > 64*1024 {
+			if e := c.w.Flush(); e != nil {
+				return
+			}
+		}
+		if s.closing.Load() {
+			c.w.Flush()
+			return
+		}
+	}
+	c.w.Flush()
+}
+
+// reads the next command of the connection, within the limits of its
+// authentication state. Fails if the connection is idle for longer than
+// the idle timeout, or if reading the command exceeds the write timeout.
+func (c *respConn) readCommand() ([][]byte, error) {
+	c.conn.SetReadDeadline(time.Now().Add(c.s.idle))
+	// shutdown sets a past deadline after closing is set
+	if c.s.closing.Load() {
+		return nil, io.EOF
+	}
+	if _, e := c.r.Peek(1); e != nil {
+		return nil, e
+	}
+	c.conn.SetReadDeadline(time.Now().Add(c.s.timeout))
+	limits := c.s.limits
+	if c.s.auth.required && c.client == "" {
+		limits = respAuthLimits
+	}
+	return readCommand(c.r, limits)
+}
+
+/// commands //////////////////////////////////////////////////////////////////
+
+// type defines a command. Arity is the exact count of args (including
+// the command name), or if negative, the min count.
+type respCommand struct {
+	role  Role
+	write bool
+	arity int
+	fn    func(ctx context.Context, c *respConn, args [][]byte) error
+}
+
+var respCommandTable map[string]respCommand
+
+func init() {
+	respCommandTable = map[string]respCommand{
+		"PING":    {RoleNone, false, -1, respPing},
+		"ECHO":    {RoleNone, false, 2, respEcho},
+		"QUIT":    {RoleNone, false, 1, respQuit},
+		"AUTH":    {RoleNone, false, -2, respAuth},
+		"HELLO":   {RoleNone, false, -1, respHello},
+		"SELECT":  {RoleNone, false, 2, respSelect},
+		"COMMAND": {RoleNone, false, -1, respCommandCmd},
+		"CLIENT":  {RoleNone, false, -2, respClient},
+		"SET":     {RoleWrite, true, -2, respSet},
+		"GET":     {RoleRead, false, 2, respGet},
+		"MGET":    {RoleRead, false, -2, respMget},
+		"EXISTS":  {RoleRead, false, -2, respExists},
+		"DEL":     {RoleWrite, true, -2, respDel},
+		"INFO":    {RoleRead, false, -1, respInfo},
+	}
+}
+
+// executes command 'args' and writes its reply.
+func (c *respConn) exec(args [][]byte) {
+	name := strings.ToUpper(string(args[0]))
+	cmd, ok := respCommandTable[name]
+	if !ok {
+		respCommands.With("unknown", "error").Inc()
+		writeError(c.w, "ERR", fmt.Sprintf("unknown command '%s'", truncate(string(args[0]), 64)))
+		return
+	}
+	if (cmd.arity > 0 && len(args) != cmd.arity) || (cmd.arity < 0 && len(args) < -cmd.arity) {
+		respCommands.With(name, "error").Inc()
+		writeError(c.w, "ERR", fmt.Sprintf("wrong number of arguments for '%s' command", strings.ToLower(name)))
+		return
+	}
+
+	var e error
+	switch {
+	case cmd.role > RoleNone && c.role < cmd.role && c.s.auth.required:
+		if c.client == "" {
+			writeError(c.w, "NOAUTH", "Authentication required.")
+		} else {
+			writeError(c.w, "NOPERM", fmt.Sprintf("%s role token required - have %s", cmd.role, c.role))
+		}
+		e = errInvalidCredentials
+	case cmd.write && c.s.opts.ReadOnly:
+		writeError(c.w, "READONLY", store.ReadOnlyErr.Error())
+		e = store.ReadOnlyErr
+	case !c.allow(cmd):
+		e = RateLimitedErr
+	default:
+		ctx := c.s.ctx
+		if c.client != "" {
+			ctx = withClient(ctx, c.client)
+		}
+		start := time.Now()
+		e = cmd.fn(ctx, c, args[1:])
+		if cmd.role > RoleNone {
+			attrs := []any{"command", name, "client", c.client, "remote", c.conn.RemoteAddr().String(), "duration", time.Since(start)}
+			if e != nil {
+				attrs = append(attrs, "error", e)
+			}
+			logging.FromContext(ctx).Debug("resp command", attrs...)
+		}
+	}
+	status := "ok"
+	if e != nil {
+		status = "error"
+	}
+	respCommands.With(name, status).Inc()
+}
+
+// applies the per-client rate limit of read or write command 'cmd'.
+// Writes an error reply and returns false if the limit is exceeded.
+func (c *respConn) allow(cmd respCommand) bool {
+	var l *rateLimiter
+	switch {
+	case cmd.write:
+		l = c.s.rate.write
+	case cmd.role == RoleRead:
+		l = c.s.rate.read
+	}
+	if l == nil {
+		return true
+	}
+	ok, wait := l.allow(identity(c.client, c.conn.RemoteAddr().String()), time.Now())
+	if !ok {
+		rateLimited.With(l.kind).Inc()
+		writeError(c.w, "ERR", fmt.Sprintf("%s rate limit exceeded - retry after %ds", l.kind, int(math.Ceil(wait.Seconds()))))
+	}
+	return ok
+}
+
+// parses 'args' as keys. Writes an error reply and returns false if
+// any key is malformed.
+func (c *respConn) parseKeys(args [][]byte) ([]store.Key, bool) {
+	keys := make([]store.Key, len(args))
+	for i, arg := range args {
+		key, e := store.ParseKey(string(arg))
+		if e != nil {
+			writeError(c.w, "ERR", e.Error())
+			return nil, false
+		}
+		keys[i] = key
+	}
+	return keys, true
+}
+
+// writes the error reply for store error 'e', and returns it.
+func (c *respConn) storeError(e error) error {
+	switch {
+	case errors.Is(e, store.ReadOnlyErr):
+		writeError(c.w, "READONLY", e.Error())
+	case errors.Is(e, store.BusyErr), errors.Is(e, store.UnavailableErr):
+		writeError(c.w, "TRYAGAIN", e.Error())
+	default:
+		writeError(c.w, "ERR", e.Error())
+	}
+	return e
+}
+
+func respPing(ctx context.Context, c *respConn, args [][]byte) error {
+	switch len(args) {
+	case 0:
+		writeSimple(c.w, "PONG")
+	case 1:
+		writeBulk(c.w, args[0])
+	default:
+		writeError(c.w, "ERR", "wrong number of arguments for 'ping' command")
+		return respSyntaxErr
+	}
+	return nil
+}
+
+func respEcho(ctx context.Context, c *respConn, args [][]byte) error {
+	writeBulk(c.w, args[0])
+	return nil
+}
+
+func respQuit(ctx context.Context, c *respConn, args [][]byte) error {
+	writeSimple(c.w, "OK")
+	c.quit = true
+	return nil
+}
+
+// AUTH <token> or AUTH <user> <token>. The user name is ignored.
+func respAuth(ctx context.Context, c *respConn, args [][]byte) error {
+	if len(args) > 2 {
+		writeError(c.w, "ERR", "syntax error")
+		return respSyntaxErr
+	}
+	if e := c.authenticate(args[len(args)-1]); e != nil {
+		return e
+	}
+	writeSimple(c.w, "OK")
+	return nil
+}
+
+// authenticates the connection with 'token'. Writes an error reply
+// on error.
+func (c *respConn) authenticate(token []byte) error {
+	id, role, e := c.s.auth.authenticateToken(string(token))
+	if errors.Is(e, errInvalidCredentials) {
+		writeError(c.w, "WRONGPASS", "invalid username-password pair or user is disabled.")
+		return e
+	} else if e != nil {
+		return c.storeError(e)
+	}
+	c.client, c.role = id, role
+	return nil
+}
+
+// HELLO [2 [AUTH <user> <token>] [SETNAME <name>]]. Only protocol
+// version 2 is supported: clients asking for version 3 fall back to
+// AUTH and version 2.
+func respHello(ctx context.Context, c *respConn, args [][]byte) error {
+	if len(args) > 0 && string(args[0]) != "2" {
+		writeError(c.w, "NOPROTO", "sorry, this protocol version is not supported")
+		return nil
+	}
+	for i := 1; i < len(args); i++ {
+		switch opt := strings.ToUpper(string(args[i])); {
+		case opt == "AUTH" && i+2 < len(args):
+			if e := c.authenticate(args[i+2]); e != nil {
+				return e
+			}
+			i += 2
+		case opt == "SETNAME" && i+1 < len(args):
+			i++
+		default:
+			writeError(c.w, "ERR", "syntax error")
+			return respSyntaxErr
+		}
+	}
+	fields := []string{"server", "borisdb", "proto", "2", "mode", "standalone", "role", "master"}
+	writeArray(c.w, len(fields))
+	for _, f := range fields {
+		writeBulk(c.w, []byte(f))
+	}
+	return nil
+}
+
+// only db 0 exists.
+func respSelect(ctx context.Context, c *respConn, args [][]byte) error {
+	if string(args[0]) != "0" {
+		writeError(c.w, "ERR", "DB index is out of range")
+		return nil
+	}
+	writeSimple(c.w, "OK")
+	return nil
+}
+
+// command docs are not supported. Replies an empty array.
+func respCommandCmd(ctx context.Context, c *respConn, args [][]byte) error {
+	writeArray(c.w, 0)
+	return nil
+}
+
+// client settings (e.g. SETNAME, SETINFO) are accepted and ignored.
+func respClient(ctx context.Context, c *respConn, args [][]byte) error {
+	writeSimple(c.w, "OK")
+	return nil
+}
+
+// SET <value> or SET <key> <value>
+func respSet(ctx context.Context, c *respConn, args [][]byte) error {
+	var want *store.Key
+	switch len(args) {
+	case 1:
+	case 2:
+		keys, ok := c.parseKeys(args[:1])
+		if !ok {
+			return store.InvalidKeyErr
+		}
+		want = &keys[0]
+		args = args[1:]
+	default:
+		writeError(c.w, "ERR", "syntax error")
+		return respSyntaxErr
+	}
+	if want != nil {
+		if key := store.KeyOf(args[0]); key != *want {
+			writeError(c.w, "ERR", fmt.Sprintf("%s - value hashes to %s", store.InvalidKeyErr, key))
+			return store.InvalidKeyErr
+		}
+	}
+	key, e := c.s.db.PutContext(ctx, args[0])
+	if e != nil && !errors.Is(e, store.ExistingErr) {
+		return c.storeError(e)
+	}
+	writeBulk(c.w, []byte(key.String()))
+	return nil
+}
+
+func respGet(ctx context.Context, c *respConn, args [][]byte) error {
+	keys, ok := c.parseKeys(args)
+	if !ok {
+		return store.InvalidKeyErr
+	}
+	if e := c.writeValue(ctx, keys[0]); e != nil {
+		return c.storeError(e)
+	}
+	return nil
+}
+
+// values are written as they are read, so that the reply is not held
+// in memory. Store errors are written as error elements of the reply.
+func respMget(ctx context.Context, c *respConn, args [][]byte) error {
+	keys, ok := c.parseKeys(args)
+	if !ok {
+		return store.InvalidKeyErr
+	}
+	var err error
+	writeArray(c.w, len(keys))
+	for _, key := range keys {
+		if e := c.writeValue(ctx, key); e != nil {
+			err = c.storeError(e)
+		}
+	}
+	return err
+}
+
+// writes the value of 'key' as a bulk string, or the nil bulk string if
+// not found. Other store errors are returned, and nothing is written.
+//
+// Values fitting the write buffer are written while viewed, i.e.
+// without copying. Larger values are copied, as writing them blocks on
+// the client, holding the view open.
+func (c *respConn) writeValue(ctx context.Context, key store.Key) error {
+	var v []byte
+	e := c.s.db.ViewContext(ctx, key, func(b []byte) error {
+		if len(b)+32 <= c.w.Available() {
+			writeBulk(c.w, b)
+			return nil
+		}
+		v = bytes.Clone(b)
+		return nil
+	})
+	if errors.Is(e, store.NotFoundErr) {
+		writeBulk(c.w, nil)
+		return nil
+	} else if e != nil {
+		return e
+	}
+	if v != nil {
+		writeBulk(c.w, v)
+	}
+	return nil
+}
+
+func respExists(ctx context.Context, c *respConn, args [][]byte) error {
+	keys, ok := c.parseKeys(args)
+	if !ok {
+		return store.InvalidKeyErr
+	}
+	n := 0
+	for _, key := range keys {
+		e := c.s.db.ViewContext(ctx, key, func([]byte) error { return nil })
+		if e == nil {
+			n++
+		} else if !errors.Is(e, store.NotFoundErr) {
+			return c.storeError(e)
+		}
+	}
+	writeInt(c.w, int64(n))
+	return nil
+}
+
+func respDel(ctx context.Context, c *respConn, args [][]byte) error {
+	keys, ok := c.parseKeys(args)
+	if !ok {
+		return store.InvalidKeyErr
+	}
+	n := 0
+	for _, key := range keys {
+		_, e := c.s.db.DelContext(ctx, key)
+		if e == nil {
+			n++
+		} else if !errors.Is(e, store.NotFoundErr) {
+			return c.storeError(e)
+		}
+	}
+	writeInt(c.w, int64(n))
+	return nil
+}
+
+// replies the store info as an info section. Sections are ignored.
+func respInfo(ctx context.Context, c *respConn, args [][]byte) error {
+	info, e := c.s.db.InfoContext(ctx)
+	if e != nil {
+		return c.storeError(e)
+	}
+	var b strings.Builder
+	b.WriteString("# Server\r\nserver:borisdb\r\n\r\n# Store\r\n")
+	for _, line := range strings.Split(strings.TrimSpace(string(info)), "\n") {
+		b.WriteString(strings.TrimSpace(line) + "\r\n")
+	}
+	writeBulk(c.w, []byte(b.String()))
+	return nil
+}
+
+/// protocol //////////////////////////////////////////////////////////////////
+
+// reads a command, either a RESP array of bulk strings, or an inline
+// command (a line of space separated args). Commands exceeding 'limits'
+// are rejected before their bulk strings are read. Malformed commands
+// are reported as respProtocolErr.
+func readCommand(r *bufio.Reader, limits respLimits) ([][]byte, error) {
+	b, e := r.Peek(1)
+	if e != nil {
+		return nil, e
+	}
+	if b[0] != '*' {
+		line, e := readLine(r, int(min(respMaxInline, limits.total)))
+		if e != nil {
+			return nil, e
+		}
+		var args [][]byte
+		for _, f := range strings.Fields(string(line)) {
+			args = append(args, []byte(f))
+		}
+		return args, nil
+	}
+
+	n, e := readHeader(r, '*', limits.args)
+	if e != nil {
+		return nil, e
+	}
+	args := make([][]byte, 0, min(n, 64))
+	remaining := limits.total
+	for i := int64(0); i < n; i++ {
+		size, e := readHeader(r, '$', min(limits.bulk, remaining))
+		if e != nil {
+			return nil, e
+		}
+		if remaining -= size + respArgOverhead; remaining < 0 {
+			return nil, fmt.Errorf("%w - command exceeds max size %d", respProtocolErr, limits.total)
+		}
+		// buffers grow as data arrives, not as announced
+		var buf bytes.Buffer
+		buf.Grow(int(min(size+2, 64*1024)))
+		if _, e := io.CopyN(&buf, r, size+2); e != nil {
+			if e == io.EOF {
+				e = io.ErrUnexpectedEOF
+			}
+			return nil, e
+		}
+		arg := buf.Bytes()
+		if arg[size] != '\r' || arg[size+1] != '\n' {
+			return nil, fmt.Errorf("%w - expected CRLF after bulk string", respProtocolErr)
+		}
+		args = append(args, arg[:size])
+	}
+	return args, nil
+}
+
+// reads a header line '<prefix><n>' with 0 <= n <= max.
+func readHeader(r *bufio.Reader, prefix byte, max int64) (int64, error) {
+	line, e := readLine(r, 32)
+	if e != nil {
+		return 0, e
+	}
+	if len(line) < 2 || line[0] != prefix {
+		return 0, fmt.Errorf("%w - expected '%c', got %q", respProtocolErr, prefix, truncate(string(line), 32))
+	}
+	n, e := strconv.ParseInt(string(line[1:]), 10, 64)
+	if e != nil || n < 0 {
+		return 0, fmt.Errorf("%w - invalid length %q", respProtocolErr, line[1:])
+	}
+	if n > max {
+		return 0, fmt.Errorf("%w - length %d exceeds max %d", respProtocolErr, n, max)
+	}
+	return n, nil
+}
+
+// reads a CRLF (or LF) terminated line of at most 'max' bytes.
+func readLine(r *bufio.Reader, max int) ([]byte, error) {
+	var line []byte
+	for {
+		frag, e := r.ReadSlice('\n')
+		line = append(line, frag...)
+		if len(line) > max+2 {
+			return nil, fmt.Errorf("%w - line too long", respProtocolErr)
+		}
+		if e == nil {
+			break
+		}
+		if e != bufio.ErrBufferFull {
+			return nil, e
+		}
+	}
+	line = line[:len(line)-1]
+	if n := len(line); n > 0 && line[n-1] == '\r' {
+		line = line[:n-1]
+	}
+	return line, nil
+}
+
+func writeSimple(w *bufio.Writer, s string) {
+	w.WriteString("+" + s + "\r\n")
+}
+
+// errors are written as '-<code> <msg>'. msg must not include newlines.
+func writeError(w *bufio.Writer, code, msg string) {
+	msg = strings.NewReplacer("\r", " ", "\n", " ").Replace(msg)
+	w.WriteString("-" + code + " " + msg + "\r\n")
+}
+
+func writeInt(w *bufio.Writer, n int64) {
+	w.WriteString(":" + strconv.FormatInt(n, 10) + "\r\n")
+}
+
+// writes bulk string 'b', or the nil bulk string if b is nil.
+func writeBulk(w *bufio.Writer, b []byte) {
+	if b == nil {
+		w.WriteString("$-1\r\n")
+		return
+	}
+	w.WriteString("$" + strconv.Itoa(len(b)) + "\r\n")
+	w.Write(b)
+	w.WriteString("\r\n")
+}
+
+func writeArray(w *bufio.Writer, n int) {
+	w.WriteString("*" + strconv.Itoa(n) + "\r\n")
+}
+
+func truncate(s string, n int) string {
+	if len(s) > n {
+		return s[:n] + "..."
+	}
+	return s
+}
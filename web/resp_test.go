@@ -0,0 +1,340 @@
+//    Copyright © 2016 Joubin Houshyar. All rights reserved.
+//
+//    This file is part of Frankinstore.
+//
+//    Frankinstore is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU Affero General Public License as
+//    published by the Free Software Foundation, either version 3 of
+//    the License, or (at your option) any later version.
+//
+//    Frankinstore is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU Affero General Public License for more details.
+//
+//    You should have received a copy of the GNU Affero General Public
+//    License along with Frankinstore.  If not, see <http://www.gnu.org/licenses/>.
+
+package web
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/alphazero/borisdb/store"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+/// test client ///////////////////////////////////////////////////////////////
+
+// hand-rolled RESP client. Replies are decoded as string (simple),
+// respError, int64, []byte (bulk, nil for the nil bulk) or []interface{}.
+type respTestClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+type respError string
+
+// starts a RESP server for 'opts' on a test store and returns a client.
+func startRESP(t *testing.T, opts Options) (store.Store, *respServer, *respTestClient) {
+	t.Helper()
+	db := openTestDb(t)
+	s := newRESPServer(db, opts, newRateLimits(opts))
+	ln, e := net.Listen("tcp", "127.0.0.1:0")
+	if e != nil {
+		t.Fatal(e)
+	}
+	go s.serve(ln)
+	t.Cleanup(func() { s.shutdown(context.Background()) })
+	return db, s, dialRESP(t, ln.Addr().String())
+}
+
+func dialRESP(t *testing.T, addr string) *respTestClient {
+	t.Helper()
+	conn, e := net.Dial("tcp", addr)
+	if e != nil {
+		t.Fatal(e)
+	}
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	t.Cleanup(func() { conn.Close() })
+	return &respTestClient{t: t, conn: conn, r: bufio.NewReader(conn)}
+}
+
+// encodes a command as an array of bulk strings.
+func encodeCommand(args ...interface{}) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		var v []byte
+		switch a := arg.(type) {
+		case []byte:
+			v = a
+		case store.Key:
+			v = []byte(a.String())
+		default:
+			v = []byte(fmt.Sprint(a))
+		}
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(v), v)
+	}
+	return b.Bytes()
+}
+
+func (c *respTestClient) send(b []byte) {
+	c.t.Helper()
+	if _, e := c.conn.Write(b); e != nil {
+		c.t.Fatal(e)
+	}
+}
+
+// sends a command and returns its reply.
+func (c *respTestClient) do(args ...interface{}) interface{} {
+	c.t.Helper()
+	c.send(encodeCommand(args...))
+	return c.read()
+}
+
+func (c *respTestClient) read() interface{} {
+	c.t.Helper()
+	line, e := c.r.ReadString('\n')
+	if e != nil {
+		c.t.Fatalf("read reply: %v", e)
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	switch line[0] {
+	case '+':
+		return line[1:]
+	case '-':
+		return respError(line[1:])
+	case ':':
+		n, _ := strconv.ParseInt(line[1:], 10, 64)
+		return n
+	case '$':
+		n, _ := strconv.Atoi(line[1:])
+		if n < 0 {
+			return []byte(nil)
+		}
+		b := make([]byte, n+2)
+		if _, e := io.ReadFull(c.r, b); e != nil {
+			c.t.Fatal(e)
+		}
+		return b[:n]
+	case '*':
+		n, _ := strconv.Atoi(line[1:])
+		a := make([]interface{}, n)
+		for i := range a {
+			a[i] = c.read()
+		}
+		return a
+	}
+	c.t.Fatalf("invalid reply %q", line)
+	return nil
+}
+
+// asserts reply 'have' is 'want'. Errors match by prefix.
+func expectReply(t *testing.T, cmd string, have, want interface{}) {
+	t.Helper()
+	switch w := want.(type) {
+	case respError:
+		if h, ok := have.(respError); !ok || !strings.HasPrefix(string(h), string(w)) {
+			t.Errorf("%s = %#v - expect error %q", cmd, have, w)
+		}
+	case []byte:
+		if h, ok := have.([]byte); !ok || !bytes.Equal(h, w) || (h == nil) != (w == nil) {
+			t.Errorf("%s = %#v - expect %q", cmd, have, w)
+		}
+	default:
+		if fmt.Sprint(have) != fmt.Sprint(want) {
+			t.Errorf("%s = %#v - expect %#v", cmd, have, want)
+		}
+	}
+}
+
+/// tests /////////////////////////////////////////////////////////////////////
+
+func TestRESPCommands(t *testing.T) {
+	db, _, c := startRESP(t, Options{})
+	blob := []byte("binary\r\n\x00blob")
+	key := store.KeyOf(blob)
+	missing := store.KeyOf([]byte("missing"))
+
+	expectReply(t, "PING", c.do("PING"), "PONG")
+	expectReply(t, "SET", c.do("SET", blob), []byte(key.String()))
+	expectReply(t, "SET existing", c.do("set", key, blob), []byte(key.String()))
+	expectReply(t, "SET wrong key", c.do("SET", missing, blob), respError("ERR "+store.InvalidKeyErr.Error()))
+	expectReply(t, "SET options", c.do("SET", key, blob, "EX", "10"), respError("ERR syntax error"))
+	expectReply(t, "GET", c.do("GET", key), blob)
+	expectReply(t, "GET missing", c.do("GET", missing), []byte(nil))
+	expectReply(t, "GET invalid", c.do("GET", "foo"), respError("ERR "+store.InvalidKeyErr.Error()))
+	expectReply(t, "GET arity", c.do("GET"), respError("ERR wrong number of arguments"))
+	expectReply(t, "EXISTS", c.do("EXISTS", key, missing, key), int64(2))
+
+	mget := c.do("MGET", key, missing)
+	if a, ok := mget.([]interface{}); !ok || len(a) != 2 || !bytes.Equal(a[0].([]byte), blob) || a[1].([]byte) != nil {
+		t.Errorf("MGET = %#v", mget)
+	}
+	info := c.do("INFO")
+	if b, ok := info.([]byte); !ok || !bytes.Contains(b, []byte("server:borisdb")) {
+		t.Errorf("INFO = %q", info)
+	}
+
+	expectReply(t, "DEL", c.do("DEL", key, missing), int64(1))
+	if _, e := db.Get(key); e == nil {
+		t.Error("blob not deleted")
+	}
+	expectReply(t, "unknown", c.do("FLUSHALL"), respError("ERR unknown command"))
+	expectReply(t, "SELECT", c.do("SELECT", "1"), respError("ERR DB index"))
+	expectReply(t, "HELLO 3", c.do("HELLO", "3"), respError("NOPROTO"))
+
+	// inline commands
+	c.send([]byte("PING\r\n"))
+	expectReply(t, "inline PING", c.read(), "PONG")
+	expectReply(t, "QUIT", c.do("QUIT"), "OK")
+	if _, e := c.r.ReadByte(); e != io.EOF {
+		t.Errorf("read after QUIT = %v - expect EOF", e)
+	}
+}
+
+func TestRESPPipelining(t *testing.T) {
+	_, _, c := startRESP(t, Options{})
+
+	// all commands are sent before any reply is read
+	const n = 200
+	var batch bytes.Buffer
+	for i := 0; i < n; i++ {
+		batch.Write(encodeCommand("SET", fmt.Sprintf("blob %d", i)))
+		batch.Write(encodeCommand("GET", store.KeyOf([]byte(fmt.Sprintf("blob %d", i)))))
+	}
+	go c.conn.Write(batch.Bytes())
+	for i := 0; i < n; i++ {
+		blob := []byte(fmt.Sprintf("blob %d", i))
+		expectReply(t, "SET", c.read(), []byte(store.KeyOf(blob).String()))
+		expectReply(t, "GET", c.read(), blob)
+	}
+}
+
+func TestRESPAccess(t *testing.T) {
+	db, s, c := startRESP(t, Options{AdminToken: "secret", AuthRequired: true})
+	reader := createToken(t, s.auth, "secret", "read")
+	key, _ := db.Put([]byte("blob"))
+
+	expectReply(t, "PING", c.do("PING"), "PONG")
+	expectReply(t, "GET anonymous", c.do("GET", key), respError("NOAUTH"))
+	expectReply(t, "AUTH invalid", c.do("AUTH", "nope"), respError("WRONGPASS"))
+	expectReply(t, "AUTH", c.do("AUTH", "default", reader.Token), "OK")
+	expectReply(t, "GET", c.do("GET", key), []byte("blob"))
+	expectReply(t, "SET reader", c.do("SET", "v"), respError("NOPERM"))
+	if a, ok := c.do("HELLO", "2", "AUTH", "default", "secret").([]interface{}); !ok || len(a) != 8 {
+		t.Errorf("HELLO AUTH = %#v", a)
+	}
+	expectReply(t, "SET admin", c.do("SET", "v"), []byte(store.KeyOf([]byte("v")).String()))
+
+	_, _, ro := startRESP(t, Options{ReadOnly: true})
+	expectReply(t, "SET read-only", ro.do("SET", "v"), respError("READONLY"))
+
+	// protocol errors close the connection
+	_, _, pc := startRESP(t, Options{MaxBlobSize: 10})
+	pc.send([]byte("*1\r\n$100\r\n"))
+	expectReply(t, "too large", pc.read(), respError("ERR Protocol error"))
+	if _, e := pc.r.ReadByte(); e != io.EOF {
+		t.Errorf("read after protocol error = %v - expect EOF", e)
+	}
+}
+
+func TestRESPShutdown(t *testing.T) {
+	_, s, c := startRESP(t, Options{})
+	expectReply(t, "PING", c.do("PING"), "PONG")
+
+	// idle connections are closed
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if e := s.shutdown(ctx); e != nil {
+		t.Fatalf("shutdown error = %v", e)
+	}
+	if _, e := c.r.ReadByte(); e != io.EOF {
+		t.Errorf("read after shutdown = %v - expect EOF", e)
+	}
+}
+
+func TestRESPLimits(t *testing.T) {
+	// commands exceeding the total size fail before their bulks are read
+	limits := respLimits{args: 4, bulk: 100, total: 150}
+	fits := encodeCommand("SET", bytes.Repeat([]byte("v"), 100))
+	if args, e := readCommand(bufio.NewReader(bytes.NewReader(fits)), limits); e != nil || len(args) != 2 {
+		t.Errorf("readCommand = %q, %v", args, e)
+	}
+	over := encodeCommand(bytes.Repeat([]byte("v"), 100), bytes.Repeat([]byte("v"), 100))
+	if _, e := readCommand(bufio.NewReader(bytes.NewReader(over)), limits); !errors.Is(e, respProtocolErr) {
+		t.Errorf("readCommand over total = %v - expect protocol error", e)
+	}
+
+	// unauthenticated connections are limited to small commands
+	_, s, c := startRESP(t, Options{AdminToken: "secret", AuthRequired: true})
+	c.send([]byte("*1\r\n$2000\r\n"))
+	expectReply(t, "unauthenticated", c.read(), respError("ERR Protocol error"))
+	if _, e := c.r.ReadByte(); e != io.EOF {
+		t.Errorf("read after protocol error = %v - expect EOF", e)
+	}
+	s.mu.Lock()
+	ac := dialRESP(t, s.ln.Addr().String())
+	s.mu.Unlock()
+	expectReply(t, "AUTH", ac.do("AUTH", "secret"), "OK")
+	blob := bytes.Repeat([]byte("blob"), 16*1024)
+	expectReply(t, "SET authenticated", ac.do("SET", blob), []byte(store.KeyOf(blob).String()))
+
+	// values larger than the write buffer are copied
+	expectReply(t, "GET large", ac.do("GET", store.KeyOf(blob)), blob)
+	mget := ac.do("MGET", store.KeyOf(blob), store.KeyOf([]byte("missing")), store.KeyOf(blob))
+	if a, ok := mget.([]interface{}); !ok || len(a) != 3 || !bytes.Equal(a[0].([]byte), blob) || a[1].([]byte) != nil || !bytes.Equal(a[2].([]byte), blob) {
+		t.Errorf("MGET large = %d elements", len(a))
+	}
+
+	// store errors are reply elements of MGET
+	db, _, ec := startRESP(t, Options{})
+	db.Close()
+	mget = ec.do("MGET", store.KeyOf(blob))
+	if a, ok := mget.([]interface{}); !ok || len(a) != 1 {
+		t.Errorf("MGET closed = %#v", mget)
+	} else {
+		expectReply(t, "MGET closed", a[0], respError("ERR "+store.ClosedErr.Error()))
+	}
+	expectReply(t, "PING", ec.do("PING"), "PONG")
+}
+
+func TestRESPRateLimits(t *testing.T) {
+	db, _, c := startRESP(t, Options{ReadRate: 0.01, ReadBurst: 1})
+	key, _ := db.Put([]byte("blob"))
+
+	expectReply(t, "GET", c.do("GET", key), []byte("blob"))
+	expectReply(t, "GET limited", c.do("GET", key), respError("ERR read rate limit exceeded"))
+	expectReply(t, "PING", c.do("PING"), "PONG")
+	expectReply(t, "SET", c.do("SET", "v"), []byte(store.KeyOf([]byte("v")).String()))
+}
+
+func TestRESPTimeouts(t *testing.T) {
+	// idle connections are closed
+	_, _, c := startRESP(t, Options{IdleTimeout: 100 * time.Millisecond})
+	expectReply(t, "PING", c.do("PING"), "PONG")
+	start := time.Now()
+	if _, e := c.r.ReadByte(); e != io.EOF {
+		t.Errorf("read idle = %v - expect EOF", e)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("idle connection closed after %s", d)
+	}
+
+	// as are connections sending partial commands
+	_, _, pc := startRESP(t, Options{WriteTimeout: 100 * time.Millisecond})
+	pc.send([]byte("*2\r\n$4\r\nECHO\r\n"))
+	if _, e := pc.r.ReadByte(); e != io.EOF {
+		t.Errorf("read after partial command = %v - expect EOF", e)
+	}
+}
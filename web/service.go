@@ -19,36 +19,243 @@
 package web
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"github.com/alphazero/borisdb/logging"
 	"github.com/alphazero/borisdb/store"
 	"io/ioutil"
+	"log/slog"
+	"net"
 	"net/http"
 	"path"
+	"strconv"
+	"sync/atomic"
+	"time"
 )
 
 /// services //////////////////////////////////////////////////////////////////
 
 const DefaultPort = 5722
 
+// default http server timeouts. See Options.
+const (
+	DefaultReadHeaderTimeout = 10 * time.Second
+	DefaultWriteTimeout      = 5 * time.Minute
+	DefaultIdleTimeout       = 2 * time.Minute
+)
+
+// web service options
+type Options struct {
+	// static admin role token, e.g. to bootstrap token management.
+	// Not accepted if zerovalue. See Role.
+	AdminToken string
+	// read and write endpoints require a token of the respective
+	// role if set. Admin endpoints always require an admin token.
+	AuthRequired bool
+	// max accepted request body size for Set. Not enforced if zerovalue.
+	MaxBlobSize int64
+	// mutating endpoints (set, del, shutdown, import, compact) are
+	// rejected if ReadOnly is set.
+	ReadOnly bool
+	// database file path, used to check free disk space.
+	DbPath string
+	// min free disk space for readiness. Not checked if zerovalue.
+	MinDiskFree uint64
+	// service certificate and key files. Served over https if set.
+	TLSCert string
+	TLSKey  string
+	// CA bundle file verifying client certificates. Clients must
+	// present a certificate (mutual-TLS) if set.
+	ClientCA string
+	// max-age of cacheable (get) responses. Not cached if zerovalue.
+	CacheMaxAge time.Duration
+	// per-client (token or remote ip) read and write requests per
+	// second, and burst sizes. Not enforced if zerovalue. Bursts
+	// default to the rate.
+	ReadRate   float64
+	ReadBurst  int
+	WriteRate  float64
+	WriteBurst int
+	// directory staging the parts of upload sessions. Uploads are not
+	// enabled if zerovalue. Sessions expire after UploadTTL without
+	// activity, by default after a day.
+	UploadDir string
+	UploadTTL time.Duration
+	// max accepted import archive size. Not enforced if zerovalue.
+	MaxImportSize int64
+	// http server timeouts reading request headers, writing responses
+	// (backups, exports and imports excepted) and of idle keep-alive
+	// connections. RESP connections are closed if idle, or if reading
+	// a command or writing its reply exceeds the write timeout.
+	// Defaults apply if zerovalue, e.g. DefaultWriteTimeout.
+	ReadHeaderTimeout time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	// port of the RESP (redis protocol) front end, served with the TLS
+	// options of the service. Not served if zerovalue. See respServer.
+	RESPPort int
+}
+
+// borisdb web service - see RunService
+type Service struct {
+	server *http.Server
+	state  atomic.Int32  // lifecycle state - see getReadyzHandler
+	certs  *certReloader // nil if not serving https
+	resp   *respServer   // nil if not serving RESP
+}
+
 // starts borisdb webservices on specified port 'port'
 // and delegating to the provided backend store 'db'
-func RunService(port int, db store.Store, shutdownFn func(error) error) {
+//
+// The service is served in the background once the listener is bound.
+// shutdownFn is called with the serve error, if any, and with nil on
+// /shutdown requests. The caller stops the service with Shutdown.
+func RunService(port int, db store.Store, opts Options, shutdownFn func(error) error) (*Service, error) {
 	if db == nil {
-		shutdownFn(fmt.Errorf("startup-err - arg 'db' is nil"))
-		return
+		return nil, fmt.Errorf("startup-err - arg 'db' is nil")
 	}
+	tlscfg, certs, e := serverTLSConfig(opts)
+	if e != nil {
+		return nil, fmt.Errorf("startup-err - %w", e)
+	}
+	s := &Service{certs: certs}
+	s.state.Store(stateStarting)
 
-	http.HandleFunc("/info", getInfoHandler(db))
-	http.HandleFunc("/set", getSetHandler(db))
-	http.HandleFunc("/get/", getGetHandler(db))
-	http.HandleFunc("/del/", getDelHandler(db))
-	http.HandleFunc("/shutdown", getShutdownHandler(db, shutdownFn))
+	uploads, e := newUploadManager(opts)
+	if e != nil {
+		return nil, fmt.Errorf("startup-err - %w", e)
+	}
+	limits := newRateLimits(opts)
+	mux := newServeMux(db, opts, &s.state, uploads, limits, shutdownFn)
 
 	addr := fmt.Sprintf(":%d", port)
+	ln, e := net.Listen("tcp", addr)
+	if e != nil {
+		return nil, fmt.Errorf("startup-err - %w", e)
+	}
+	if tlscfg != nil {
+		ln = tls.NewListener(ln, tlscfg)
+	}
+	s.server = &http.Server{
+		Handler:           mux,
+		TLSConfig:         tlscfg,
+		ReadHeaderTimeout: orDefault(opts.ReadHeaderTimeout, DefaultReadHeaderTimeout),
+		WriteTimeout:      orDefault(opts.WriteTimeout, DefaultWriteTimeout),
+		IdleTimeout:       orDefault(opts.IdleTimeout, DefaultIdleTimeout),
+		ErrorLog:          slog.NewLogLogger(logging.Default().Handler(), slog.LevelWarn),
+	}
+	if opts.RESPPort != 0 {
+		rln, e := net.Listen("tcp", fmt.Sprintf(":%d", opts.RESPPort))
+		if e != nil {
+			ln.Close()
+			return nil, fmt.Errorf("startup-err - resp - %w", e)
+		}
+		if tlscfg != nil {
+			rln = tls.NewListener(rln, tlscfg)
+		}
+		s.resp = newRESPServer(db, opts, limits)
+		go func() {
+			if e := s.resp.serve(rln); e != nil {
+				s.state.Store(stateStopping)
+				shutdownFn(fmt.Errorf("resp - %w", e))
+			}
+		}()
+	}
+	s.state.Store(stateReady)
+
+	go func() {
+		e := s.server.Serve(ln)
+		if e != http.ErrServerClosed {
+			s.state.Store(stateStopping)
+			shutdownFn(e)
+		}
+	}()
+	return s, nil
+}
+
+// returns the service request multiplexer. 'state' is the service
+// lifecycle state reported by readiness checks. Upload sessions are
+// not served if 'uploads' is nil.
+func newServeMux(db store.Store, opts Options, state *atomic.Int32, uploads *uploadManager, limits rateLimits, shutdownFn func(error) error) *http.ServeMux {
+	mux := http.NewServeMux()
+	handle := func(pattern, name string, fn http.HandlerFunc) {
+		mux.HandleFunc(pattern, instrument(name, fn))
+	}
+	auth := newAuthenticator(db, opts)
+	read := func(fn http.HandlerFunc) http.HandlerFunc {
+		return auth.require(RoleRead, limited(limits.read, fn))
+	}
+	write := func(fn http.HandlerFunc) http.HandlerFunc {
+		return auth.require(RoleWrite, writable(opts, limited(limits.write, fn)))
+	}
+	admin := func(fn http.HandlerFunc) http.HandlerFunc { return auth.require(RoleAdmin, fn) }
 
-	e := http.ListenAndServe(addr, nil)
-	shutdownFn(e)
+	handle("/info", "info", read(getInfoHandler(db)))
+	handle("/set", "set", write(getSetHandler(db, opts.MaxBlobSize)))
+	handle("/get/", "get", read(getGetHandler(db, opts)))
+	handle("/del/", "del", write(getDelHandler(db)))
+	handle(blobsPath, "blobs", methods(map[string]http.HandlerFunc{
+		"POST": write(getPostBlobHandler(db, opts.MaxBlobSize)),
+	}))
+	handle(blobsPath+"/", "blobs", methods(map[string]http.HandlerFunc{
+		"GET":    read(getBlobHandler(db, opts)),
+		"HEAD":   read(getBlobHandler(db, opts)),
+		"PUT":    write(getPutBlobHandler(db, opts.MaxBlobSize)),
+		"DELETE": write(getDeleteBlobHandler(db)),
+	}))
+	handle(uploadsPath, "uploads", write(getUploadsHandler(db, uploads)))
+	handle(uploadsPath+"/", "uploads", write(getUploadsHandler(db, uploads)))
+	handle("/shutdown", "shutdown", admin(writable(opts, getShutdownHandler(shutdownFn))))
+	handle("/metrics", "metrics", read(getMetricsHandler()))
+	handle("/healthz", "healthz", getHealthzHandler())
+	handle("/readyz", "readyz", getReadyzHandler(db, opts, state))
+	handle("/admin/backup", "backup", admin(getBackupHandler(db)))
+	handle("/admin/export", "export", admin(getExportHandler(db)))
+	handle("/admin/import", "import", admin(writable(opts, getImportHandler(db, opts.MaxImportSize))))
+	handle("/admin/compact", "compact", admin(writable(opts, getCompactHandler(db))))
+	handle("/admin/tokens", "tokens", admin(getTokensHandler(auth)))
+	handle("/admin/tokens/", "tokens", admin(getTokensHandler(auth)))
+	return mux
+}
+
+// ReloadTLS reloads the service certificate from its files. The
+// current certificate remains in use on error.
+func (s *Service) ReloadTLS() error {
+	if s.certs == nil {
+		return fmt.Errorf("err - ReloadTLS - service is not using tls")
+	}
+	return s.certs.reload()
+}
+
+// Shutdown stops accepting requests and waits for in-flight requests
+// to complete. Remaining connections are closed if ctx is done first,
+// in which case the ctx error is returned.
+func (s *Service) Shutdown(ctx context.Context) error {
+	s.state.Store(stateStopping)
+	// RESP connections are drained concurrently
+	respDone := make(chan error, 1)
+	if s.resp != nil {
+		go func() { respDone <- s.resp.shutdown(ctx) }()
+	} else {
+		respDone <- nil
+	}
+	if e := s.server.Shutdown(ctx); e != nil {
+		s.server.Close()
+		<-respDone
+		return e
+	}
+	return <-respDone
+}
+
+// returns 'd', or 'def' if 'd' is zerovalue.
+func orDefault(d, def time.Duration) time.Duration {
+	if d == 0 {
+		return def
+	}
+	return d
 }
 
 // convenince error response function
@@ -57,6 +264,155 @@ func onError(w http.ResponseWriter, code int, fmtstr string, args ...interface{}
 	http.Error(w, msg, code)
 }
 
+// convenience error response function for store errors. Clients
+// are asked to retry transient errors after a second.
+func onStoreError(w http.ResponseWriter, e error) {
+	onStoreErrorf(w, e, "%s", e)
+}
+
+// onStoreError with a response message formatted per 'fmtstr'. The
+// store error is identified by the errorHeader code, if any.
+func onStoreErrorf(w http.ResponseWriter, e error, fmtstr string, args ...interface{}) {
+	if errors.Is(e, store.BusyErr) || errors.Is(e, store.UnavailableErr) {
+		w.Header().Set("Retry-After", "1")
+	}
+	if code := errorCode(e); code != "" {
+		w.Header().Set(errorHeader, code)
+	}
+	onError(w, statusFor(e), fmtstr, args...)
+}
+
+// response header identifying the store error of error responses.
+const errorHeader = "X-Borisdb-Error"
+
+// codes of store errors, in order of precedence. See errorHeader.
+var errorCodes = []struct {
+	code string
+	err  error
+}{
+	{"not-found", store.NotFoundErr},
+	{"existing", store.ExistingErr},
+	{"too-large", store.TooLargeErr},
+	{"disk-full", store.DiskFullErr},
+	{"read-only", store.ReadOnlyErr},
+	{"closed", store.ClosedErr},
+	{"unavailable", store.UnavailableErr},
+	{"busy", store.BusyErr},
+	{"canceled", context.Canceled},
+	{"deadline-exceeded", context.DeadlineExceeded},
+	{"nil-value", store.NilValueErr},
+	{"zero-value", store.ZeroValueErr},
+	{"invalid-archive", store.InvalidArchiveErr},
+	{"invalid-key", store.InvalidKeyErr},
+	{"data-corrupted", store.DataCorruptedErr},
+	{"internal", store.InternalErr},
+}
+
+// returns the errorHeader code of 'e', or "" if not a store error.
+func errorCode(e error) string {
+	for _, c := range errorCodes {
+		if errors.Is(e, c.err) {
+			return c.code
+		}
+	}
+	return ""
+}
+
+// returns the store error of errorHeader 'code', or nil if unknown.
+func errorFor(code string) error {
+	for _, c := range errorCodes {
+		if c.code == code {
+			return c.err
+		}
+	}
+	return nil
+}
+
+// maps store errors to http status codes.
+func statusFor(e error) int {
+	switch {
+	case errors.Is(e, store.NotFoundErr):
+		return http.StatusNotFound
+	case errors.Is(e, store.ExistingErr):
+		return http.StatusConflict
+	case errors.Is(e, store.TooLargeErr):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(e, store.DiskFullErr):
+		return http.StatusInsufficientStorage
+	case errors.Is(e, store.ReadOnlyErr):
+		return http.StatusForbidden
+	case errors.Is(e, store.ClosedErr),
+		errors.Is(e, store.UnavailableErr),
+		errors.Is(e, store.BusyErr),
+		errors.Is(e, context.Canceled),
+		errors.Is(e, context.DeadlineExceeded):
+		return http.StatusServiceUnavailable
+	case errors.Is(e, store.NilValueErr),
+		errors.Is(e, store.ZeroValueErr),
+		errors.Is(e, store.InvalidKeyErr),
+		errors.Is(e, store.InvalidArchiveErr):
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+// convenience wrapper for mutating handlers. Requests are rejected
+// if the service is in read-only mode.
+func writable(opts Options, fn http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if opts.ReadOnly {
+			onStoreError(w, store.ReadOnlyErr)
+			return
+		}
+		fn(w, req)
+	}
+}
+
+// reads the request body of 'req' as a value of at most 'maxsize' (if
+// non-zero) bytes. Responds with an error and returns false if the
+// value is blank, too large or can not be read.
+func readValue(w http.ResponseWriter, req *http.Request, maxsize int64) ([]byte, bool) {
+	// note: chunked requests have unknown (-1) content length
+	if req.ContentLength == 0 {
+		onError(w, http.StatusBadRequest, "value data not provided")
+		return nil, false
+	}
+	if maxsize > 0 {
+		if req.ContentLength > maxsize {
+			onStoreError(w, store.TooLargeErr)
+			return nil, false
+		}
+		req.Body = http.MaxBytesReader(w, req.Body, maxsize)
+	}
+
+	blob, e := ioutil.ReadAll(req.Body)
+	if e != nil {
+		var maxerr *http.MaxBytesError
+		if errors.As(e, &maxerr) {
+			onStoreError(w, store.TooLargeErr)
+			return nil, false
+		}
+		onError(w, http.StatusInternalServerError, "%s", e)
+		return nil, false
+	}
+	return blob, true
+}
+
+// parses hex encoded key 'keystr'. Responds with an error and returns
+// false if the key is blank or invalid.
+func parseKey(w http.ResponseWriter, keystr string) (store.Key, bool) {
+	if keystr == "" {
+		onError(w, http.StatusBadRequest, "key not provided")
+		return store.Key{}, false
+	}
+	key, e := store.ParseKey(keystr)
+	if e != nil {
+		onStoreError(w, e)
+		return key, false
+	}
+	return key, true
+}
+
 /// handlers //////////////////////////////////////////////////////////////////
 
 // returns a new http request handler function for Set semantics
@@ -64,7 +420,8 @@ func onError(w http.ResponseWriter, code int, fmtstr string, args ...interface{}
 // The returned handler will service POST method requests, with request
 // body (binary blob) uses as 'value' to store. Successful addtions to store
 // will result in return of (hex encoded) key or error as returned by the db.
-func getSetHandler(db store.Store) func(http.ResponseWriter, *http.Request) {
+// Request bodies larger than 'maxsize' (if non-zero) are rejected.
+func getSetHandler(db store.Store, maxsize int64) func(http.ResponseWriter, *http.Request) {
 
 	return func(w http.ResponseWriter, req *http.Request) {
 		/* assert constraints */
@@ -72,29 +429,23 @@ func getSetHandler(db store.Store) func(http.ResponseWriter, *http.Request) {
 			onError(w, http.StatusBadRequest, "expect POST method - have %s", req.Method)
 			return
 		}
-		if req.ContentLength < 1 {
-			onError(w, http.StatusBadRequest, "value data not provided")
-			return
-		}
 
 		// get post data
-		blob, e := ioutil.ReadAll(req.Body)
-		if e != nil {
-			onError(w, http.StatusInternalServerError, e.Error())
+		blob, ok := readValue(w, req, maxsize)
+		if !ok {
 			return
 		}
 
 		// process request
-		key, e := db.Put(blob)
+		key, e := db.PutContext(req.Context(), blob)
 		if e != nil {
-			// TODO: need to distinguish top level errors e.g. NotFouund
-			// REVU: ok for now
-			onError(w, http.StatusBadRequest, e.Error())
+			onStoreError(w, e)
 			return
 		}
 
 		// post response - note binary key is hex encoded
 		encoded := []byte(hex.EncodeToString(key[:]))
+		logKey(w, string(encoded))
 		w.Write(encoded)
 
 		return
@@ -102,36 +453,27 @@ func getSetHandler(db store.Store) func(http.ResponseWriter, *http.Request) {
 }
 
 // returns a new http request handler function for Get semantics
-func getGetHandler(db store.Store) func(http.ResponseWriter, *http.Request) {
+//
+// See serveBlob.
+func getGetHandler(db store.Store, opts Options) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, req *http.Request) {
 		/* assert constraints */
-		if req.Method != "GET" {
+		if req.Method != "GET" && req.Method != "HEAD" {
 			onError(w, http.StatusBadRequest, "expect GET method - have %s", req.Method)
 			return
 		}
 
 		// service api is assumed as ../get/<sha-hexstring>
 		_, keystr := path.Split(req.URL.Path)
-		if keystr == "" {
-			onError(w, http.StatusBadRequest, "key not provided")
-			return
-		}
-		b, e := hex.DecodeString(keystr)
-		if e != nil {
-			onError(w, http.StatusBadRequest, e.Error())
+		key, ok := parseKey(w, keystr)
+		if !ok {
 			return
 		}
 
 		// process request
-		var key store.Key
-		copy(key[:], b)
-		val, e := db.Get(key)
-		if e != nil {
-			onError(w, http.StatusBadRequest, e.Error())
-			return
-		}
 		// post response - note value is returned in binary form as original
-		w.Write(val)
+		// and written directly from the store's transaction (zero-copy).
+		serveBlob(w, req, db, key, opts)
 	}
 }
 
@@ -144,24 +486,17 @@ func getDelHandler(db store.Store) func(http.ResponseWriter, *http.Request) {
 			return
 		}
 
-		// service api is assumed as ../get/<sha-hexstring>
+		// service api is assumed as ../del/<sha-hexstring>
 		_, keystr := path.Split(req.URL.Path)
-		if keystr == "" {
-			onError(w, http.StatusBadRequest, "key not provided")
-			return
-		}
-		b, e := hex.DecodeString(keystr)
-		if e != nil {
-			onError(w, http.StatusBadRequest, e.Error())
+		key, ok := parseKey(w, keystr)
+		if !ok {
 			return
 		}
 
 		// process request
-		var key store.Key
-		copy(key[:], b)
-		val, e := db.Del(key)
+		val, e := db.DelContext(req.Context(), key)
 		if e != nil {
-			onError(w, http.StatusBadRequest, e.Error())
+			onStoreError(w, e)
 			return
 		}
 		// post response - note value is returned in binary form as original
@@ -177,16 +512,87 @@ func getInfoHandler(db store.Store) func(http.ResponseWriter, *http.Request) {
 		}
 
 		// process request
-		info, e := db.Info()
+		info, e := db.InfoContext(req.Context())
 		if e != nil {
-			onError(w, http.StatusBadRequest, e.Error())
+			onStoreError(w, e)
 			return
 		}
 		// post response - note value is returned in binary form as original
 		w.Write(info)
 	}
 }
-func getShutdownHandler(db store.Store, shutdownFn func(error) error) func(http.ResponseWriter, *http.Request) {
+func getShutdownHandler(shutdownFn func(error) error) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, req *http.Request) {
+		/* assert constraints */
+		if req.Method != "GET" {
+			onError(w, http.StatusBadRequest, "expect GET method - have %s", req.Method)
+			return
+		}
+
+		// process request - the server drains in-flight requests,
+		// including this one, before the store is closed.
+		e := shutdownFn(nil)
+		if e != nil {
+			onError(w, http.StatusInternalServerError, "%s", e)
+			return
+		}
+		// post response
+		w.Write([]byte("shutdown"))
+	}
+}
+
+// returns a new http request handler function for online backups.
+//
+// The returned handler streams a consistent snapshot of the database
+// file as the response body.
+func getBackupHandler(db store.Store) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, req *http.Request) {
+		/* assert constraints */
+		if req.Method != "GET" {
+			onError(w, http.StatusBadRequest, "expect GET method - have %s", req.Method)
+			return
+		}
+
+		// process request
+		w.Header().Set("Content-Type", mimetype)
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", store.DefaultDb))
+		// backups of large dbs outlast the server's write timeout
+		http.NewResponseController(w).SetWriteDeadline(time.Time{})
+		bw := &backupWriter{w: w}
+		if _, e := db.BackupContext(req.Context(), bw); e != nil {
+			if bw.written {
+				// headers are sent. abort the response so the client
+				// sees a truncated body and not a complete backup.
+				logging.FromContext(req.Context()).Warn("backup aborted", "error", e)
+				panic(http.ErrAbortHandler)
+			}
+			onStoreErrorf(w, e, "backup - %s", e)
+			return
+		}
+	}
+}
+
+// type sets the Content-Length of backup responses, and tracks if the
+// response (headers) have been written. See store.SizedWriter.
+type backupWriter struct {
+	w       http.ResponseWriter
+	written bool
+}
+
+func (p *backupWriter) SetSize(n int64) {
+	p.w.Header().Set("Content-Length", strconv.FormatInt(n, 10))
+}
+
+func (p *backupWriter) Write(b []byte) (int, error) {
+	p.written = true
+	return p.w.Write(b)
+}
+
+// returns a new http request handler function for archive exports.
+//
+// The returned handler streams a (tar) export archive of all blobs
+// as the response body. See store.Export.
+func getExportHandler(db store.Store) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, req *http.Request) {
 		/* assert constraints */
 		if req.Method != "GET" {
@@ -195,18 +601,77 @@ func getShutdownHandler(db store.Store, shutdownFn func(error) error) func(http.
 		}
 
 		// process request
-		e := db.Close()
+		w.Header().Set("Content-Type", "application/x-tar")
+		http.NewResponseController(w).SetWriteDeadline(time.Time{})
+		bw := &backupWriter{w: w}
+		if _, e := store.ExportContext(req.Context(), db, bw); e != nil {
+			if bw.written {
+				// headers are sent. see getBackupHandler
+				logging.FromContext(req.Context()).Warn("export aborted", "error", e)
+				panic(http.ErrAbortHandler)
+			}
+			onStoreErrorf(w, e, "export - %s", e)
+			return
+		}
+	}
+}
+
+// returns a new http request handler function for archive imports.
+//
+// The returned handler will service POST method requests, with request
+// body an export archive. Response is the count of imported blobs.
+func getImportHandler(db store.Store, maxsize int64) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, req *http.Request) {
+		/* assert constraints */
+		if req.Method != "POST" {
+			onError(w, http.StatusBadRequest, "expect POST method - have %s", req.Method)
+			return
+		}
+		if maxsize > 0 {
+			if req.ContentLength > maxsize {
+				onStoreErrorf(w, store.TooLargeErr, "import - %s", store.TooLargeErr)
+				return
+			}
+			req.Body = http.MaxBytesReader(w, req.Body, maxsize)
+		}
+		// reading large archives outlasts the server's write timeout
+		http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+		// process request
+		n, e := store.ImportContext(req.Context(), db, req.Body)
 		if e != nil {
-			onError(w, http.StatusBadRequest, e.Error())
+			var maxerr *http.MaxBytesError
+			if errors.As(e, &maxerr) {
+				onStoreErrorf(w, store.TooLargeErr, "import - %d blobs imported - %s", n, store.TooLargeErr)
+				return
+			}
+			onStoreErrorf(w, e, "import - %d blobs imported - %s", n, e)
 			return
 		}
+		fmt.Fprintf(w, "%d", n)
+	}
+}
 
-		e = shutdownFn(nil)
+// returns a new http request handler function for online compaction.
+//
+// The returned handler will service POST method requests. Writers are
+// briefly blocked while the compacted db is swapped in, and compaction
+// fails with 503 while a backup or export is in progress. Response
+// reports the db file size before and after compaction.
+func getCompactHandler(db store.Store) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, req *http.Request) {
+		/* assert constraints */
+		if req.Method != "POST" {
+			onError(w, http.StatusBadRequest, "expect POST method - have %s", req.Method)
+			return
+		}
+
+		// process request
+		before, after, e := db.CompactContext(req.Context())
 		if e != nil {
-			onError(w, http.StatusInternalServerError, e.Error())
+			onStoreErrorf(w, e, "compact - %s", e)
 			return
 		}
-		// post response - note value is returned in binary form as original
-		w.Write([]byte("shutdown"))
+		fmt.Fprintf(w, "compact: before:%d - after:%d\n", before, after)
 	}
 }
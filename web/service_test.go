@@ -0,0 +1,418 @@
+//    Copyright © 2016 Joubin Houshyar. All rights reserved.
+//
+//    This file is part of Frankinstore.
+//
+//    Frankinstore is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU Affero General Public License as
+//    published by the Free Software Foundation, either version 3 of
+//    the License, or (at your option) any later version.
+//
+//    Frankinstore is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU Affero General Public License for more details.
+//
+//    You should have received a copy of the GNU Affero General Public
+//    License along with Frankinstore.  If not, see <http://www.gnu.org/licenses/>.
+
+package web
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/alphazero/borisdb/logging"
+	"github.com/alphazero/borisdb/store"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// type fails backups and iterations after some output is written.
+type failingStore struct {
+	store.Store
+}
+
+var failingErr = errors.New("failing store")
+
+func (p failingStore) BackupContext(ctx context.Context, w io.Writer) (int64, error) {
+	n, _ := w.Write(make([]byte, 4096))
+	return int64(n), failingErr
+}
+
+func (p failingStore) ForEachContext(ctx context.Context, fn func(store.Key, []byte) error) error {
+	return failingErr
+}
+
+func TestBackupHandler(t *testing.T) {
+	db, srv := startTestService(t, Options{AdminToken: "secret"})
+	for i := 0; i < 100; i++ {
+		if _, e := db.Put([]byte(fmt.Sprintf("blob-%d", i))); e != nil {
+			t.Fatal(e)
+		}
+	}
+	resp, body := do(t, "GET", srv.URL+"/admin/backup", nil, "Authorization", "Bearer secret")
+	if resp.StatusCode != http.StatusOK || resp.ContentLength <= 0 || resp.ContentLength != int64(len(body)) {
+		t.Fatalf("GET backup = %d length %d - have %d bytes", resp.StatusCode, resp.ContentLength, len(body))
+	}
+	name := filepath.Join(t.TempDir(), store.DefaultDb)
+	if e := os.WriteFile(name, []byte(body), 0600); e != nil {
+		t.Fatal(e)
+	}
+	if e := store.Verify(name); e != nil {
+		t.Errorf("Verify backup: %v", e)
+	}
+}
+
+// responses failing mid-stream are aborted and never look complete.
+func TestStreamAborted(t *testing.T) {
+	db := failingStore{openTestDb(t)}
+	for _, uri := range []string{"/admin/backup", "/admin/export"} {
+		var fn http.HandlerFunc = getBackupHandler(db)
+		if uri == "/admin/export" {
+			fn = getExportHandler(db)
+		}
+		srv := httptest.NewServer(fn)
+		resp, e := http.Get(srv.URL + uri)
+		if e == nil {
+			_, e = io.ReadAll(resp.Body)
+			resp.Body.Close()
+		}
+		if e == nil {
+			t.Errorf("GET %s = %d; want aborted response", uri, resp.StatusCode)
+		}
+		srv.Close()
+	}
+}
+
+// blob size and store size limits are enforced by the handlers.
+func TestLimits(t *testing.T) {
+	db, e := store.OpenDb(filepath.Join(t.TempDir(), store.DefaultDb), &store.Options{MaxSize: 1024})
+	if e != nil {
+		t.Fatal(e)
+	}
+	t.Cleanup(func() { db.Close() })
+	srv := serveTestDb(t, db, Options{MaxBlobSize: 512})
+
+	for _, tc := range []struct {
+		name   string
+		method string
+		uri    string
+		val    []byte
+		status int
+	}{
+		{"post", "POST", blobsPath, bytes.Repeat([]byte("a"), 400), http.StatusCreated},
+		{"post too large", "POST", blobsPath, bytes.Repeat([]byte("b"), 513), http.StatusRequestEntityTooLarge},
+		{"set too large", "POST", "/set", bytes.Repeat([]byte("b"), 513), http.StatusRequestEntityTooLarge},
+		{"post full", "POST", blobsPath, bytes.Repeat([]byte("c"), 400), http.StatusCreated},
+		{"post disk full", "POST", blobsPath, bytes.Repeat([]byte("d"), 400), http.StatusInsufficientStorage},
+		{"set disk full", "POST", "/set", bytes.Repeat([]byte("e"), 400), http.StatusInsufficientStorage},
+	} {
+		if resp, body := do(t, tc.method, srv.URL+tc.uri, tc.val); resp.StatusCode != tc.status {
+			t.Errorf("%s: %s %s = %d %q; want %d", tc.name, tc.method, tc.uri, resp.StatusCode, body, tc.status)
+		}
+	}
+}
+
+func TestImportLimit(t *testing.T) {
+	src := openTestDb(t)
+	for i := 0; i < 100; i++ {
+		if _, e := src.Put([]byte(fmt.Sprintf("blob-%d", i))); e != nil {
+			t.Fatal(e)
+		}
+	}
+	var archive bytes.Buffer
+	if _, e := store.Export(src, &archive); e != nil {
+		t.Fatal(e)
+	}
+	auth := []string{"Authorization", "Bearer secret"}
+
+	_, srv := startTestService(t, Options{AdminToken: "secret", MaxImportSize: int64(archive.Len() / 2)})
+	if resp, body := do(t, "POST", srv.URL+"/admin/import", archive.Bytes(), auth...); resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("POST import = %d %q; want 413", resp.StatusCode, body)
+	}
+	// chunked requests are limited while reading
+	req, e := http.NewRequest("POST", srv.URL+"/admin/import", io.MultiReader(bytes.NewReader(archive.Bytes())))
+	if e != nil {
+		t.Fatal(e)
+	}
+	req.Header.Set(auth[0], auth[1])
+	if resp, e := http.DefaultClient.Do(req); e != nil || resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("POST chunked import = %v, %v; want 413", resp, e)
+	} else {
+		resp.Body.Close()
+	}
+
+	_, srv = startTestService(t, Options{AdminToken: "secret", MaxImportSize: int64(archive.Len())})
+	if resp, body := do(t, "POST", srv.URL+"/admin/import", archive.Bytes(), auth...); resp.StatusCode != http.StatusOK || body != "100" {
+		t.Errorf("POST import = %d %q; want 200 100", resp.StatusCode, body)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	name := filepath.Join(t.TempDir(), store.DefaultDb)
+	db, e := store.OpenDb(name, nil)
+	if e != nil {
+		t.Fatal(e)
+	}
+	val := []byte("read-only")
+	key, e := db.Put(val)
+	if e != nil {
+		t.Fatal(e)
+	}
+	db.Close()
+	if db, e = store.OpenDb(name, &store.Options{ReadOnly: true}); e != nil {
+		t.Fatal(e)
+	}
+	t.Cleanup(func() { db.Close() })
+	srv := serveTestDb(t, db, Options{AdminToken: "secret", ReadOnly: true})
+	blob := srv.URL + blobsPath + "/" + key.String()
+	other := []byte("other")
+
+	for _, tc := range []struct {
+		method string
+		uri    string
+		body   []byte
+	}{
+		{"POST", srv.URL + "/set", other},
+		{"GET", srv.URL + "/del/" + key.String(), nil},
+		{"POST", srv.URL + blobsPath, other},
+		{"PUT", srv.URL + blobsPath + "/" + store.KeyOf(other).String(), other},
+		{"DELETE", blob, nil},
+		{"GET", srv.URL + "/shutdown", nil},
+		{"POST", srv.URL + "/admin/import", other},
+		{"POST", srv.URL + "/admin/compact", nil},
+	} {
+		resp, body := do(t, tc.method, tc.uri, tc.body, "Authorization", "Bearer secret")
+		if resp.StatusCode != http.StatusForbidden {
+			t.Errorf("%s %s = %d %q; want 403", tc.method, tc.uri, resp.StatusCode, body)
+		}
+	}
+
+	if resp, body := do(t, "GET", blob, nil); resp.StatusCode != http.StatusOK || body != string(val) {
+		t.Errorf("GET = %d %q; want 200 %q", resp.StatusCode, body, val)
+	}
+	if resp, body := do(t, "GET", srv.URL+"/info", nil); resp.StatusCode != http.StatusOK || len(body) == 0 {
+		t.Errorf("GET info = %d %q; want 200", resp.StatusCode, body)
+	}
+	if v, e := db.Get(store.KeyOf(other)); !errors.Is(e, store.NotFoundErr) {
+		t.Errorf("Get other = %q, %v - expect NotFoundErr", v, e)
+	}
+}
+
+// log buffer safe for concurrent writers.
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (p *logBuffer) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.buf.Write(b)
+}
+
+func (p *logBuffer) String() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.buf.String()
+}
+
+// the request id of the client tags the access and store log records.
+func TestRequestIDLogged(t *testing.T) {
+	var logs logBuffer
+	logger, e := logging.New(&logs, logging.JSON, "debug")
+	if e != nil {
+		t.Fatal(e)
+	}
+	prev := logging.Default()
+	logging.SetDefault(logger)
+	t.Cleanup(func() { logging.SetDefault(prev) })
+
+	_, srv := startTestService(t, Options{})
+	key := store.KeyOf([]byte("missing"))
+	resp, _ := do(t, "GET", srv.URL+blobsPath+"/"+key.String(), nil, requestIDHeader, "test-request-1")
+	if resp.StatusCode != http.StatusNotFound || resp.Header.Get(requestIDHeader) != "test-request-1" {
+		t.Fatalf("GET = %d %s %q; want 404 test-request-1", resp.StatusCode, requestIDHeader, resp.Header.Get(requestIDHeader))
+	}
+
+	records := map[string]bool{}
+	for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		var rec map[string]interface{}
+		if e := json.Unmarshal([]byte(line), &rec); e != nil {
+			t.Fatalf("log record %q: %v", line, e)
+		}
+		if rec[logging.RequestIDKey] == "test-request-1" {
+			records[rec["msg"].(string)] = true
+		}
+	}
+	for _, msg := range []string{"access", "store op failed"} {
+		if !records[msg] {
+			t.Errorf("no %q log record with request id - have %s", msg, logs.String())
+		}
+	}
+}
+
+// instrumented handlers support http.ResponseController.
+func TestResponseController(t *testing.T) {
+	fn := instrument("test", func(w http.ResponseWriter, req *http.Request) {
+		rc := http.NewResponseController(w)
+		if e := rc.SetWriteDeadline(time.Now().Add(time.Minute)); e != nil {
+			t.Errorf("SetWriteDeadline: %v", e)
+		}
+		if e := rc.Flush(); e != nil {
+			t.Errorf("Flush: %v", e)
+		}
+	})
+	srv := httptest.NewServer(fn)
+	defer srv.Close()
+	if resp, body := do(t, "GET", srv.URL, nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("GET = %d %q", resp.StatusCode, body)
+	}
+}
+
+// returns a free local tcp port.
+func freePort(t *testing.T) int {
+	t.Helper()
+	ln, e := net.Listen("tcp", "127.0.0.1:0")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+// starts the service for 'opts' on a free port, and returns the
+// service and its base url.
+func runTestService(t *testing.T, db store.Store, opts Options) (*Service, string) {
+	t.Helper()
+	port := freePort(t)
+	svc, e := RunService(port, db, opts, func(e error) error { return e })
+	if e != nil {
+		t.Fatal(e)
+	}
+	t.Cleanup(func() { svc.Shutdown(context.Background()) })
+	return svc, fmt.Sprintf("http://127.0.0.1:%d", port)
+}
+
+func TestServerTimeouts(t *testing.T) {
+	svc, uri := runTestService(t, openTestDb(t), Options{ReadHeaderTimeout: 100 * time.Millisecond})
+	if s := svc.server; s.WriteTimeout != DefaultWriteTimeout || s.IdleTimeout != DefaultIdleTimeout {
+		t.Errorf("timeouts write:%s idle:%s - expect defaults", s.WriteTimeout, s.IdleTimeout)
+	}
+
+	// connections stalling request headers are closed
+	conn, e := net.Dial("tcp", strings.TrimPrefix(uri, "http://"))
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer conn.Close()
+	if _, e := conn.Write([]byte("GET /healthz HTTP/1.1\r\nHost: x\r\n")); e != nil {
+		t.Fatal(e)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, e := io.ReadAll(conn); e != nil {
+		t.Errorf("stalled request: %v - expect closed connection", e)
+	}
+}
+
+// large blobs are not served from the store's transaction, which would
+// block compaction until the client reads the response.
+func TestLargeBlobCopied(t *testing.T) {
+	db, srv := startTestService(t, Options{})
+	val := make([]byte, 32<<20)
+	rand.New(rand.NewSource(1)).Read(val)
+	key, e := db.Put(val)
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	resp, e := http.Get(srv.URL + blobsPath + "/" + key.String())
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer resp.Body.Close()
+	done := make(chan error, 1)
+	go func() {
+		_, _, e := db.Compact()
+		done <- e
+	}()
+	select {
+	case e := <-done:
+		if e != nil {
+			t.Fatalf("Compact: %v", e)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Compact blocked by blob response")
+	}
+	body, e := io.ReadAll(resp.Body)
+	if e != nil || !bytes.Equal(body, val) {
+		t.Errorf("GET = %d bytes, %v - expect %d bytes", len(body), e, len(val))
+	}
+}
+
+// Shutdown waits for in-flight requests, so the store is closed only
+// once they complete.
+func TestShutdownDrains(t *testing.T) {
+	db := openTestDb(t)
+	port := freePort(t)
+	svc, e := RunService(port, db, Options{}, func(e error) error { return e })
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	// the request is in-flight until its body is complete
+	val := []byte("in-flight")
+	pr, pw := io.Pipe()
+	status := make(chan int, 1)
+	go func() {
+		resp, e := http.Post(fmt.Sprintf("http://127.0.0.1:%d%s", port, blobsPath), "application/octet-stream", pr)
+		if e != nil {
+			t.Errorf("POST: %v", e)
+			status <- 0
+			return
+		}
+		resp.Body.Close()
+		status <- resp.StatusCode
+	}()
+	if _, e := pw.Write(val[:2]); e != nil {
+		t.Fatal(e)
+	}
+	time.Sleep(100 * time.Millisecond) // let the handler block on the body
+
+	stopped := make(chan error, 1)
+	go func() { stopped <- svc.Shutdown(context.Background()) }()
+	select {
+	case e := <-stopped:
+		t.Fatalf("Shutdown = %v - before the in-flight request completed", e)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	pw.Write(val[2:])
+	pw.Close()
+	if code := <-status; code != http.StatusCreated {
+		t.Errorf("in-flight POST = %d; want 201", code)
+	}
+	if e := <-stopped; e != nil {
+		t.Errorf("Shutdown: %v", e)
+	}
+	if v, e := db.Get(store.KeyOf(val)); e != nil || !bytes.Equal(v, val) {
+		t.Errorf("Get in-flight blob = %q, %v", v, e)
+	}
+	if e := db.Close(); e != nil {
+		t.Fatal(e)
+	}
+	if _, e := http.Get(fmt.Sprintf("http://127.0.0.1:%d/healthz", port)); e == nil {
+		t.Errorf("GET after Shutdown - expect connection error")
+	}
+}
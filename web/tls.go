@@ -0,0 +1,130 @@
+//    Copyright © 2016 Joubin Houshyar. All rights reserved.
+//
+//    This file is part of Frankinstore.
+//
+//    Frankinstore is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU Affero General Public License as
+//    published by the Free Software Foundation, either version 3 of
+//    the License, or (at your option) any later version.
+//
+//    Frankinstore is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU Affero General Public License for more details.
+//
+//    You should have received a copy of the GNU Affero General Public
+//    License along with Frankinstore.  If not, see <http://www.gnu.org/licenses/>.
+
+package web
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sync"
+)
+
+/// server tls ////////////////////////////////////////////////////////////////
+
+// type holds the service certificate and supports reloading it from
+// its files, e.g. on renewal.
+type certReloader struct {
+	certFile string
+	keyFile  string
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if e := r.reload(); e != nil {
+		return nil, e
+	}
+	return r, nil
+}
+
+// loads the certificate files. The current certificate is kept on error.
+func (r *certReloader) reload() error {
+	cert, e := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if e != nil {
+		return fmt.Errorf("err - tls - %w", e)
+	}
+	r.mu.Lock()
+	r.cert = &cert
+	r.mu.Unlock()
+	return nil
+}
+
+// supports tls.Config.GetCertificate
+func (r *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// returns the service tls config for 'opts', or nil if opts.TLSCert
+// is zerovalue. Client certificates are required and verified if
+// opts.ClientCA is set.
+func serverTLSConfig(opts Options) (*tls.Config, *certReloader, error) {
+	if opts.TLSCert == "" {
+		if opts.TLSKey != "" || opts.ClientCA != "" {
+			return nil, nil, fmt.Errorf("err - tls - key and client CA require a certificate")
+		}
+		return nil, nil, nil
+	}
+	certs, e := newCertReloader(opts.TLSCert, opts.TLSKey)
+	if e != nil {
+		return nil, nil, e
+	}
+	cfg := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: certs.getCertificate,
+	}
+	if opts.ClientCA != "" {
+		pool, e := loadCertPool(opts.ClientCA)
+		if e != nil {
+			return nil, nil, e
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, certs, nil
+}
+
+/// client tls ////////////////////////////////////////////////////////////////
+
+// LoadClientTLS returns a client tls config that verifies the service
+// against CA bundle 'caFile', or the system roots if caFile is blank,
+// and presents the certificate 'certFile', 'keyFile' if not blank.
+func LoadClientTLS(caFile, certFile, keyFile string) (*tls.Config, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		pool, e := loadCertPool(caFile)
+		if e != nil {
+			return nil, e
+		}
+		cfg.RootCAs = pool
+	}
+	if certFile != "" || keyFile != "" {
+		cert, e := tls.LoadX509KeyPair(certFile, keyFile)
+		if e != nil {
+			return nil, fmt.Errorf("err - tls - %w", e)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+// loads the PEM certificates of CA bundle file 'name'.
+func loadCertPool(name string) (*x509.CertPool, error) {
+	pem, e := os.ReadFile(name)
+	if e != nil {
+		return nil, fmt.Errorf("err - tls - %w", e)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("err - tls - no certificates in %s", name)
+	}
+	return pool, nil
+}
@@ -0,0 +1,222 @@
+//    Copyright © 2016 Joubin Houshyar. All rights reserved.
+//
+//    This file is part of Frankinstore.
+//
+//    Frankinstore is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU Affero General Public License as
+//    published by the Free Software Foundation, either version 3 of
+//    the License, or (at your option) any later version.
+//
+//    Frankinstore is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU Affero General Public License for more details.
+//
+//    You should have received a copy of the GNU Affero General Public
+//    License along with Frankinstore.  If not, see <http://www.gnu.org/licenses/>.
+
+package web
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+/// test pki //////////////////////////////////////////////////////////////////
+
+type testCert struct {
+	cert     *x509.Certificate
+	key      *ecdsa.PrivateKey
+	certFile string
+	keyFile  string
+}
+
+// issues a certificate signed by 'ca', or a self-signed CA if ca is nil,
+// and writes it as PEM files to 'dir'.
+func issueCert(t *testing.T, dir, name string, serial int64, ca *testCert) *testCert {
+	t.Helper()
+	key, e := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if e != nil {
+		t.Fatal(e)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	parent, signer := tmpl, key
+	if ca == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		parent, signer = ca.cert, ca.key
+	}
+	der, e := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, signer)
+	if e != nil {
+		t.Fatal(e)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+
+	tc := &testCert{
+		cert:     cert,
+		key:      key,
+		certFile: filepath.Join(dir, name+".crt"),
+		keyFile:  filepath.Join(dir, name+".key"),
+	}
+	writePem(t, tc.certFile, "CERTIFICATE", der)
+	writePem(t, tc.keyFile, "EC PRIVATE KEY", keyDer)
+	return tc
+}
+
+func writePem(t *testing.T, name, typ string, der []byte) {
+	t.Helper()
+	b := pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der})
+	if e := os.WriteFile(name, b, 0600); e != nil {
+		t.Fatal(e)
+	}
+}
+
+// starts a https test server for 'opts' and returns a client for it.
+func startTLSServer(t *testing.T, opts Options) (*httptest.Server, *certReloader, *Client) {
+	t.Helper()
+	cfg, certs, e := serverTLSConfig(opts)
+	if e != nil {
+		t.Fatalf("serverTLSConfig error = %v", e)
+	}
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	// serve the config as is, as StartTLS would add its own certificate
+	srv.Listener = tls.NewListener(srv.Listener, cfg)
+	srv.Config.ErrorLog = log.New(io.Discard, "", 0)
+	srv.Start()
+	t.Cleanup(srv.Close)
+
+	host, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+	portnum, _ := strconv.Atoi(port)
+	client, _ := NewClient(host, portnum)
+	return srv, certs, client
+}
+
+/// tests /////////////////////////////////////////////////////////////////////
+
+func TestTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := issueCert(t, dir, "ca", 1, nil)
+	server := issueCert(t, dir, "server", 2, ca)
+
+	_, _, client := startTLSServer(t, Options{TLSCert: server.certFile, TLSKey: server.keyFile})
+
+	// plain client does not trust the test CA
+	cfg, e := LoadClientTLS("", "", "")
+	if e != nil {
+		t.Fatal(e)
+	}
+	client.SetTLS(cfg)
+	if _, e := client.Info(); e == nil {
+		t.Errorf("Info with system roots error = nil; want verification error")
+	}
+
+	cfg, e = LoadClientTLS(ca.certFile, "", "")
+	if e != nil {
+		t.Fatal(e)
+	}
+	client.SetTLS(cfg)
+	if v, e := client.Info(); e != nil || string(v) != "ok" {
+		t.Errorf("Info = %q, %v; want ok, nil", v, e)
+	}
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := issueCert(t, dir, "ca", 1, nil)
+	server := issueCert(t, dir, "server", 2, ca)
+	clientCert := issueCert(t, dir, "client", 3, ca)
+	otherCA := issueCert(t, dir, "other-ca", 4, nil)
+	otherCert := issueCert(t, dir, "other-client", 5, otherCA)
+
+	opts := Options{TLSCert: server.certFile, TLSKey: server.keyFile, ClientCA: ca.certFile}
+	_, _, client := startTLSServer(t, opts)
+
+	for _, tc := range []struct {
+		name    string
+		cert    *testCert
+		wantErr bool
+	}{
+		{"no client cert", nil, true},
+		{"untrusted client cert", otherCert, true},
+		{"trusted client cert", clientCert, false},
+	} {
+		certFile, keyFile := "", ""
+		if tc.cert != nil {
+			certFile, keyFile = tc.cert.certFile, tc.cert.keyFile
+		}
+		cfg, e := LoadClientTLS(ca.certFile, certFile, keyFile)
+		if e != nil {
+			t.Fatal(e)
+		}
+		client.SetTLS(cfg)
+		if _, e := client.Info(); (e != nil) != tc.wantErr {
+			t.Errorf("%s: Info error = %v; want error %t", tc.name, e, tc.wantErr)
+		}
+	}
+}
+
+func TestCertReload(t *testing.T) {
+	dir := t.TempDir()
+	ca := issueCert(t, dir, "ca", 1, nil)
+	server := issueCert(t, dir, "server", 2, ca)
+
+	srv, certs, _ := startTLSServer(t, Options{TLSCert: server.certFile, TLSKey: server.keyFile})
+	serial := func() int64 {
+		conn, e := tls.Dial("tcp", srv.Listener.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+		if e != nil {
+			t.Fatal(e)
+		}
+		defer conn.Close()
+		return conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64()
+	}
+	if n := serial(); n != 2 {
+		t.Fatalf("serial = %d; want 2", n)
+	}
+
+	// renew in place
+	issueCert(t, dir, "server", 6, ca)
+	if e := certs.reload(); e != nil {
+		t.Fatalf("reload error = %v", e)
+	}
+	if n := serial(); n != 6 {
+		t.Errorf("serial after reload = %d; want 6", n)
+	}
+
+	// broken files keep the current certificate
+	os.WriteFile(server.keyFile, []byte("garbage"), 0600)
+	if e := certs.reload(); e == nil {
+		t.Errorf("reload of invalid key error = nil; want error")
+	}
+	if n := serial(); n != 6 {
+		t.Errorf("serial after failed reload = %d; want 6", n)
+	}
+}
@@ -0,0 +1,534 @@
+//    Copyright © 2016 Joubin Houshyar. All rights reserved.
+//
+//    This file is part of Frankinstore.
+//
+//    Frankinstore is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU Affero General Public License as
+//    published by the Free Software Foundation, either version 3 of
+//    the License, or (at your option) any later version.
+//
+//    Frankinstore is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU Affero General Public License for more details.
+//
+//    You should have received a copy of the GNU Affero General Public
+//    License along with Frankinstore.  If not, see <http://www.gnu.org/licenses/>.
+
+package web
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/alphazero/borisdb/logging"
+	"github.com/alphazero/borisdb/store"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/// upload sessions ///////////////////////////////////////////////////////////
+
+// Large blobs can be uploaded in parts, in upload sessions:
+//
+//	POST   /v2/uploads                     creates a session. Answers its status.
+//	PUT    /v2/uploads/<id>/<n>?offset=<o>  uploads part n at offset o of the blob.
+//	GET    /v2/uploads/<id>                answers the session status, i.e. the
+//	                                        received parts.
+//	POST   /v2/uploads/<id>/commit[?key=<k>] stores the assembled blob. Answers
+//	                                        the key, as POST /v2/blobs.
+//	DELETE /v2/uploads/<id>                aborts the session.
+//
+// Parts may be sent in any order, and resent, e.g. after a dropped
+// connection. On commit, the parts must cover the blob without gaps or
+// overlaps. If 'key' is given, the assembled blob must hash to it.
+// Parts overlapping other parts, or exceeding the max blob size along
+// with them, are rejected as they are uploaded.
+//
+// Parts are staged in a directory per session, which is removed on
+// commit, abort or expiry. Sessions survive service restarts. Clients
+// (i.e. tokens, or remote ips) are limited to a few open sessions.
+
+const uploadsPath = "/v2/uploads"
+
+// max part number of a session
+const maxUploadParts = 10000
+
+// max open sessions, in total and per client
+const (
+	maxUploadSessions       = 256
+	maxClientUploadSessions = 8
+)
+
+// max blob size unless Options.MaxBlobSize. Blobs are assembled in
+// memory on commit.
+const uploadMaxBlob = 512 << 20
+
+// upload requests that can not be served, e.g. parts with gaps.
+var invalidUploadErr = errors.New("invalid upload")
+
+// sessions exceeding the open session limits.
+var tooManyUploadsErr = errors.New("too many upload sessions")
+
+// session files
+const (
+	uploadMetaFile  = "session.json"
+	uploadOwnerFile = "owner" // client identity of the session creator
+	uploadPartExt   = ".part"
+)
+
+// UploadStatus is the status of an upload session.
+type UploadStatus struct {
+	ID      string       `json:"id"`
+	Created time.Time    `json:"created"`
+	Expires time.Time    `json:"expires"`
+	Parts   []UploadPart `json:"parts"` // received parts, by number
+}
+
+// UploadPart describes a received part of an upload session.
+type UploadPart struct {
+	Number int    `json:"number"`
+	Offset int64  `json:"offset"`
+	Size   int64  `json:"size"`
+	SHA1   string `json:"sha1"`
+}
+
+// type manages the upload sessions staged in 'dir'.
+type uploadManager struct {
+	dir     string
+	ttl     time.Duration // sessions expire after ttl without activity
+	maxsize int64         // max blob size
+	mu      sync.Mutex    // serializes session updates
+	swept   time.Time     // last sweep of expired sessions
+}
+
+// returns a new upload manager, or nil if uploads are not configured.
+// Sessions of earlier runs are resumed, unless expired.
+func newUploadManager(opts Options) (*uploadManager, error) {
+	if opts.UploadDir == "" {
+		return nil, nil
+	}
+	if e := os.MkdirAll(opts.UploadDir, 0700); e != nil {
+		return nil, fmt.Errorf("err - uploads - %w", e)
+	}
+	ttl := opts.UploadTTL
+	if ttl <= 0 {
+		ttl = 24 * time.Hour
+	}
+	maxsize := opts.MaxBlobSize
+	if maxsize <= 0 {
+		maxsize = uploadMaxBlob
+	}
+	m := &uploadManager{dir: opts.UploadDir, ttl: ttl, maxsize: maxsize}
+	m.sweep(time.Now())
+	return m, nil
+}
+
+// removes expired sessions, at most once a minute.
+func (m *uploadManager) sweep(now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if now.Sub(m.swept) < time.Minute {
+		return
+	}
+	m.swept = now
+
+	entries, e := os.ReadDir(m.dir)
+	if e != nil {
+		logging.Default().Warn("upload sweep failed", "error", e)
+		return
+	}
+	for _, entry := range entries {
+		if !validUploadID(entry.Name()) {
+			continue
+		}
+		status, e := m.load(entry.Name())
+		if e == nil && now.Before(status.Expires) {
+			continue
+		}
+		os.RemoveAll(filepath.Join(m.dir, entry.Name()))
+		logging.Default().Info("upload session expired", "upload", entry.Name())
+	}
+}
+
+func validUploadID(id string) bool {
+	if len(id) != 32 {
+		return false
+	}
+	_, e := hex.DecodeString(id)
+	return e == nil
+}
+
+// loads the status of session 'id'. Caller holds m.mu.
+func (m *uploadManager) load(id string) (UploadStatus, error) {
+	var status UploadStatus
+	if !validUploadID(id) {
+		return status, fmt.Errorf("%w - upload %s", store.NotFoundErr, id)
+	}
+	b, e := os.ReadFile(filepath.Join(m.dir, id, uploadMetaFile))
+	if errors.Is(e, os.ErrNotExist) {
+		return status, fmt.Errorf("%w - upload %s", store.NotFoundErr, id)
+	} else if e != nil {
+		return status, e
+	}
+	if e := json.Unmarshal(b, &status); e != nil {
+		return status, fmt.Errorf("%w - upload %s - %s", store.DataCorruptedErr, id, e)
+	}
+	if time.Now().After(status.Expires) {
+		return status, fmt.Errorf("%w - upload %s expired", store.NotFoundErr, id)
+	}
+	return status, nil
+}
+
+// saves the status of a session, extending its expiry. Caller holds m.mu.
+func (m *uploadManager) save(status *UploadStatus) error {
+	status.Expires = time.Now().Add(m.ttl).UTC()
+	sort.Slice(status.Parts, func(i, j int) bool { return status.Parts[i].Number < status.Parts[j].Number })
+	b, _ := json.Marshal(status)
+	tmp := filepath.Join(m.dir, status.ID, uploadMetaFile+".tmp")
+	if e := os.WriteFile(tmp, b, 0600); e != nil {
+		return e
+	}
+	return os.Rename(tmp, filepath.Join(m.dir, status.ID, uploadMetaFile))
+}
+
+func (m *uploadManager) partFile(id string, n int) string {
+	return filepath.Join(m.dir, id, strconv.Itoa(n)+uploadPartExt)
+}
+
+// creates a new session of client 'owner' (see clientIdentity).
+func (m *uploadManager) create(owner string) (UploadStatus, error) {
+	var id [16]byte
+	if _, e := rand.Read(id[:]); e != nil {
+		return UploadStatus{}, e
+	}
+	status := UploadStatus{
+		ID:      hex.EncodeToString(id[:]),
+		Created: time.Now().UTC(),
+		Parts:   []UploadPart{},
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	total, owned, e := m.sessions(owner)
+	if e != nil {
+		return status, e
+	}
+	if total >= maxUploadSessions {
+		return status, fmt.Errorf("%w - %d open sessions", tooManyUploadsErr, total)
+	}
+	if owned >= maxClientUploadSessions {
+		return status, fmt.Errorf("%w - client has %d open sessions", tooManyUploadsErr, owned)
+	}
+	dir := filepath.Join(m.dir, status.ID)
+	if e := os.Mkdir(dir, 0700); e != nil {
+		return status, e
+	}
+	if e := os.WriteFile(filepath.Join(dir, uploadOwnerFile), []byte(owner), 0600); e != nil {
+		os.RemoveAll(dir)
+		return status, e
+	}
+	return status, m.save(&status)
+}
+
+// returns the count of open sessions, in total and of client 'owner'.
+// Caller holds m.mu.
+func (m *uploadManager) sessions(owner string) (total, owned int, err error) {
+	entries, e := os.ReadDir(m.dir)
+	if e != nil {
+		return 0, 0, e
+	}
+	for _, entry := range entries {
+		if _, e := m.load(entry.Name()); e != nil {
+			continue
+		}
+		total++
+		if b, _ := os.ReadFile(filepath.Join(m.dir, entry.Name(), uploadOwnerFile)); string(b) == owner {
+			owned++
+		}
+	}
+	return total, owned, nil
+}
+
+// returns the status of session 'id'.
+func (m *uploadManager) status(id string) (UploadStatus, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.load(id)
+}
+
+// stages part 'n' at 'offset', read from 'r', replacing any earlier
+// upload of the part.
+func (m *uploadManager) putPart(id string, n int, offset int64, r io.Reader) (UploadPart, error) {
+	part := UploadPart{Number: n, Offset: offset}
+	if n < 1 || n > maxUploadParts {
+		return part, fmt.Errorf("%w - part number %d - expect [1, %d]", invalidUploadErr, n, maxUploadParts)
+	}
+	if offset < 0 {
+		return part, fmt.Errorf("%w - part offset %d", invalidUploadErr, offset)
+	}
+	if offset >= m.maxsize {
+		return part, fmt.Errorf("%w - part %d at offset %d", store.TooLargeErr, n, offset)
+	}
+	status, e := m.status(id)
+	if e != nil {
+		return part, e
+	}
+	room, e := m.checkPart(status, part)
+	if e != nil {
+		return part, e
+	}
+	r = io.LimitReader(r, min(m.maxsize-offset, room)+1) // detects, not stages, parts too large
+
+	// stage the data outside the session lock
+	tmp, e := os.CreateTemp(filepath.Join(m.dir, id), "part-*.tmp")
+	if e != nil {
+		return part, e
+	}
+	defer os.Remove(tmp.Name())
+	h := sha1.New()
+	part.Size, e = io.Copy(io.MultiWriter(tmp, h), r)
+	if e0 := tmp.Close(); e == nil {
+		e = e0
+	}
+	if e != nil {
+		return part, e
+	}
+	if part.Size == 0 {
+		return part, fmt.Errorf("%w - empty part %d", store.ZeroValueErr, n)
+	}
+	if offset+part.Size > m.maxsize {
+		return part, fmt.Errorf("%w - part %d ends at %d", store.TooLargeErr, n, offset+part.Size)
+	}
+	part.SHA1 = hex.EncodeToString(h.Sum(nil))
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if status, e = m.load(id); e != nil {
+		return part, e
+	}
+	// parts may have been received meanwhile
+	if _, e := m.checkPart(status, part); e != nil {
+		return part, e
+	}
+	if e := os.Rename(tmp.Name(), m.partFile(id, n)); e != nil {
+		return part, e
+	}
+	parts := status.Parts[:0]
+	for _, p := range status.Parts {
+		if p.Number != n {
+			parts = append(parts, p)
+		}
+	}
+	status.Parts = append(parts, part)
+	return part, m.save(&status)
+}
+
+// checks that part 'p' does not overlap the other parts of session
+// 'status', and does not exceed the max blob size along with them.
+// Returns the remaining room, i.e. bytes that may yet be staged.
+func (m *uploadManager) checkPart(status UploadStatus, p UploadPart) (int64, error) {
+	staged := p.Size
+	for _, q := range status.Parts {
+		if q.Number == p.Number {
+			continue // replaced
+		}
+		if p.Offset < q.Offset+q.Size && q.Offset < p.Offset+max(p.Size, 1) {
+			return 0, fmt.Errorf("%w - part %d at offset %d overlaps part %d", invalidUploadErr, p.Number, p.Offset, q.Number)
+		}
+		staged += q.Size
+	}
+	if staged > m.maxsize {
+		return 0, fmt.Errorf("%w - parts exceed max blob size %d", store.TooLargeErr, m.maxsize)
+	}
+	return m.maxsize - staged, nil
+}
+
+// assembles the blob of session 'id' and returns it with its key. The
+// parts must cover the blob without gaps or overlaps, and are verified
+// as they are read. The session lock is not held while reading.
+func (m *uploadManager) assemble(id string) ([]byte, store.Key, error) {
+	var key store.Key
+	m.mu.Lock()
+	status, e := m.load(id)
+	m.mu.Unlock()
+	if e != nil {
+		return nil, key, e
+	}
+	if len(status.Parts) == 0 {
+		return nil, key, fmt.Errorf("%w - upload %s has no parts", store.ZeroValueErr, id)
+	}
+	parts := status.Parts
+	sort.Slice(parts, func(i, j int) bool { return parts[i].Offset < parts[j].Offset })
+
+	var size int64
+	for _, p := range parts {
+		if p.Offset != size {
+			return nil, key, fmt.Errorf("%w - parts do not cover the blob - part %d at offset %d - expect offset %d", invalidUploadErr, p.Number, p.Offset, size)
+		}
+		size += p.Size
+	}
+	if size > m.maxsize {
+		return nil, key, fmt.Errorf("%w - blob size %d", store.TooLargeErr, size)
+	}
+
+	// parts replaced since the snapshot fail verification
+	blob := make([]byte, size)
+	h := sha1.New()
+	for _, p := range parts {
+		if e := m.readPart(id, p, blob[p.Offset:p.Offset+p.Size], h); e != nil {
+			return nil, key, e
+		}
+	}
+	copy(key[:], h.Sum(nil))
+	return blob, key, nil
+}
+
+// reads part 'p' of session 'id' into 'buf', and verifies its size
+// and hash. The data is also written to 'h'.
+func (m *uploadManager) readPart(id string, p UploadPart, buf []byte, h io.Writer) error {
+	f, e := os.Open(m.partFile(id, p.Number))
+	if e != nil {
+		if os.IsNotExist(e) {
+			return fmt.Errorf("%w - part %d was removed", invalidUploadErr, p.Number)
+		}
+		return e
+	}
+	defer f.Close()
+	ph := sha1.New()
+	r := io.TeeReader(f, io.MultiWriter(ph, h))
+	if _, e := io.ReadFull(r, buf); e != nil {
+		if e == io.ErrUnexpectedEOF || e == io.EOF {
+			return fmt.Errorf("%w - part %d changed", invalidUploadErr, p.Number)
+		}
+		return e
+	}
+	if n, _ := f.Read(make([]byte, 1)); n != 0 || hex.EncodeToString(ph.Sum(nil)) != p.SHA1 {
+		return fmt.Errorf("%w - part %d changed", invalidUploadErr, p.Number)
+	}
+	return nil
+}
+
+// removes session 'id'.
+func (m *uploadManager) remove(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, e := m.load(id); e != nil {
+		return e
+	}
+	return os.RemoveAll(filepath.Join(m.dir, id))
+}
+
+/// handlers //////////////////////////////////////////////////////////////////
+
+// returns a new http request handler function for /v2/uploads.
+//
+// See the upload sessions api above.
+func getUploadsHandler(db store.Store, m *uploadManager) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, req *http.Request) {
+		/* assert constraints */
+		if m == nil {
+			onError(w, http.StatusNotImplemented, "uploads are not enabled")
+			return
+		}
+		m.sweep(time.Now())
+
+		// service api is assumed as /v2/uploads[/<id>[/<n>|/commit]]
+		var args []string
+		if rest := strings.Trim(strings.TrimPrefix(req.URL.Path, uploadsPath), "/"); rest != "" {
+			args = strings.Split(rest, "/")
+		}
+
+		// process request
+		switch {
+		case req.Method == "POST" && len(args) == 0:
+			status, e := m.create(clientIdentity(req))
+			if e != nil {
+				onUploadError(w, e)
+				return
+			}
+			w.Header().Set("Location", uploadsPath+"/"+status.ID)
+			writeJSON(w, http.StatusCreated, status)
+
+		case req.Method == "GET" && len(args) == 1:
+			status, e := m.status(args[0])
+			if e != nil {
+				onUploadError(w, e)
+				return
+			}
+			writeJSON(w, http.StatusOK, status)
+
+		case req.Method == "PUT" && len(args) == 2:
+			n, e := strconv.Atoi(args[1])
+			if e != nil {
+				onError(w, http.StatusBadRequest, "invalid part number %q", args[1])
+				return
+			}
+			offset, e := strconv.ParseInt(req.URL.Query().Get("offset"), 10, 64)
+			if e != nil {
+				onError(w, http.StatusBadRequest, "invalid part offset %q", req.URL.Query().Get("offset"))
+				return
+			}
+			part, e := m.putPart(args[0], n, offset, req.Body)
+			if e != nil {
+				onUploadError(w, e)
+				return
+			}
+			writeJSON(w, http.StatusOK, part)
+
+		case req.Method == "POST" && len(args) == 2 && args[1] == "commit":
+			var want *store.Key
+			if keystr := req.URL.Query().Get("key"); keystr != "" {
+				key, ok := parseKey(w, keystr)
+				if !ok {
+					return
+				}
+				want = &key
+			}
+			blob, key, e := m.assemble(args[0])
+			if e != nil {
+				onUploadError(w, e)
+				return
+			}
+			if want != nil && key != *want {
+				onStoreErrorf(w, store.InvalidKeyErr, "%s - value hashes to %s", store.InvalidKeyErr, key)
+				return
+			}
+			if storeBlob(w, req, db, blob, nil) {
+				m.remove(args[0])
+			}
+
+		case req.Method == "DELETE" && len(args) == 1:
+			if e := m.remove(args[0]); e != nil {
+				onUploadError(w, e)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+
+		default:
+			onError(w, http.StatusMethodNotAllowed, "unsupported method %s for %s", req.Method, req.URL.Path)
+		}
+	}
+}
+
+// convenience error response function for upload errors.
+func onUploadError(w http.ResponseWriter, e error) {
+	if errors.Is(e, invalidUploadErr) {
+		onError(w, http.StatusBadRequest, "%s", e)
+		return
+	}
+	if errors.Is(e, tooManyUploadsErr) {
+		onError(w, http.StatusTooManyRequests, "%s", e)
+		return
+	}
+	onStoreError(w, e)
+}
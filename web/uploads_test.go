@@ -0,0 +1,227 @@
+//    Copyright © 2016 Joubin Houshyar. All rights reserved.
+//
+//    This file is part of Frankinstore.
+//
+//    Frankinstore is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU Affero General Public License as
+//    published by the Free Software Foundation, either version 3 of
+//    the License, or (at your option) any later version.
+//
+//    Frankinstore is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU Affero General Public License for more details.
+//
+//    You should have received a copy of the GNU Affero General Public
+//    License along with Frankinstore.  If not, see <http://www.gnu.org/licenses/>.
+
+package web
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/alphazero/borisdb/store"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// returns a client of test service 'srv'.
+func testClient(t *testing.T, srv *httptest.Server, opts ...ClientOption) *Client {
+	t.Helper()
+	host, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+	portnum, _ := strconv.Atoi(port)
+	client, e := NewClient(host, portnum, opts...)
+	if e != nil {
+		t.Fatal(e)
+	}
+	return client
+}
+
+func TestUploadsAPI(t *testing.T) {
+	dir := t.TempDir()
+	db, srv := startTestService(t, Options{UploadDir: dir, MaxBlobSize: 1000})
+	uri := srv.URL + uploadsPath
+
+	resp, body := do(t, "POST", uri, nil)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("create status = %d - %s", resp.StatusCode, body)
+	}
+	var status UploadStatus
+	if e := json.Unmarshal([]byte(body), &status); e != nil {
+		t.Fatal(e)
+	}
+	session := uri + "/" + status.ID
+	if loc := resp.Header.Get("Location"); loc != uploadsPath+"/"+status.ID {
+		t.Errorf("create Location = %q", loc)
+	}
+
+	// parts in any order, with a gap
+	blob := []byte("the quick brown fox jumps over the lazy dog")
+	if resp, body := do(t, "PUT", session+"/3?offset=20", blob[20:30]); resp.StatusCode != http.StatusOK {
+		t.Fatalf("put part status = %d - %s", resp.StatusCode, body)
+	}
+	do(t, "PUT", session+"/1?offset=0", blob[:10])
+	if resp, body := do(t, "POST", session+"/commit", nil); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("commit with gaps status = %d - %s", resp.StatusCode, body)
+	}
+
+	// received parts are reported, and resent parts replace earlier ones
+	do(t, "PUT", session+"/2?offset=10", []byte("xx"))
+	do(t, "PUT", session+"/2?offset=10", blob[10:20])
+	do(t, "PUT", session+"/4?offset=30", blob[30:])
+	_, body = do(t, "GET", session, nil)
+	json.Unmarshal([]byte(body), &status)
+	if len(status.Parts) != 4 || status.Parts[1].Size != 10 {
+		t.Fatalf("status parts = %+v", status.Parts)
+	}
+
+	cases := []struct {
+		name, uri string
+		body      []byte
+		code      int
+	}{
+		{"part 0", session + "/0?offset=0", []byte("x"), http.StatusBadRequest},
+		{"no offset", session + "/5", []byte("x"), http.StatusBadRequest},
+		{"empty part", session + "/5?offset=43", []byte{}, http.StatusBadRequest},
+		{"part too large", session + "/5?offset=999", []byte("xx"), http.StatusRequestEntityTooLarge},
+		{"overlapping part", session + "/5?offset=25", []byte("xx"), http.StatusBadRequest},
+		{"unknown session", uri + "/00112233445566778899aabbccddeeff/1?offset=0", []byte("x"), http.StatusNotFound},
+		{"invalid session", uri + "/not-a-session/1?offset=0", []byte("x"), http.StatusNotFound},
+	}
+	for _, c := range cases {
+		if resp, body := do(t, "PUT", c.uri, c.body); resp.StatusCode != c.code {
+			t.Errorf("%s: status = %d - expect %d - %s", c.name, resp.StatusCode, c.code, body)
+		}
+	}
+
+	key := store.KeyOf(blob)
+	if resp, body := do(t, "POST", session+"/commit?key="+store.KeyOf([]byte("x")).String(), nil); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("commit with wrong key status = %d - %s", resp.StatusCode, body)
+	}
+	// parts are verified on commit
+	part := filepath.Join(dir, status.ID, "4"+uploadPartExt)
+	if e := os.WriteFile(part, []byte("the lazy cat"), 0600); e != nil {
+		t.Fatal(e)
+	}
+	if resp, body := do(t, "POST", session+"/commit", nil); resp.StatusCode != http.StatusBadRequest || !strings.Contains(body, "part 4 changed") {
+		t.Errorf("commit with changed part status = %d - %s", resp.StatusCode, body)
+	}
+	do(t, "PUT", session+"/4?offset=30", blob[30:])
+
+	resp, body = do(t, "POST", session+"/commit?key="+key.String(), nil)
+	if resp.StatusCode != http.StatusCreated || body != key.String() {
+		t.Fatalf("commit = %d %q - expect 201 %q", resp.StatusCode, body, key)
+	}
+	if v, e := db.Get(key); e != nil || !bytes.Equal(v, blob) {
+		t.Errorf("stored blob = %q, %v", v, e)
+	}
+
+	// committed sessions are removed
+	if resp, _ := do(t, "GET", session, nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("status after commit = %d - expect 404", resp.StatusCode)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("upload dir has %d entries after commit", len(entries))
+	}
+}
+
+// blobs are assembled in memory, and limited irrespective of options.
+func TestUploadsLimited(t *testing.T) {
+	m, e := newUploadManager(Options{UploadDir: t.TempDir()})
+	if e != nil {
+		t.Fatal(e)
+	}
+	if m.maxsize != uploadMaxBlob {
+		t.Errorf("max blob size = %d - expect %d", m.maxsize, uploadMaxBlob)
+	}
+	status, e := m.create("ip:127.0.0.1")
+	if e != nil {
+		t.Fatal(e)
+	}
+	if _, e := m.putPart(status.ID, 1, uploadMaxBlob, strings.NewReader("x")); !errors.Is(e, store.TooLargeErr) {
+		t.Errorf("putPart beyond limit error = %v - expect TooLargeErr", e)
+	}
+
+	// parts may not overlap other parts
+	if _, e := m.putPart(status.ID, 2, 10, strings.NewReader("0123456789")); e != nil {
+		t.Fatal(e)
+	}
+	if _, e := m.putPart(status.ID, 1, 0, strings.NewReader("0123456789ab")); !errors.Is(e, invalidUploadErr) {
+		t.Errorf("putPart overlapping error = %v - expect invalidUploadErr", e)
+	}
+	if _, e := m.putPart(status.ID, 2, 5, strings.NewReader("0123456789")); e != nil {
+		t.Errorf("putPart replacing error = %v", e)
+	}
+
+	// clients are limited to a few open sessions
+	for i := 1; i < maxClientUploadSessions; i++ {
+		if _, e := m.create("ip:127.0.0.1"); e != nil {
+			t.Fatal(e)
+		}
+	}
+	if _, e := m.create("ip:127.0.0.1"); !errors.Is(e, tooManyUploadsErr) {
+		t.Errorf("create error = %v - expect tooManyUploadsErr", e)
+	}
+	if _, e := m.create("token:other"); e != nil {
+		t.Errorf("create of other client error = %v", e)
+	}
+	m.remove(status.ID)
+	if _, e := m.create("ip:127.0.0.1"); e != nil {
+		t.Errorf("create after remove error = %v", e)
+	}
+}
+
+func TestUploadsDisabled(t *testing.T) {
+	_, srv := startTestService(t, Options{})
+	if resp, _ := do(t, "POST", srv.URL+uploadsPath, nil); resp.StatusCode != http.StatusNotImplemented {
+		t.Errorf("create status = %d - expect 501", resp.StatusCode)
+	}
+}
+
+func TestUploader(t *testing.T) {
+	db, srv := startTestService(t, Options{UploadDir: t.TempDir()})
+	client := testClient(t, srv)
+
+	blob := make([]byte, 10000)
+	rand.New(rand.NewSource(1)).Read(blob)
+
+	// an interrupted upload, with a stale part
+	ctx := context.Background()
+	status, _ := client.uploadRequest(ctx, "POST", "", nil)
+	client.uploadRequest(ctx, "PUT", status.ID+"/1?offset=0", blob[:1024])
+	client.uploadRequest(ctx, "PUT", status.ID+"/2?offset=1024", []byte("stale"))
+
+	// is resumed, sending the missing and stale parts
+	up := &Uploader{Client: client, ID: status.ID, PartSize: 1024}
+	key, e := up.Upload(bytes.NewReader(blob), int64(len(blob)))
+	if e != nil {
+		t.Fatal(e)
+	}
+	want := store.KeyOf(blob)
+	if key != want {
+		t.Errorf("upload key = %s - expect %s", key, want)
+	}
+	if v, e := db.Get(want); e != nil || !bytes.Equal(v, blob) {
+		t.Errorf("stored blob differs - %v", e)
+	}
+
+	// aborted sessions are removed
+	up = client.NewUploader()
+	status, _ = client.uploadRequest(ctx, "POST", "", nil)
+	up.ID = status.ID
+	if e := up.Abort(); e != nil {
+		t.Fatal(e)
+	}
+	if _, e := up.Status(); !errors.Is(e, store.NotFoundErr) {
+		t.Errorf("status after abort = %v - expect NotFoundErr", e)
+	}
+}